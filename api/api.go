@@ -10,7 +10,9 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -24,12 +26,36 @@ const (
 	UnknownSecretSource SecretSource = iota
 	// TalosSecretSource volumes will be handled by https://github.com/spotify/talos.
 	TalosSecretSource
+	// ExecSecretSource volumes will be handled by an external plugin command.
+	ExecSecretSource
+	// HTTPSSecretSource volumes will be handled by a generic HTTPS endpoint
+	// that serves archives of secrets.
+	HTTPSSecretSource
+	// KubernetesSecretSource volumes will be handled by the Kubernetes API
+	// server's Secret objects.
+	KubernetesSecretSource
+	// GeneratedSecretSource volumes will be populated with newly generated
+	// secrets, i.e. random passwords and keys.
+	GeneratedSecretSource
+	// CASecretSource volumes will be populated with short-lived workload
+	// certificates issued by a local CA.
+	CASecretSource
 )
 
 func (s SecretSource) String() string {
 	switch s {
 	case TalosSecretSource:
 		return "Talos"
+	case ExecSecretSource:
+		return "Exec"
+	case HTTPSSecretSource:
+		return "HTTPS"
+	case KubernetesSecretSource:
+		return "Kubernetes"
+	case GeneratedSecretSource:
+		return "Generated"
+	case CASecretSource:
+		return "CA"
 	default:
 		return "Unknown"
 	}
@@ -50,6 +76,16 @@ func (s *SecretSource) UnmarshalJSON(data []byte) error {
 	switch strings.ToLower(str) {
 	case "talos":
 		*s = TalosSecretSource
+	case "exec":
+		*s = ExecSecretSource
+	case "https":
+		*s = HTTPSSecretSource
+	case "kubernetes":
+		*s = KubernetesSecretSource
+	case "generated":
+		*s = GeneratedSecretSource
+	case "ca":
+		*s = CASecretSource
 	default:
 		*s = UnknownSecretSource
 	}
@@ -87,6 +123,58 @@ func (k KeyPair) ToCertificate() (tls.Certificate, error) {
 	return crt, errors.Wrap(err, "cannot parse keypair")
 }
 
+// An Owner represents the user and group that own the files of a Volume.
+type Owner struct {
+	UID int
+	GID int
+}
+
+// A FileMode represents file permission bits. It is encoded as an octal string
+// in JSON, i.e. "0750".
+type FileMode os.FileMode
+
+// MarshalJSON returns an octal string representation of a FileMode.
+func (m FileMode) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("\"%#o\"", uint32(m))), nil
+}
+
+// UnmarshalJSON unmarshals a FileMode from its octal string representation.
+func (m *FileMode) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return errors.Wrapf(err, "cannot unmarshal %s", data)
+	}
+	p, err := strconv.ParseUint(str, 8, 32)
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse file mode %v", str)
+	}
+	if os.FileMode(p)&^os.ModePerm != 0 {
+		return errors.Errorf("file mode %v contains more than permission bits", str)
+	}
+	*m = FileMode(p)
+	return nil
+}
+
+// Modes represents the permissions of a Volume's mountpoint, and of the
+// directories and files within it.
+type Modes struct {
+	Mountpoint FileMode
+	Dir        FileMode
+	File       FileMode
+}
+
+// Notify specifies how to notify the consumer of a Volume that its secrets
+// changed. Either a PID or a Cgroup may be specified.
+type Notify struct {
+	// PID is the process to signal.
+	PID int `json:",omitempty"`
+	// Cgroup is the path of a cgroup, relative to the root of the cgroup
+	// filesystem, whose processes will all be signalled.
+	Cgroup string `json:",omitempty"`
+	// Signal is the name of the signal to send, for example SIGHUP.
+	Signal string `json:",omitempty"`
+}
+
 // A Volume represents a 'secret volume' in which secrets for a particular
 // resource (i.e. a Docker container) will be stored.
 type Volume struct {
@@ -98,6 +186,30 @@ type Volume struct {
 	// Tags may be passed to the secrets.Provider to request or filter specific
 	// secrets.
 	Tags url.Values
+	// Owner optionally specifies the user and group that should own the volume
+	// and its files. They are owned by secret-volume if no Owner is specified.
+	Owner *Owner `json:",omitempty"`
+	// Mounted reports whether the volume's filesystem is actually mounted. It
+	// is only included when getting or listing volumes.
+	Mounted *bool `json:",omitempty"`
+	// Usage is the volume's current usage. It is only included when getting a
+	// single volume.
+	Usage *Usage `json:",omitempty"`
+	// SizeMB optionally specifies the maximum size of the volume in megabytes.
+	SizeMB uint `json:",omitempty"`
+	// Modes optionally specifies the permissions of the volume and its files.
+	Modes *Modes `json:",omitempty"`
+	// Notify optionally specifies a process or cgroup to signal when the
+	// volume's secrets change.
+	Notify *Notify `json:",omitempty"`
+	// Status reports the state of the volume. Volumes created before states
+	// were recorded have no status, and are ready.
+	Status VolumeStatus `json:",omitempty"`
+	// Error explains why the volume failed or is broken.
+	Error string `json:",omitempty"`
+	// Cleanup records attempts to clean up the volume after it was destroyed.
+	// It is only set while the volume is destroying.
+	Cleanup *Cleanup `json:",omitempty"`
 	// The KeyPair is used for secrets.Providers that require authentication.
 	KeyPair KeyPair `json:"-"`
 }
@@ -117,12 +229,37 @@ func ReadVolumeJSON(r io.Reader) (*Volume, error) {
 	return v, nil
 }
 
+// A VolumeStatus reports the state of a Volume.
+type VolumeStatus string
+
+const (
+	// VolumePending volumes are being created.
+	VolumePending VolumeStatus = "pending"
+	// VolumeReady volumes have been created, and contain their secrets.
+	VolumeReady VolumeStatus = "ready"
+	// VolumeFailed volumes occupy an ID, and possibly memory, but cannot be
+	// used because their creation failed part way through. They can only be
+	// destroyed.
+	VolumeFailed VolumeStatus = "failed"
+	// VolumeBroken volumes occupy an ID, and possibly memory, but cannot be
+	// used because their metadata is missing or unreadable. They can only be
+	// destroyed.
+	VolumeBroken VolumeStatus = "broken"
+	// VolumeDestroying volumes have been destroyed, but could not yet be
+	// unmounted because they were busy. They will be cleaned up later.
+	VolumeDestroying VolumeStatus = "destroying"
+)
+
 // A volumeCreation represents the JSON required to create a Volume, including
 // the KeyPair.
 type volumeCreation struct {
 	ID      string
 	Source  SecretSource
 	Tags    url.Values
+	Owner   *Owner
+	SizeMB  uint
+	Modes   *Modes
+	Notify  *Notify
 	KeyPair KeyPair
 }
 
@@ -134,7 +271,7 @@ func ReadVolumeJSONWithKeyPair(r io.Reader) (*Volume, error) {
 	if err := json.NewDecoder(r).Decode(v); err != nil {
 		return nil, errors.Wrap(err, "cannot read JSON")
 	}
-	return &Volume{ID: v.ID, Source: v.Source, Tags: v.Tags, KeyPair: v.KeyPair}, nil
+	return &Volume{ID: v.ID, Source: v.Source, Tags: v.Tags, Owner: v.Owner, SizeMB: v.SizeMB, Modes: v.Modes, Notify: v.Notify, KeyPair: v.KeyPair}, nil
 }
 
 // Volumes represents a slice of Volumes.
@@ -155,6 +292,124 @@ func ReadVolumesJSON(r io.Reader) (Volumes, error) {
 	return *v, nil
 }
 
+// Usage represents the disk usage of a Volume.
+type Usage struct {
+	// Files is the number of files in the Volume.
+	Files int
+	// UsedBytes is the number of bytes used by the Volume.
+	UsedBytes int64
+	// SizeBytes is the maximum size of the Volume.
+	SizeBytes int64
+	// Modified is when the most recently modified file in the Volume was
+	// modified.
+	Modified time.Time
+}
+
+// Capacity represents the memory allocated to and used by all Volumes.
+type Capacity struct {
+	// BudgetBytes is the total number of bytes that may be allocated to
+	// Volumes. Zero means there is no budget.
+	BudgetBytes int64
+	// AllocatedBytes is the sum of the maximum sizes of all Volumes.
+	AllocatedBytes int64
+	// UsedBytes is the number of bytes used by the files of all Volumes.
+	UsedBytes int64
+	// Volumes is the number of extant Volumes.
+	Volumes int
+}
+
+// WriteJSON writes a JSON representation of Capacity to the supplied io.Writer.
+func (c *Capacity) WriteJSON(w io.Writer) error {
+	return errors.Wrapf(json.NewEncoder(w).Encode(c), "cannot write JSON for %+v", c)
+}
+
+// ReadCapacityJSON creates Capacity by reading its JSON representation from the
+// supplied io.Reader.
+func ReadCapacityJSON(r io.Reader) (*Capacity, error) {
+	c := &Capacity{}
+	if err := json.NewDecoder(r).Decode(c); err != nil {
+		return nil, errors.Wrap(err, "cannot read JSON")
+	}
+	return c, nil
+}
+
+// A Cleanup represents a destroyed Volume that could not yet be unmounted, and
+// will be cleaned up later.
+type Cleanup struct {
+	// ID is the ID of the destroyed Volume.
+	ID string
+	// Since is when the Volume was destroyed.
+	Since time.Time
+	// Attempts is the number of times unmounting the Volume has been attempted.
+	Attempts int
+	// Error is the error returned by the most recent attempt.
+	Error string
+}
+
+// Cleanups represents a slice of Cleanups.
+type Cleanups []*Cleanup
+
+// WriteJSON writes a JSON representation of Cleanups to the supplied io.Writer.
+func (cs Cleanups) WriteJSON(w io.Writer) error {
+	return errors.Wrapf(json.NewEncoder(w).Encode(cs), "cannot write JSON for %v", cs)
+}
+
+// ReadCleanupsJSON creates Cleanups by reading their JSON representation from
+// the supplied io.Reader.
+func ReadCleanupsJSON(r io.Reader) (Cleanups, error) {
+	cs := &Cleanups{}
+	if err := json.NewDecoder(r).Decode(cs); err != nil {
+		return nil, errors.Wrap(err, "cannot read JSON")
+	}
+	return *cs, nil
+}
+
+// A FileHash identifies the contents of a file in a Volume without revealing
+// them.
+type FileHash struct {
+	// Path is the path of the file relative to the root of the Volume.
+	Path string
+	// HMAC is the hex encoded HMAC-SHA256 of the file's contents, keyed by a
+	// secret generated when secret-volume starts. Unlike a plain hash it
+	// cannot be used to confirm a guess at the file's contents. It changes
+	// each time secret-volume restarts.
+	HMAC string
+}
+
+// A Refresh describes how the files of a Volume changed when its secrets were
+// refreshed or updated.
+type Refresh struct {
+	// ID is the ID of the refreshed Volume.
+	ID string
+	// Version is incremented each time the Volume is refreshed or updated.
+	Version int
+	// Time is when the Volume was refreshed.
+	Time time.Time
+	// Added files did not exist before the Volume was refreshed.
+	Added []FileHash
+	// Removed files no longer exist. Their hashes are those of their
+	// contents before the Volume was refreshed.
+	Removed []FileHash
+	// Changed files have new contents.
+	Changed []FileHash
+}
+
+// WriteJSON writes a JSON representation of a Refresh to the supplied
+// io.Writer.
+func (rf *Refresh) WriteJSON(w io.Writer) error {
+	return errors.Wrapf(json.NewEncoder(w).Encode(rf), "cannot write JSON for refresh of %v", rf.ID)
+}
+
+// ReadRefreshJSON creates a Refresh by reading its JSON representation from
+// the supplied io.Reader.
+func ReadRefreshJSON(r io.Reader) (*Refresh, error) {
+	rf := &Refresh{}
+	if err := json.NewDecoder(r).Decode(rf); err != nil {
+		return nil, errors.Wrap(err, "cannot read JSON")
+	}
+	return rf, nil
+}
+
 func (v *Volume) String() string {
 	return fmt.Sprintf("Volume id=%v source=%v, tags=%v, keypair=%+v", v.ID, v.Source, v.Tags, v.KeyPair)
 }
@@ -4,8 +4,16 @@
 package cmd
 
 import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/negz/secret-volume/api"
 	"github.com/negz/secret-volume/secrets"
@@ -21,6 +29,32 @@ import (
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+// serve serves HTTP until SIGTERM or SIGINT is received, at which point it calls
+// the supplied cancel function then stops the server gracefully.
+func serve(s *http.Server, hd *httpdown.HTTP, cancel context.CancelFunc) error {
+	hs, err := hd.ListenAndServe(s)
+	if err != nil {
+		return err
+	}
+	waiterr := make(chan error, 1)
+	go func() { waiterr <- hs.Wait() }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-waiterr:
+		return err
+	case <-signals:
+		signal.Stop(signals)
+		log.Info("stopping", zap.Duration("closeAfter", hd.StopTimeout), zap.Duration("killAfter", hd.KillTimeout))
+		cancel()
+		if err := hs.Stop(); err != nil {
+			return err
+		}
+		return <-waiterr
+	}
+}
+
 func setupTalosLb(ns, srv string) lb.LoadBalancer {
 	var lib dns.Lookup
 	if ns == "" {
@@ -35,6 +69,54 @@ func setupTalosLb(ns, srv string) lb.LoadBalancer {
 	return lb.New(&lb.Config{Dns: lib, Strategy: random.RandomStrategy}, srv)
 }
 
+func talosOptions(ca string) []secrets.TalosProducerOption {
+	o := []secrets.TalosProducerOption{}
+	if ca != "" {
+		c, err := ioutil.ReadFile(ca)
+		kingpin.FatalIfError(err, "cannot read Talos CA certificates")
+		o = append(o, secrets.TalosCA(c))
+	}
+	return o
+}
+
+func httpsOptions(hdr map[string]string, token, ca string) []secrets.HTTPSProducerOption {
+	o := make([]secrets.HTTPSProducerOption, 0, len(hdr)+2)
+	for k, v := range hdr {
+		o = append(o, secrets.HTTPSHeader(k, v))
+	}
+	if token != "" {
+		t, err := ioutil.ReadFile(token)
+		kingpin.FatalIfError(err, "cannot read HTTPS bearer token")
+		o = append(o, secrets.HTTPSBearerToken(strings.TrimSpace(string(t))))
+	}
+	if ca != "" {
+		c, err := ioutil.ReadFile(ca)
+		kingpin.FatalIfError(err, "cannot read HTTPS CA certificates")
+		o = append(o, secrets.HTTPSCA(c))
+	}
+	return o
+}
+
+func kubernetesOptions(token, cert, key, ca string) []secrets.KubernetesProducerOption {
+	o := []secrets.KubernetesProducerOption{}
+	if token != "" {
+		t, err := ioutil.ReadFile(token)
+		kingpin.FatalIfError(err, "cannot read Kubernetes bearer token")
+		o = append(o, secrets.KubernetesToken(strings.TrimSpace(string(t))))
+	}
+	if cert != "" || key != "" {
+		kp, err := api.NewKeyPair(cert, key)
+		kingpin.FatalIfError(err, "cannot read Kubernetes keypair")
+		o = append(o, secrets.KubernetesKeyPair(kp))
+	}
+	if ca != "" {
+		c, err := ioutil.ReadFile(ca)
+		kingpin.FatalIfError(err, "cannot read Kubernetes CA certificates")
+		o = append(o, secrets.KubernetesCA(c))
+	}
+	return o
+}
+
 // Run is effectively the main() of the secretvolume binary.
 // It lives here in its own package to allow convenient use of Go build tags
 // to control debug logging and system calls.
@@ -43,32 +125,141 @@ func Run() {
 		app = kingpin.New(filepath.Base(os.Args[0]), "Manages sets of files containing secrets.").DefaultEnvars()
 
 		talos  = app.Flag("talos-srv", "Enables Talos by providing an SRV record at which to find it.").String()
+		tca    = app.Flag("talos-ca-file", "Verify Talos using the CA certificates in this file.").ExistingFile()
+		plugin = app.Flag("exec-plugin", "Enables the exec producer by providing a plugin command to run.").String()
+		ptime  = app.Flag("exec-timeout", "Kill the exec plugin if it runs for longer than this.").Default("15s").Duration()
+		hurl   = app.Flag("https-url", "Enables the HTTPS producer by providing a URL template at which to find archives.").String()
+		hhdr   = app.Flag("https-header", "Send this header with requests to the HTTPS producer (key=value).").StringMap()
+		htoken = app.Flag("https-token-file", "Authenticate to the HTTPS producer using the bearer token in this file.").ExistingFile()
+		hca    = app.Flag("https-ca-file", "Verify the HTTPS producer's endpoint using the CA certificates in this file.").ExistingFile()
+		k8s    = app.Flag("kubernetes-server", "Enables the Kubernetes producer by providing an API server URL.").String()
+		ktoken = app.Flag("kubernetes-token-file", "Authenticate to Kubernetes using the bearer token in this file.").ExistingFile()
+		kcert  = app.Flag("kubernetes-cert-file", "Authenticate to Kubernetes using the client certificate in this file.").ExistingFile()
+		kkey   = app.Flag("kubernetes-key-file", "Authenticate to Kubernetes using the client key in this file.").ExistingFile()
+		kca    = app.Flag("kubernetes-ca-file", "Verify the Kubernetes API server using the CA certificates in this file.").ExistingFile()
+		gen    = app.Flag("generated", "Enables the producer of generated (i.e. throwaway) secrets.").Bool()
+		cacert = app.Flag("ca-cert-file", "Enables the CA producer by providing the CA certificate in this file.").ExistingFile()
+		cakey  = app.Flag("ca-key-file", "Sign workload certificates using the CA key in this file.").ExistingFile()
+		caroot = app.Flag("ca-client-roots-file", "Verify CA producer callers using the CA certificates in this file.").ExistingFile()
+		cattl  = app.Flag("ca-validity", "Issue workload certificates that are valid for this long.").Default("24h").Duration()
 		addr   = app.Flag("addr", "Address at which to serve requests (host:port).").Default(":10002").String()
 		ns     = app.Flag("ns", "DNS server to use to lookup SRV records (host:port).").String()
 		parent = app.Flag("parent", "Directory under which to mount secret volumes.").Default("/secrets").String()
 		virt   = app.Flag("virtual", "Use an in-memory filesystem and a no-op mounter.").Bool()
+		noswap = app.Flag("no-swap", "Prevent secrets being swapped to disk, using tmpfs noswap or falling back to ramfs.").Bool()
+		unpriv = app.Flag("unprivileged", "Store secrets in plain directories, for running without root.").Bool()
 		stop   = app.Flag("close-after", "Wait this long at shutdown before closing HTTP connections.").Default("1m").Duration()
 		kill   = app.Flag("kill-after", "Wait this long at shutdown before exiting.").Default("2m").Duration()
 		js     = app.Flag("json-secrets", "Store all secrets in a JSON file at this path.").String()
+		omin   = app.Flag("owner-min", "Minimum UID and GID volumes may request to be owned by.").Default("1000").Int()
+		size   = app.Flag("size-mb", "Size in megabytes of each secret volume, unless it requests otherwise.").Default("100").Uint()
+		maxsz  = app.Flag("max-size-mb", "Maximum size in megabytes a secret volume may request.").Default("100").Uint()
+		maxmd  = app.Flag("max-mode", "Maximum octal permissions a secret volume may request for its mountpoint, directories, and files.").String()
+		budget = app.Flag("memory-budget-mb", "Total size in megabytes that may be allocated to secret volumes. Zero means no budget.").Default("0").Uint()
+		ures   = app.Flag("unmount-retries", "Retry unmounting busy volumes this many times when they are destroyed.").Default("3").Int()
+		uback  = app.Flag("unmount-backoff", "Wait this long before first retrying to unmount a busy volume, doubling with each retry.").Default("100ms").Duration()
+		lazy   = app.Flag("lazy-unmount", "Lazily unmount volumes that remain busy after retrying.").Bool()
+		defcl  = app.Flag("defer-cleanup", "Retry unmounting volumes that remain busy at this interval in the background. Zero disables deferred cleanup.").Default("0").Duration()
+		clatt  = app.Flag("cleanup-attempts", "Give up cleaning up a volume in the background after this many attempts. Zero means no limit.").Default("100").Int()
+		ctime  = app.Flag("async-timeout", "Remove volumes that take longer than this to create in the background.").Default("5m").Duration()
+		omax   = app.Flag("owner-max", "Maximum UID and GID volumes may request to be owned by. Volumes may not request an owner unless set.").Default("-1").Int()
+		mdir   = app.Flag("metadata-dir", "Store volume metadata as JSON files in this directory. Defaults to the parent directory with a .metadata suffix.").String()
+		mdb    = app.Flag("metadata-db", "Store volume metadata in an embedded database in this file.").String()
+		verf   = app.Flag("version-file", "Describe the changes made when a volume is refreshed or updated in a JSON file at this path. Empty disables the file.").Default(".version").String()
+		nsig   = app.Flag("notify-signals", "Permit volumes to request that a PID or cgroup be signalled when their secrets change.").Bool()
+		cgroot = app.Flag("cgroup-root", "Root of the cgroup filesystem, relative to which volumes specify cgroups to signal.").Default("/sys/fs/cgroup").String()
+		hook   = app.Flag("notify-hook", "Run this command when the secrets of any volume change.").String()
+		htime  = app.Flag("notify-hook-timeout", "Kill the notification hook if it runs for longer than this.").Default("15s").Duration()
+		retain = app.Flag("retain-credentials", "Retain the keypair of each volume in encrypted, locked memory so that refreshes and updates may omit it.").Bool()
+		credkb = app.Flag("credentials-memory-kb", "Lock this many kilobytes of memory in which to retain keypairs.").Default("1024").Uint()
 	)
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
 
-	m, fs, err := setupFs(*virt, *parent)
+	m, fs, err := setupFs(*virt, *noswap, *unpriv, *parent)
 	kingpin.FatalIfError(err, "cannot setup filesystem and parenter")
 
 	sps := make(map[api.SecretSource]secrets.Producer)
 	if *talos != "" {
-		sp, terr := secrets.NewTalosProducer(setupTalosLb(*ns, *talos))
+		sp, terr := secrets.NewTalosProducer(setupTalosLb(*ns, *talos), talosOptions(*tca)...)
 		kingpin.FatalIfError(terr, "cannot setup Talos secret producer")
 		sps[api.TalosSecretSource] = sp
 	}
+	if *plugin != "" {
+		sp, perr := secrets.NewExecProducer(*plugin, secrets.ExecTimeout(*ptime))
+		kingpin.FatalIfError(perr, "cannot setup exec secret producer")
+		sps[api.ExecSecretSource] = sp
+	}
+	if *hurl != "" {
+		sp, herr := secrets.NewHTTPSProducer(*hurl, httpsOptions(*hhdr, *htoken, *hca)...)
+		kingpin.FatalIfError(herr, "cannot setup HTTPS secret producer")
+		sps[api.HTTPSSecretSource] = sp
+	}
+	if *k8s != "" {
+		sp, kerr := secrets.NewKubernetesProducer(*k8s, kubernetesOptions(*ktoken, *kcert, *kkey, *kca)...)
+		kingpin.FatalIfError(kerr, "cannot setup Kubernetes secret producer")
+		sps[api.KubernetesSecretSource] = sp
+	}
+	if *gen {
+		sp, gerr := secrets.NewGeneratedProducer()
+		kingpin.FatalIfError(gerr, "cannot setup generated secret producer")
+		sps[api.GeneratedSecretSource] = sp
+	}
+	if *cacert != "" {
+		kp, kerr := api.NewKeyPair(*cacert, *cakey)
+		kingpin.FatalIfError(kerr, "cannot read CA keypair")
+		cpo := []secrets.CAProducerOption{secrets.CAValidity(*cattl)}
+		if *caroot != "" {
+			r, rerr := ioutil.ReadFile(*caroot)
+			kingpin.FatalIfError(rerr, "cannot read CA client roots")
+			cpo = append(cpo, secrets.CAClientRoots(r))
+		}
+		sp, cerr := secrets.NewCAProducer(kp, cpo...)
+		kingpin.FatalIfError(cerr, "cannot setup CA secret producer")
+		sps[api.CASecretSource] = sp
+	}
 
-	var vmo []volume.ManagerOption
+	vmo := []volume.ManagerOption{volume.Filesystem(fs), volume.VolumeSizeMB(*size, *maxsz), volume.MemoryBudgetMB(*budget), volume.UnmountRetries(*ures, *uback), volume.VersionFile(*verf), volume.CreateTimeout(*ctime)}
+	if *lazy {
+		vmo = append(vmo, volume.LazyUnmount())
+	}
+	if *defcl > 0 {
+		vmo = append(vmo, volume.DeferCleanup(*defcl))
+		vmo = append(vmo, volume.MaxCleanupAttempts(*clatt))
+	}
 	if *js != "" {
-		vmo = []volume.ManagerOption{volume.Filesystem(fs), volume.WriteJSONSecrets(*js)}
-	} else {
-		vmo = []volume.ManagerOption{volume.Filesystem(fs)}
+		vmo = append(vmo, volume.WriteJSONSecrets(*js))
+	}
+	if *omax >= 0 {
+		vmo = append(vmo, volume.OwnerRange(*omin, *omax))
+	}
+	if *nsig {
+		vmo = append(vmo, volume.NotifySignals(*cgroot))
+	}
+	if *hook != "" {
+		vmo = append(vmo, volume.NotifyHook(*htime, *hook))
+	}
+	if *retain {
+		vmo = append(vmo, volume.RetainCredentials(*credkb))
+	}
+	if *maxmd != "" {
+		md, perr := strconv.ParseUint(*maxmd, 8, 32)
+		kingpin.FatalIfError(perr, "cannot parse maximum mode")
+		m := api.FileMode(md)
+		vmo = append(vmo, volume.MaxModes(api.Modes{Mountpoint: m, Dir: m, File: m}))
+	}
+
+	var ms volume.MetadataStore
+	switch {
+	case *mdb != "":
+		ms, err = volume.NewBoltMetadataStore(*mdb)
+		kingpin.FatalIfError(err, "cannot setup metadata database")
+	case *mdir != "":
+		ms, err = volume.NewDirMetadataStore(*mdir, volume.DirMetadataFilesystem(fs))
+		kingpin.FatalIfError(err, "cannot setup metadata directory")
+	}
+	if ms != nil {
+		vmo = append(vmo, volume.Metadata(ms))
 	}
 
 	vm, err := volume.NewManager(m, sps, vmo...)
@@ -77,7 +268,14 @@ func Run() {
 	handlers, err := server.NewHTTPHandlers(vm)
 	kingpin.FatalIfError(err, "cannot setup HTTP handlers")
 
-	hd := &httpdown.HTTP{StopTimeout: *stop, KillTimeout: *kill}
-	http := handlers.HTTPServer(*addr)
-	kingpin.FatalIfError(httpdown.ListenAndServe(http, hd), "HTTP server error")
+	// Requests are cancelled when the server stops, so that volumes still being
+	// created are rolled back rather than left half written.
+	ctx, cancel := context.WithCancel(context.Background())
+	hs := handlers.HTTPServer(*addr)
+	hs.BaseContext = func(net.Listener) context.Context { return ctx }
+	err = serve(hs, &httpdown.HTTP{StopTimeout: *stop, KillTimeout: *kill}, cancel)
+	if ms != nil {
+		ms.Close()
+	}
+	kingpin.FatalIfError(err, "HTTP server error")
 }
@@ -7,9 +7,10 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/spf13/afero"
+	"github.com/uber-go/zap"
 )
 
-func setupFs(virt bool, root string) (volume.Mounter, afero.Fs, error) {
+func setupFs(virt, noswap, unpriv bool, root string) (volume.Mounter, afero.Fs, error) {
 	if virt {
 		log.Debug("Using in-memory filesystem and noop mounter")
 		fs := afero.NewMemMapFs()
@@ -18,6 +19,12 @@ func setupFs(virt bool, root string) (volume.Mounter, afero.Fs, error) {
 		}
 		return volume.NewNoopMounter(root), fs, nil
 	}
+	if unpriv {
+		return setupDirFs(root)
+	}
+	if noswap {
+		return setupNoSwapFs(root)
+	}
 	tmpfs, err := volume.NewTmpFsMounter(root)
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "cannot setup tmpfs mounter")
@@ -26,3 +33,47 @@ func setupFs(virt bool, root string) (volume.Mounter, afero.Fs, error) {
 	log.Debug("Using OS filesystem and tmpfs mounter")
 	return tmpfs, afero.NewOsFs(), nil
 }
+
+func setupNoSwapFs(root string) (volume.Mounter, afero.Fs, error) {
+	supported, err := volume.NoSwapSupported()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot determine whether tmpfs supports noswap")
+	}
+	if supported {
+		tmpfs, err := volume.NewTmpFsMounter(root, volume.NoSwap())
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "cannot setup tmpfs mounter")
+		}
+		log.Debug("Using OS filesystem and tmpfs mounter with noswap")
+		return tmpfs, afero.NewOsFs(), nil
+	}
+
+	log.Warn("Kernel does not support tmpfs noswap. Falling back to ramfs, which has no kernel enforced size limit.",
+		zap.String("root", root))
+	ramfs, err := volume.NewRamFsMounter(root)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot setup ramfs mounter")
+	}
+	return ramfs, afero.NewOsFs(), nil
+}
+
+func setupDirFs(root string) (volume.Mounter, afero.Fs, error) {
+	fs := afero.NewOsFs()
+	if err := fs.MkdirAll(root, 0700); err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot create %v", root)
+	}
+	mem, err := volume.MemoryBacked(root)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot determine whether parent directory is memory-backed")
+	}
+	if !mem {
+		log.Warn("INSECURE: parent directory is not on a tmpfs or ramfs. Secrets will be written to persistent storage!",
+			zap.String("root", root))
+	}
+	dirs, err := volume.NewDirMounter(root, volume.DirFilesystem(fs))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot setup dir mounter")
+	}
+	log.Debug("Using OS filesystem and dir mounter")
+	return dirs, fs, nil
+}
@@ -4,11 +4,26 @@ package cmd
 
 import (
 	"github.com/negz/secret-volume/volume"
+	"github.com/pkg/errors"
 
 	"github.com/spf13/afero"
+	"github.com/uber-go/zap"
 )
 
-func setupFs(_ bool, root string) (volume.Mounter, afero.Fs, error) {
+func setupFs(_, _, unpriv bool, root string) (volume.Mounter, afero.Fs, error) {
+	if unpriv {
+		fs := afero.NewOsFs()
+		if err := fs.MkdirAll(root, 0700); err != nil {
+			return nil, nil, errors.Wrapf(err, "cannot create %v", root)
+		}
+		log.Warn("INSECURE: cannot determine whether parent directory is memory-backed. Secrets may be written to persistent storage!",
+			zap.String("root", root))
+		dirs, err := volume.NewDirMounter(root, volume.DirFilesystem(fs))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "cannot setup dir mounter")
+		}
+		return dirs, fs, nil
+	}
 	// The tmpfs mounter will only build on Linux
 	log.Debug("Forcing in-memory filesystem and noop mounter due to non-Linux environment")
 	fs := afero.NewMemMapFs()
@@ -0,0 +1,244 @@
+package secrets
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/uber-go/zap"
+
+	"github.com/negz/secret-volume/api"
+)
+
+// CADNSTag is the volume tag used to request DNS subject alternative names for
+// a workload certificate. Each name must be the caller's verified identity or
+// a subdomain thereof.
+const CADNSTag = "dns"
+
+// caBackdate is how long before their issue workload certificates are valid
+// from, to tolerate clock skew.
+const caBackdate = 5 * time.Minute
+
+type caProducer struct {
+	crt      *x509.Certificate
+	key      interface{}
+	caPEM    []byte
+	roots    *x509.CertPool
+	validity time.Duration
+}
+
+// A CAProducerOption represents an argument to NewCAProducer.
+type CAProducerOption func(*caProducer) error
+
+// CAValidity specifies how long issued workload certificates are valid for.
+// Certificates are renewed once two thirds of their validity has elapsed. It
+// defaults to 24 hours.
+func CAValidity(d time.Duration) CAProducerOption {
+	return func(sp *caProducer) error {
+		sp.validity = d
+		return nil
+	}
+}
+
+// CAClientRoots specifies the PEM encoded CA certificates used to verify the
+// identity of callers requesting workload certificates. Callers are verified
+// against the issuing CA's own certificate by default.
+func CAClientRoots(roots []byte) CAProducerOption {
+	return func(sp *caProducer) error {
+		sp.roots = x509.NewCertPool()
+		if !sp.roots.AppendCertsFromPEM(roots) {
+			return errors.New("cannot parse client root certificates")
+		}
+		return nil
+	}
+}
+
+// NewCAProducer builds a Producer that issues short-lived workload certificates
+// signed by the supplied CA KeyPair. Callers must supply a KeyPair that can be
+// verified by the client roots. The issued certificate's common name is the
+// common name of the caller's certificate, and its organizational unit is the
+// volume ID. Each volume contains cert.pem, key.pem, and ca.pem.
+func NewCAProducer(ca api.KeyPair, cpo ...CAProducerOption) (Producer, error) {
+	c, err := ca.ToCertificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse CA keypair")
+	}
+	crt, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse CA certificate")
+	}
+	if !crt.IsCA {
+		return nil, errors.New("certificate is not a CA")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(crt)
+	sp := &caProducer{crt, c.PrivateKey, []byte(ca.Certificate), roots, 24 * time.Hour}
+	for _, o := range cpo {
+		if err := o(sp); err != nil {
+			return nil, errors.Wrap(err, "cannot apply CA producer option")
+		}
+	}
+	return sp, nil
+}
+
+// identity returns the verified identity of the caller that supplied the
+// volume's KeyPair.
+func (sp *caProducer) identity(v *api.Volume) (string, error) {
+	c, err := v.KeyPair.ToCertificate()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot parse caller keypair")
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return "", errors.Wrap(err, "cannot parse caller certificate")
+	}
+	inter := x509.NewCertPool()
+	for _, b := range c.Certificate[1:] {
+		ic, err := x509.ParseCertificate(b)
+		if err != nil {
+			return "", errors.Wrap(err, "cannot parse caller intermediate certificate")
+		}
+		inter.AddCert(ic)
+	}
+	o := x509.VerifyOptions{Roots: sp.roots, Intermediates: inter, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+	if _, err := leaf.Verify(o); err != nil {
+		return "", errors.Wrap(err, "cannot verify caller certificate")
+	}
+	if leaf.Subject.CommonName == "" {
+		return "", errors.New("caller certificate has no common name")
+	}
+	return leaf.Subject.CommonName, nil
+}
+
+func dnsNames(identity string, requested []string) ([]string, error) {
+	for _, n := range requested {
+		if n != identity && !strings.HasSuffix(n, "."+identity) {
+			return nil, errors.Errorf("%v may not request DNS name %v", identity, n)
+		}
+	}
+	return requested, nil
+}
+
+func (sp *caProducer) For(_ context.Context, v *api.Volume) (api.Secrets, error) {
+	id, err := sp.identity(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot determine caller identity")
+	}
+	dns, err := dnsNames(id, v.Tags[CADNSTag])
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot determine DNS names")
+	}
+	// Don't hold on to the caller's KeyPair longer than necessary.
+	return sp.issue(&api.Volume{ID: v.ID, Source: v.Source, Tags: v.Tags}, id, dns)
+}
+
+func (sp *caProducer) issue(v *api.Volume, identity string, dns []string) (api.Secrets, error) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot generate workload key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot generate serial number")
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: identity, OrganizationalUnit: []string{v.ID}},
+		DNSNames:     dns,
+		NotBefore:    now.Add(-caBackdate),
+		NotAfter:     now.Add(sp.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, sp.crt, k.Public(), sp.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot issue workload certificate")
+	}
+	key, err := privateKeyPEM(k)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("issued workload certificate",
+		zap.String("id", v.ID),
+		zap.String("identity", identity),
+		zap.Time("expiry", tmpl.NotAfter))
+	fs := NewFiles(v,
+		File{Path: "cert.pem", Data: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})},
+		File{Path: "key.pem", Data: key},
+		File{Path: "ca.pem", Data: sp.caPEM},
+	)
+	return &caSecrets{fs, sp, v, identity, dns, renewAt(now, tmpl.NotAfter)}, nil
+}
+
+// renewAt returns the time at which a certificate issued at the supplied time
+// should be renewed, i.e. once two thirds of its validity has elapsed.
+func renewAt(issued, expiry time.Time) time.Time {
+	return issued.Add(expiry.Sub(issued) * 2 / 3)
+}
+
+// Resume returns the Renewable secrets of a volume given the workload
+// certificate previously issued to it. The certificate must have been issued by
+// this CA for the volume. The identity and DNS names for which it was issued
+// are used to renew it.
+func (sp *caProducer) Resume(v *api.Volume, fs afero.Fs, root string) (Renewable, error) {
+	p := path.Join(root, "cert.pem")
+	b, err := afero.ReadFile(fs, p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read workload certificate %v", p)
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, errors.Errorf("workload certificate %v is not PEM encoded", p)
+	}
+	crt, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse workload certificate")
+	}
+	if err := crt.CheckSignatureFrom(sp.crt); err != nil {
+		return nil, errors.Wrap(err, "workload certificate was not issued by this CA")
+	}
+	if len(crt.Subject.OrganizationalUnit) != 1 || crt.Subject.OrganizationalUnit[0] != v.ID {
+		return nil, errors.Errorf("workload certificate was not issued for volume %v", v.ID)
+	}
+	id := crt.Subject.CommonName
+	if id == "" {
+		return nil, errors.New("workload certificate has no common name")
+	}
+	dns, err := dnsNames(id, crt.DNSNames)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot determine DNS names")
+	}
+	cv := &api.Volume{ID: v.ID, Source: v.Source, Tags: v.Tags}
+	return &caSecrets{nil, sp, cv, id, dns, renewAt(crt.NotBefore.Add(caBackdate), crt.NotAfter)}, nil
+}
+
+// caSecrets are workload certificate Secrets. They remember the identity for
+// which they were issued in order to be renewed without re-verifying the
+// caller. Resumed caSecrets have no Secrets; they may only be renewed.
+type caSecrets struct {
+	api.Secrets
+	sp       *caProducer
+	v        *api.Volume
+	identity string
+	dns      []string
+	renewAt  time.Time
+}
+
+func (s *caSecrets) RenewAt() time.Time {
+	return s.renewAt
+}
+
+func (s *caSecrets) Renew() (api.Secrets, error) {
+	return s.sp.issue(s.v, s.identity, s.dns)
+}
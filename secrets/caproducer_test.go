@@ -0,0 +1,246 @@
+package secrets
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/negz/secret-volume/api"
+)
+
+// testKeyPair creates a KeyPair signed by the supplied parent, or self-signed
+// if parent is nil.
+func testKeyPair(t *testing.T, cn string, ca bool, parent *x509.Certificate, parentKey interface{}) (api.KeyPair, *x509.Certificate, interface{}) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, k
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, k.Public(), parentKey)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(): %v", err)
+	}
+	crt, _ := x509.ParseCertificate(der)
+	key, _ := x509.MarshalECPrivateKey(k)
+	return api.KeyPair{
+		Certificate: api.PEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKey:  api.PEM(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})),
+	}, crt, k
+}
+
+func TestCAProducer(t *testing.T) {
+	ca, caCrt, caKey := testKeyPair(t, "ca", true, nil, nil)
+	client, _, _ := testKeyPair(t, "svc.example.org", false, caCrt, caKey)
+	untrusted, _, _ := testKeyPair(t, "svc.example.org", false, nil, nil)
+
+	sp, err := NewCAProducer(ca, CAValidity(time.Hour))
+	if err != nil {
+		t.Fatalf("NewCAProducer(): %v", err)
+	}
+	if _, err := NewCAProducer(client); err == nil {
+		t.Errorf("NewCAProducer(%v): want error for non-CA certificate, got nil", "svc.example.org")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCrt)
+
+	var caProducerTests = []struct {
+		name string
+		kp   api.KeyPair
+		dns  []string
+		err  bool
+	}{
+		{"Valid", client, []string{"svc.example.org", "api.svc.example.org"}, false},
+		{"NoDNS", client, nil, false},
+		{"UnauthorizedDNS", client, []string{"evil.example.org"}, true},
+		{"UntrustedCaller", untrusted, nil, true},
+		{"NoKeyPair", api.KeyPair{}, nil, true},
+	}
+
+	for _, tt := range caProducerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &api.Volume{ID: "workload", Source: api.CASecretSource, Tags: url.Values{CADNSTag: tt.dns}, KeyPair: tt.kp}
+			s, err := sp.For(context.Background(), v)
+			if tt.err {
+				if err == nil {
+					t.Errorf("sp.For(context.Background(), %v): want error, got nil", v.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("sp.For(context.Background(), %v): %v", v.ID, err)
+				return
+			}
+
+			crt := checkWorkloadSecrets(t, s, roots)
+			if crt == nil {
+				return
+			}
+			if crt.Subject.CommonName != "svc.example.org" {
+				t.Errorf("crt.Subject.CommonName: want %v, got %v", "svc.example.org", crt.Subject.CommonName)
+			}
+			if !reflect.DeepEqual(crt.Subject.OrganizationalUnit, []string{v.ID}) {
+				t.Errorf("crt.Subject.OrganizationalUnit: want %v, got %v", []string{v.ID}, crt.Subject.OrganizationalUnit)
+			}
+			if !reflect.DeepEqual(crt.DNSNames, tt.dns) {
+				t.Errorf("crt.DNSNames: want %v, got %v", tt.dns, crt.DNSNames)
+			}
+
+			r, ok := s.(Renewable)
+			if !ok {
+				t.Errorf("sp.For(context.Background(), %v): secrets are not Renewable", v.ID)
+				return
+			}
+			if !r.RenewAt().Before(crt.NotAfter) {
+				t.Errorf("r.RenewAt(): %v is not before expiry %v", r.RenewAt(), crt.NotAfter)
+			}
+			rs, err := r.Renew()
+			if err != nil {
+				t.Errorf("r.Renew(): %v", err)
+				return
+			}
+			if rc := checkWorkloadSecrets(t, rs, roots); rc != nil && rc.SerialNumber.Cmp(crt.SerialNumber) == 0 {
+				t.Errorf("r.Renew(): want new certificate, got serial %v again", rc.SerialNumber)
+			}
+		})
+	}
+}
+
+// checkWorkloadSecrets ensures the supplied Secrets contain a valid workload
+// certificate, returning it.
+func checkWorkloadSecrets(t *testing.T, s api.Secrets, roots *x509.CertPool) *x509.Certificate {
+	files := map[string][]byte{}
+	for {
+		h, err := s.Next()
+		if err != nil {
+			break
+		}
+		files[h.Path], _ = ioutil.ReadAll(s)
+	}
+	for _, f := range []string{"cert.pem", "key.pem", "ca.pem"} {
+		if _, ok := files[f]; !ok {
+			t.Errorf("want file %v, got none", f)
+			return nil
+		}
+	}
+	b, _ := pem.Decode(files["cert.pem"])
+	if b == nil {
+		t.Errorf("pem.Decode(%v): not PEM encoded", "cert.pem")
+		return nil
+	}
+	crt, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		t.Errorf("x509.ParseCertificate(): %v", err)
+		return nil
+	}
+	if _, err := crt.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("crt.Verify(): %v", err)
+	}
+	return crt
+}
+
+func TestCAProducerResume(t *testing.T) {
+	ca, caCrt, caKey := testKeyPair(t, "ca", true, nil, nil)
+	other, _, _ := testKeyPair(t, "other", true, nil, nil)
+	client, _, _ := testKeyPair(t, "svc.example.org", false, caCrt, caKey)
+
+	sp, err := NewCAProducer(ca, CAValidity(time.Hour))
+	if err != nil {
+		t.Fatalf("NewCAProducer(): %v", err)
+	}
+	osp, err := NewCAProducer(other, CAValidity(time.Hour))
+	if err != nil {
+		t.Fatalf("NewCAProducer(): %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCrt)
+
+	v := &api.Volume{ID: "workload", Source: api.CASecretSource, Tags: url.Values{CADNSTag: []string{"api.svc.example.org"}}, KeyPair: client}
+	s, err := sp.For(context.Background(), v)
+	if err != nil {
+		t.Fatalf("sp.For(context.Background(), %v): %v", v.ID, err)
+	}
+	fs := afero.NewMemMapFs()
+	for {
+		h, err := s.Next()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(s)
+		afero.WriteFile(fs, path.Join("/workload", h.Path), b, 0600)
+	}
+	want := s.(Renewable).RenewAt()
+
+	var caResumeTests = []struct {
+		name string
+		sp   Producer
+		id   string
+		err  bool
+	}{
+		{"Resumed", sp, "workload", false},
+		{"OtherCA", osp, "workload", true},
+		{"OtherVolume", sp, "other", true},
+	}
+
+	for _, tt := range caResumeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := tt.sp.(Resumer).Resume(&api.Volume{ID: tt.id, Source: api.CASecretSource}, fs, "/workload")
+			if tt.err {
+				if err == nil {
+					t.Errorf("sp.Resume(%v): want error, got nil", tt.id)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("sp.Resume(%v): %v", tt.id, err)
+				return
+			}
+			// Certificate validity is only recorded to the second.
+			if d := r.RenewAt().Sub(want); d < -time.Second || d > time.Second {
+				t.Errorf("r.RenewAt(): want %v, got %v", want, r.RenewAt())
+			}
+			rs, err := r.Renew()
+			if err != nil {
+				t.Errorf("r.Renew(): %v", err)
+				return
+			}
+			crt := checkWorkloadSecrets(t, rs, roots)
+			if crt == nil {
+				return
+			}
+			if crt.Subject.CommonName != "svc.example.org" {
+				t.Errorf("crt.Subject.CommonName: want %v, got %v", "svc.example.org", crt.Subject.CommonName)
+			}
+			if !reflect.DeepEqual(crt.DNSNames, []string{"api.svc.example.org"}) {
+				t.Errorf("crt.DNSNames: want %v, got %v", []string{"api.svc.example.org"}, crt.DNSNames)
+			}
+			if crt.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+				t.Errorf("crt.KeyUsage: want no key encipherment for ECDSA key, got %v", crt.KeyUsage)
+			}
+		})
+	}
+}
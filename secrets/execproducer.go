@@ -0,0 +1,181 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+
+	"github.com/negz/secret-volume/api"
+)
+
+// maxExecStderr is the maximum number of bytes of a plugin's stderr that will
+// be included in an error.
+const maxExecStderr = 4096
+
+type execProducer struct {
+	path    string
+	args    []string
+	timeout time.Duration
+	max     int64
+	t       api.SecretType
+}
+
+// An ExecProducerOption represents an argument to NewExecProducer.
+type ExecProducerOption func(*execProducer) error
+
+// ExecArgs specifies arguments to be passed to the plugin command.
+func ExecArgs(args ...string) ExecProducerOption {
+	return func(sp *execProducer) error {
+		sp.args = args
+		return nil
+	}
+}
+
+// ExecTimeout specifies how long the plugin command may run before it is
+// killed. It defaults to 15 seconds.
+func ExecTimeout(d time.Duration) ExecProducerOption {
+	return func(sp *execProducer) error {
+		sp.timeout = d
+		return nil
+	}
+}
+
+// ExecMaxBytes specifies the maximum number of bytes the plugin command may
+// write to stdout. It defaults to 100MB.
+func ExecMaxBytes(b int64) ExecProducerOption {
+	return func(sp *execProducer) error {
+		sp.max = b
+		return nil
+	}
+}
+
+// ExecSecretType defines the type of the secret files produced by the plugin
+// command.
+func ExecSecretType(t api.SecretType) ExecProducerOption {
+	return func(sp *execProducer) error {
+		sp.t = t
+		return nil
+	}
+}
+
+// NewExecProducer builds a Producer backed by an external plugin command. The
+// command is passed the JSON encoded api.Volume (sans KeyPair) on stdin, and
+// the JSON encoded KeyPair on file descriptor 3. It is expected to write a
+// gzipped tarball of secret files to stdout and exit zero.
+func NewExecProducer(path string, epo ...ExecProducerOption) (Producer, error) {
+	sp := &execProducer{path: path, timeout: 15 * time.Second, max: 100 << 20, t: api.UnknownSecretType}
+	for _, o := range epo {
+		if err := o(sp); err != nil {
+			return nil, errors.Wrap(err, "cannot apply exec producer option")
+		}
+	}
+	return sp, nil
+}
+
+// A LimitedBuffer is a buffer that silently discards anything written beyond
+// its Limit, for example to capture the output of a command that may write more
+// than is worth keeping. It deliberately does not embed a bytes.Buffer, whose
+// ReadFrom method would allow io.Copy to bypass the limit.
+type LimitedBuffer struct {
+	b     bytes.Buffer
+	Limit int
+}
+
+func (b *LimitedBuffer) Write(p []byte) (int, error) {
+	if r := b.Limit - b.b.Len(); r < len(p) {
+		if r > 0 {
+			b.b.Write(p[:r])
+		}
+		return len(p), nil
+	}
+	return b.b.Write(p)
+}
+
+// Bytes returns the buffered bytes.
+func (b *LimitedBuffer) Bytes() []byte {
+	return b.b.Bytes()
+}
+
+func (sp *execProducer) For(ctx context.Context, v *api.Volume) (api.Secrets, error) {
+	ctx, cancel := context.WithTimeout(ctx, sp.timeout)
+	defer cancel()
+
+	stdin := &bytes.Buffer{}
+	if err := v.WriteJSON(stdin); err != nil {
+		return nil, errors.Wrap(err, "cannot encode volume for plugin")
+	}
+
+	kpr, kpw, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create keypair pipe")
+	}
+	defer kpr.Close()
+
+	stderr := &LimitedBuffer{Limit: maxExecStderr}
+	c := exec.CommandContext(ctx, sp.path, sp.args...)
+	c.Stdin = stdin
+	c.Stderr = stderr
+	c.ExtraFiles = []*os.File{kpr}
+	// The plugin runs in its own process group so that any children it starts
+	// in the background, which may hold its stdout open, are killed with it.
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		kpw.Close()
+		return nil, errors.Wrap(err, "cannot create plugin stdout pipe")
+	}
+
+	log.Debug("running plugin", zap.String("path", sp.path), zap.String("id", v.ID))
+	if err := c.Start(); err != nil {
+		kpw.Close()
+		return nil, errors.Wrapf(err, "cannot start plugin %v", sp.path)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	// The plugin may never read its keypair, so we write it asynchronously to
+	// avoid blocking on a full pipe. Any pending write fails once we close the
+	// read end of the pipe on return.
+	go func() {
+		json.NewEncoder(kpw).Encode(v.KeyPair)
+		kpw.Close()
+	}()
+
+	out, rerr := ioutil.ReadAll(io.LimitReader(stdout, sp.max+1))
+	if int64(len(out)) > sp.max {
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		c.Wait()
+		return nil, errors.Errorf("plugin %v wrote more than %v bytes to stdout", sp.path, sp.max)
+	}
+	werr := c.Wait()
+	// The plugin may exit before its children, which hold its stdout open until
+	// they are killed.
+	if ctx.Err() != nil {
+		return nil, errors.Wrapf(ctx.Err(), "plugin %v did not complete: %s", sp.path, stderr.Bytes())
+	}
+	if werr != nil {
+		return nil, errors.Wrapf(werr, "plugin %v failed: %s", sp.path, stderr.Bytes())
+	}
+	if rerr != nil {
+		return nil, errors.Wrapf(rerr, "cannot read plugin %v stdout", sp.path)
+	}
+
+	s, err := NewTarGz(v, ioutil.NopCloser(bytes.NewReader(out)), TarGzSecretType(sp.t))
+	return s, errors.Wrap(err, "cannot build tar.gz secrets")
+}
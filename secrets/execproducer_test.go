@@ -0,0 +1,112 @@
+package secrets
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/negz/secret-volume/api"
+	"github.com/negz/secret-volume/fixtures"
+)
+
+var execProducerTests = []struct {
+	name   string
+	script string
+	o      []ExecProducerOption
+	files  int
+	err    string
+	within time.Duration
+}{
+	{
+		name:   "Success",
+		script: "grep -q awesome && grep -q PRIVATE <&3 && cat ../fixtures/yaml.tar.gz",
+		files:  3,
+	},
+	{
+		name:   "Failure",
+		script: "echo kaboom >&2; exit 1",
+		err:    "kaboom",
+	},
+	{
+		name:   "Timeout",
+		script: "exec sleep 5",
+		o:      []ExecProducerOption{ExecTimeout(100 * time.Millisecond)},
+		err:    "did not complete",
+	},
+	{
+		name:   "BackgroundChild",
+		script: "sleep 5 & cat ../fixtures/yaml.tar.gz",
+		o:      []ExecProducerOption{ExecTimeout(100 * time.Millisecond)},
+		err:    "did not complete",
+		within: 2 * time.Second,
+	},
+	{
+		name:   "TooLarge",
+		script: "cat ../fixtures/yaml.tar.gz",
+		o:      []ExecProducerOption{ExecMaxBytes(10)},
+		err:    "more than 10 bytes",
+	},
+}
+
+func TestExecProducer(t *testing.T) {
+	v, _ := fixtures.TestVolumeWithCert("../fixtures/cert.pem", "../fixtures/key.pem")
+
+	for _, tt := range execProducerTests {
+		o := append([]ExecProducerOption{ExecArgs("-c", tt.script), ExecSecretType(api.YAMLSecretType)}, tt.o...)
+		sp, err := NewExecProducer("/bin/sh", o...)
+		if err != nil {
+			t.Errorf("NewExecProducer(%v): %v", "/bin/sh", err)
+			continue
+		}
+
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			s, err := sp.For(context.Background(), v)
+			if tt.within > 0 && time.Since(start) > tt.within {
+				t.Errorf("sp.For(context.Background(), %v): want return within %v, took %v", v.ID, tt.within, time.Since(start))
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("sp.For(context.Background(), %v): want error containing %q, got %v", v.ID, tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("sp.For(context.Background(), %v): %v", v.ID, err)
+				return
+			}
+			defer s.Close()
+
+			got := 0
+			for {
+				h, err := s.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Errorf("s.Next(): %v", err)
+					return
+				}
+				if h.Type != api.YAMLSecretType {
+					t.Errorf("h.Type: want %v, got %v", api.YAMLSecretType, h.Type)
+				}
+				got++
+			}
+			if got != tt.files {
+				t.Errorf("want %v files, got %v", tt.files, got)
+			}
+		})
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &LimitedBuffer{Limit: 10}
+	if _, err := io.Copy(b, strings.NewReader(strings.Repeat("x", 100))); err != nil {
+		t.Fatalf("io.Copy(): %v", err)
+	}
+	if got := string(b.Bytes()); got != strings.Repeat("x", 10) {
+		t.Errorf("b.Bytes(): want %v bytes, got %q", 10, got)
+	}
+}
@@ -0,0 +1,101 @@
+package secrets
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/negz/secret-volume/api"
+)
+
+// A File is a secret file held in memory.
+type File struct {
+	Path string
+	Type api.SecretType
+	Data []byte
+}
+
+type fileInfo struct {
+	name string
+	size int64
+}
+
+func (f *fileInfo) Name() string {
+	return f.name
+}
+
+func (f *fileInfo) Size() int64 {
+	return f.size
+}
+
+func (f *fileInfo) Mode() os.FileMode {
+	return 0
+}
+
+func (f *fileInfo) ModTime() time.Time {
+	return time.Now()
+}
+
+func (f *fileInfo) IsDir() bool {
+	return false
+}
+
+func (f *fileInfo) Sys() interface{} {
+	return nil
+}
+
+type files struct {
+	v  *api.Volume
+	fs []File
+	i  int
+	r  io.Reader
+}
+
+// NewFiles returns a set of Secrets containing the supplied in-memory files.
+func NewFiles(v *api.Volume, fs ...File) api.Secrets {
+	return &files{v: v, fs: fs, i: -1}
+}
+
+func (s *files) Volume() *api.Volume {
+	return s.v
+}
+
+func (s *files) Next() (*api.SecretsHeader, error) {
+	if s.i+1 >= len(s.fs) {
+		return nil, io.EOF
+	}
+	s.i++
+	f := s.fs[s.i]
+	s.r = bytes.NewReader(f.Data)
+	return &api.SecretsHeader{
+		Path:     f.Path,
+		Type:     f.Type,
+		FileInfo: &fileInfo{name: path.Base(f.Path), size: int64(len(f.Data))},
+	}, nil
+}
+
+func (s *files) Read(b []byte) (int, error) {
+	if s.r == nil {
+		return 0, io.EOF
+	}
+	return s.r.Read(b)
+}
+
+func (s *files) Close() error {
+	return nil
+}
+
+// TypeFromPath guesses the type of a secret file from its extension.
+func TypeFromPath(p string) api.SecretType {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".json":
+		return api.JSONSecretType
+	case ".yaml", ".yml":
+		return api.YAMLSecretType
+	default:
+		return api.UnknownSecretType
+	}
+}
@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/negz/secret-volume/api"
+	"github.com/negz/secret-volume/fixtures"
+)
+
+var filesTests = []struct {
+	v  *api.Volume
+	fs []File
+}{
+	{fixtures.TestVolume, []File{}},
+	{
+		fixtures.TestVolume,
+		[]File{
+			{Path: "a.json", Type: api.JSONSecretType, Data: []byte(`{"a":"b"}`)},
+			{Path: "dir/b", Type: api.UnknownSecretType, Data: []byte("b")},
+		},
+	},
+}
+
+func TestFiles(t *testing.T) {
+	for _, tt := range filesTests {
+		s := NewFiles(tt.v, tt.fs...)
+
+		t.Run("Volume", func(t *testing.T) {
+			if s.Volume() != tt.v {
+				t.Errorf("s.Volume(), want %v, got %v", tt.v, s.Volume())
+			}
+		})
+		t.Run("NextAndRead", func(t *testing.T) {
+			for _, f := range tt.fs {
+				h, err := s.Next()
+				if err != nil {
+					t.Errorf("s.Next(): %v", err)
+					return
+				}
+				if h.Path != f.Path || h.Type != f.Type {
+					t.Errorf("s.Next(): want %v (%v), got %v (%v)", f.Path, f.Type, h.Path, h.Type)
+				}
+				if h.FileInfo.Size() != int64(len(f.Data)) {
+					t.Errorf("h.FileInfo.Size(): want %v, got %v", len(f.Data), h.FileInfo.Size())
+				}
+				b, err := ioutil.ReadAll(s)
+				if err != nil {
+					t.Errorf("ioutil.ReadAll(%v): %v", s, err)
+				}
+				if !reflect.DeepEqual(b, f.Data) {
+					t.Errorf("ioutil.ReadAll(%v): want %s, got %s", s, f.Data, b)
+				}
+			}
+			if _, err := s.Next(); err != io.EOF {
+				t.Errorf("s.Next(): want %v, got %v", io.EOF, err)
+			}
+		})
+	}
+}
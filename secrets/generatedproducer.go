@@ -0,0 +1,284 @@
+package secrets
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+
+	"github.com/negz/secret-volume/api"
+)
+
+const (
+	// GeneratedPasswordTag requests a random password of the form name[:length].
+	GeneratedPasswordTag = "password"
+	// GeneratedRSATag requests an RSA keypair of the form name[:bits].
+	GeneratedRSATag = "rsa"
+	// GeneratedEd25519Tag requests an Ed25519 keypair of the form name.
+	GeneratedEd25519Tag = "ed25519"
+	// GeneratedSelfSignedTag requests a self-signed certificate of the form
+	// name:commonname.
+	GeneratedSelfSignedTag = "selfsigned"
+)
+
+const passwordChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+type generatedProducer struct {
+	file     string
+	validity time.Duration
+}
+
+// A GeneratedProducerOption represents an argument to NewGeneratedProducer.
+type GeneratedProducerOption func(*generatedProducer) error
+
+// GeneratedJSONFile specifies the name of the JSON file in which all generated
+// secrets are stored. It defaults to 'generated.json'.
+func GeneratedJSONFile(f string) GeneratedProducerOption {
+	return func(sp *generatedProducer) error {
+		sp.file = f
+		return nil
+	}
+}
+
+// GeneratedValidity specifies how long generated self-signed certificates are
+// valid for. It defaults to one year.
+func GeneratedValidity(d time.Duration) GeneratedProducerOption {
+	return func(sp *generatedProducer) error {
+		sp.validity = d
+		return nil
+	}
+}
+
+// NewGeneratedProducer builds a Producer that generates throwaway secrets
+// rather than fetching them. Secrets are requested via volume tags, i.e.
+// password=db:32, rsa=signing:2048, ed25519=ssh, or selfsigned=cn:localhost.
+// Keys and certificates are written as PEM files named after the secret.
+// Every generated secret is also included in a JSON file, keyed by filename
+// (or name, in the case of passwords).
+func NewGeneratedProducer(gpo ...GeneratedProducerOption) (Producer, error) {
+	sp := &generatedProducer{"generated.json", 365 * 24 * time.Hour}
+	for _, o := range gpo {
+		if err := o(sp); err != nil {
+			return nil, errors.Wrap(err, "cannot apply generated producer option")
+		}
+	}
+	return sp, nil
+}
+
+// generatedSecrets accumulates generated secret files.
+type generatedSecrets struct {
+	fs []File
+	m  map[string]string
+}
+
+func (g *generatedSecrets) add(name string, data []byte, file bool) error {
+	if _, ok := g.m[name]; ok {
+		return errors.Errorf("duplicate generated secret %v", name)
+	}
+	g.m[name] = string(data)
+	if file {
+		g.fs = append(g.fs, File{Path: name, Type: api.UnknownSecretType, Data: data})
+	}
+	return nil
+}
+
+func splitSpec(spec string) (string, string, error) {
+	p := strings.SplitN(spec, ":", 2)
+	if p[0] == "" || strings.ContainsAny(p[0], "/.") {
+		return "", "", errors.Errorf("invalid secret name in %q", spec)
+	}
+	if len(p) == 1 {
+		return p[0], "", nil
+	}
+	return p[0], p[1], nil
+}
+
+func intParam(p string, def, min, max int) (int, error) {
+	if p == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot parse %q", p)
+	}
+	if i < min || i > max {
+		return 0, errors.Errorf("%v is not between %v and %v", i, min, max)
+	}
+	return i, nil
+}
+
+func password(length int) ([]byte, error) {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(passwordChars)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read random data")
+		}
+		b[i] = passwordChars[n.Int64()]
+	}
+	return b, nil
+}
+
+func publicKeyPEM(k interface{}) ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(k)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal public key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), nil
+}
+
+func privateKeyPEM(k interface{}) ([]byte, error) {
+	b, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal private key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), nil
+}
+
+func (g *generatedSecrets) keyPair(name string, pub, priv interface{}) error {
+	pubPEM, err := publicKeyPEM(pub)
+	if err != nil {
+		return err
+	}
+	privPEM, err := privateKeyPEM(priv)
+	if err != nil {
+		return err
+	}
+	if err := g.add(name+".pub", pubPEM, true); err != nil {
+		return err
+	}
+	return g.add(name+".key", privPEM, true)
+}
+
+func (g *generatedSecrets) password(spec string) error {
+	name, p, err := splitSpec(spec)
+	if err != nil {
+		return err
+	}
+	l, err := intParam(p, 32, 8, 1024)
+	if err != nil {
+		return errors.Wrapf(err, "invalid password length for %v", name)
+	}
+	pw, err := password(l)
+	if err != nil {
+		return errors.Wrapf(err, "cannot generate password %v", name)
+	}
+	return g.add(name, pw, false)
+}
+
+func (g *generatedSecrets) rsa(spec string) error {
+	name, p, err := splitSpec(spec)
+	if err != nil {
+		return err
+	}
+	bits, err := intParam(p, 2048, 2048, 8192)
+	if err != nil {
+		return errors.Wrapf(err, "invalid RSA key size for %v", name)
+	}
+	k, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return errors.Wrapf(err, "cannot generate RSA key %v", name)
+	}
+	return g.keyPair(name, k.Public(), k)
+}
+
+func (g *generatedSecrets) ed25519(spec string) error {
+	name, _, err := splitSpec(spec)
+	if err != nil {
+		return err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return errors.Wrapf(err, "cannot generate Ed25519 key %v", name)
+	}
+	return g.keyPair(name, pub, priv)
+}
+
+func (g *generatedSecrets) selfSigned(spec string, validity time.Duration) error {
+	name, cn, err := splitSpec(spec)
+	if err != nil {
+		return err
+	}
+	if cn == "" {
+		return errors.Errorf("no common name for self-signed certificate %v", name)
+	}
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrapf(err, "cannot generate key for %v", name)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return errors.Wrap(err, "cannot generate serial number")
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, k.Public(), k)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create self-signed certificate %v", name)
+	}
+	privPEM, err := privateKeyPEM(k)
+	if err != nil {
+		return err
+	}
+	if err := g.add(name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), true); err != nil {
+		return err
+	}
+	return g.add(name+".key", privPEM, true)
+}
+
+func (sp *generatedProducer) For(_ context.Context, v *api.Volume) (api.Secrets, error) {
+	g := &generatedSecrets{m: make(map[string]string)}
+	for _, spec := range v.Tags[GeneratedPasswordTag] {
+		if err := g.password(spec); err != nil {
+			return nil, errors.Wrap(err, "cannot generate password")
+		}
+	}
+	for _, spec := range v.Tags[GeneratedRSATag] {
+		if err := g.rsa(spec); err != nil {
+			return nil, errors.Wrap(err, "cannot generate RSA keypair")
+		}
+	}
+	for _, spec := range v.Tags[GeneratedEd25519Tag] {
+		if err := g.ed25519(spec); err != nil {
+			return nil, errors.Wrap(err, "cannot generate Ed25519 keypair")
+		}
+	}
+	for _, spec := range v.Tags[GeneratedSelfSignedTag] {
+		if err := g.selfSigned(spec, sp.validity); err != nil {
+			return nil, errors.Wrap(err, "cannot generate self-signed certificate")
+		}
+	}
+	if len(g.m) == 0 {
+		return nil, errors.Errorf("no secrets requested for %v", v.ID)
+	}
+
+	j, err := json.Marshal(g.m)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode generated secrets")
+	}
+	log.Debug("generated secrets", zap.String("id", v.ID), zap.Int("secrets", len(g.m)))
+	return NewFiles(v, append(g.fs, File{Path: sp.file, Type: api.JSONSecretType, Data: j})...), nil
+}
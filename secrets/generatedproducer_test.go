@@ -0,0 +1,141 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/negz/secret-volume/api"
+)
+
+var generatedProducerTests = []struct {
+	name  string
+	tags  url.Values
+	files []string
+	keys  []string
+	err   bool
+}{
+	{
+		name:  "Password",
+		tags:  url.Values{GeneratedPasswordTag: []string{"db:12", "cache"}},
+		files: []string{"generated.json"},
+		keys:  []string{"cache", "db"},
+	},
+	{
+		name: "Everything",
+		tags: url.Values{
+			GeneratedPasswordTag:   []string{"db"},
+			GeneratedRSATag:        []string{"signing:2048"},
+			GeneratedEd25519Tag:    []string{"ssh"},
+			GeneratedSelfSignedTag: []string{"cn:localhost"},
+		},
+		files: []string{"signing.pub", "signing.key", "ssh.pub", "ssh.key", "cn.crt", "cn.key", "generated.json"},
+		keys:  []string{"cn.crt", "cn.key", "db", "signing.key", "signing.pub", "ssh.key", "ssh.pub"},
+	},
+	{name: "Nothing", tags: url.Values{"unrelated": []string{"tag"}}, err: true},
+	{name: "ShortPassword", tags: url.Values{GeneratedPasswordTag: []string{"db:4"}}, err: true},
+	{name: "WeakRSA", tags: url.Values{GeneratedRSATag: []string{"signing:512"}}, err: true},
+	{name: "NoCommonName", tags: url.Values{GeneratedSelfSignedTag: []string{"cn"}}, err: true},
+	{name: "Duplicate", tags: url.Values{GeneratedRSATag: []string{"k"}, GeneratedEd25519Tag: []string{"k"}}, err: true},
+	{name: "PathTraversal", tags: url.Values{GeneratedPasswordTag: []string{"../../etc/passwd"}}, err: true},
+}
+
+func TestGeneratedProducer(t *testing.T) {
+	sp, err := NewGeneratedProducer()
+	if err != nil {
+		t.Fatalf("NewGeneratedProducer(): %v", err)
+	}
+
+	for _, tt := range generatedProducerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &api.Volume{ID: "generated", Source: api.GeneratedSecretSource, Tags: tt.tags}
+			s, err := sp.For(context.Background(), v)
+			if tt.err {
+				if err == nil {
+					t.Errorf("sp.For(context.Background(), %v): want error, got nil", tt.tags)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("sp.For(context.Background(), %v): %v", tt.tags, err)
+				return
+			}
+
+			files := []string{}
+			m := map[string]string{}
+			for {
+				h, err := s.Next()
+				if err != nil {
+					break
+				}
+				files = append(files, h.Path)
+				b, _ := ioutil.ReadAll(s)
+				if h.Type == api.JSONSecretType {
+					if err := json.Unmarshal(b, &m); err != nil {
+						t.Errorf("json.Unmarshal(%v): %v", h.Path, err)
+					}
+					continue
+				}
+				p, _ := pem.Decode(b)
+				if p == nil {
+					t.Errorf("pem.Decode(%v): not PEM encoded", h.Path)
+					continue
+				}
+				if p.Type == "CERTIFICATE" {
+					c, err := x509.ParseCertificate(p.Bytes)
+					if err != nil {
+						t.Errorf("x509.ParseCertificate(%v): %v", h.Path, err)
+						continue
+					}
+					if err := c.VerifyHostname("localhost"); err != nil {
+						t.Errorf("c.VerifyHostname(%v): %v", "localhost", err)
+					}
+					if c.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+						t.Errorf("c.KeyUsage: want no key encipherment for ECDSA key, got %v", c.KeyUsage)
+					}
+				}
+			}
+			if !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("files: want %v, got %v", tt.files, files)
+			}
+			keys := []string{}
+			for _, k := range []string{"cache", "cn.crt", "cn.key", "db", "signing.key", "signing.pub", "ssh.key", "ssh.pub"} {
+				if _, ok := m[k]; ok {
+					keys = append(keys, k)
+				}
+			}
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("keys: want %v, got %v", tt.keys, keys)
+			}
+			if pw, ok := tt.tags[GeneratedPasswordTag]; ok && pw[0] == "db:12" && len(m["db"]) != 12 {
+				t.Errorf("len(%v): want 12, got %v", m["db"], len(m["db"]))
+			}
+		})
+	}
+}
+
+func TestGeneratedProducerWriteJSON(t *testing.T) {
+	sp, _ := NewGeneratedProducer()
+	v := &api.Volume{ID: "generated", Source: api.GeneratedSecretSource, Tags: url.Values{GeneratedPasswordTag: []string{"db"}}}
+	s, err := sp.For(context.Background(), v)
+	if err != nil {
+		t.Fatalf("sp.For(context.Background(), %v): %v", v.Tags, err)
+	}
+	b := &bytes.Buffer{}
+	if err := WriteJSON(s, b); err != nil {
+		t.Fatalf("WriteJSON(): %v", err)
+	}
+	m := map[string]string{}
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", b, err)
+	}
+	if len(m["db"]) != 32 {
+		t.Errorf("len(%v): want 32, got %v", m["db"], len(m["db"]))
+	}
+}
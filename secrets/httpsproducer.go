@@ -0,0 +1,192 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/negz/secret-volume/api"
+)
+
+type httpsProducer struct {
+	u     *template.Template
+	h     http.Header
+	token string
+	ca    *x509.CertPool
+}
+
+// A HTTPSProducerOption represents an argument to NewHTTPSProducer.
+type HTTPSProducerOption func(sp *httpsProducer) error
+
+// HTTPSHeader specifies a header to be sent with each request for secrets.
+// It may be supplied multiple times.
+func HTTPSHeader(k, v string) HTTPSProducerOption {
+	return func(sp *httpsProducer) error {
+		sp.h.Add(k, v)
+		return nil
+	}
+}
+
+// HTTPSBearerToken specifies a token to be sent as an Authorization: Bearer
+// header with each request for secrets.
+func HTTPSBearerToken(t string) HTTPSProducerOption {
+	return func(sp *httpsProducer) error {
+		sp.token = t
+		return nil
+	}
+}
+
+// HTTPSCA specifies PEM encoded CA certificates with which to verify the HTTPS
+// endpoint. The system CA pool is used by default.
+func HTTPSCA(ca []byte) HTTPSProducerOption {
+	return func(sp *httpsProducer) error {
+		p, err := certPool(ca)
+		if err != nil {
+			return errors.Wrap(err, "cannot parse HTTPS CA certificates")
+		}
+		sp.ca = p
+		return nil
+	}
+}
+
+// NewHTTPSProducer builds a Producer backed by a generic HTTPS endpoint that
+// serves archives of secrets. The supplied URL is a text/template executed
+// against the api.Volume for which secrets are being produced, for example:
+//
+//	https://example.org/{{.ID}}?env={{.Tags.Get "env" | urlquery}}
+//
+// Requests are authenticated using the volume's KeyPair (if any) as a TLS
+// client certificate, and the bearer token (if any). The type and compression
+// of the archive are determined by the Content-Type of the response.
+func NewHTTPSProducer(u string, spo ...HTTPSProducerOption) (Producer, error) {
+	t, err := template.New("url").Option("missingkey=error").Parse(u)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse URL template %v", u)
+	}
+	sp := &httpsProducer{u: t, h: http.Header{}}
+	for _, o := range spo {
+		if err := o(sp); err != nil {
+			return nil, errors.Wrap(err, "cannot apply HTTPS producer option")
+		}
+	}
+	return sp, nil
+}
+
+func (sp *httpsProducer) url(v *api.Volume) (string, error) {
+	b := &bytes.Buffer{}
+	if err := sp.u.Execute(b, v); err != nil {
+		return "", errors.Wrap(err, "cannot execute URL template")
+	}
+	u, err := url.Parse(b.String())
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot parse URL %v", b)
+	}
+	if u.Scheme != "https" {
+		return "", errors.Errorf("refusing to fetch secrets from non-HTTPS URL %v", u)
+	}
+	return u.String(), nil
+}
+
+func (sp *httpsProducer) client(v *api.Volume) (*http.Client, error) {
+	if v.KeyPair.Certificate == "" {
+		return tlsClient(sp.ca), nil
+	}
+	return httpClientFor(v, sp.ca)
+}
+
+// archiveOptions determines how to read an archive of secrets given its
+// Content-Type, i.e. "application/gzip; type=yaml".
+func archiveOptions(ct string) ([]TarGzOption, error) {
+	mt, p, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse content type %v", ct)
+	}
+	var o []TarGzOption
+	switch mt {
+	case "application/gzip", "application/x-gzip", "application/x-tgz", "application/x-compressed-tar":
+	case "application/x-tar":
+		o = append(o, TarGzUncompressed())
+	default:
+		return nil, errors.Errorf("unsupported archive content type %v", mt)
+	}
+	switch strings.ToLower(p["type"]) {
+	case "json":
+		o = append(o, TarGzSecretType(api.JSONSecretType))
+	case "yaml":
+		o = append(o, TarGzSecretType(api.YAMLSecretType))
+	}
+	return o, nil
+}
+
+func (sp *httpsProducer) For(ctx context.Context, v *api.Volume) (api.Secrets, error) {
+	url, err := sp.url(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot build URL for %v", v.ID)
+	}
+	log.Debug("fetching secrets", zap.String("url", url))
+	c, err := sp.client(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot build HTTP client for %v", v.ID)
+	}
+	rq, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot build request for %v", url)
+	}
+	// The response body is streamed by the returned Secrets, so the context
+	// must outlive this function. It is cancelled when the Secrets are closed.
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	for k, vs := range sp.h {
+		rq.Header[k] = vs
+	}
+	if sp.token != "" {
+		rq.Header.Set("Authorization", "Bearer "+sp.token)
+	}
+	r, err := ctxhttp.Do(ctx, c, rq)
+	if err != nil {
+		cancel()
+		return nil, errors.Wrapf(err, "cannot fetch secrets from %v", url)
+	}
+	r.Body = &cancelOnClose{r.Body, cancel}
+	if r.StatusCode != http.StatusOK {
+		e, rerr := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if rerr != nil {
+			return nil, errors.Wrapf(rerr, "cannot read response body with status %v while fetching secrets from %v", r.Status, url)
+		}
+		return nil, errors.Errorf("cannot fetch secrets from %v: %v: %s", url, r.Status, e)
+	}
+	o, err := archiveOptions(r.Header.Get("Content-Type"))
+	if err != nil {
+		r.Body.Close()
+		return nil, errors.Wrapf(err, "cannot handle secrets from %v", url)
+	}
+	s, err := NewTarGz(v, r.Body, o...)
+	if err != nil {
+		r.Body.Close()
+		return nil, errors.Wrap(err, "cannot build tar.gz secrets")
+	}
+	return s, nil
+}
+
+// cancelOnClose cancels a context when the wrapped io.ReadCloser is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
@@ -0,0 +1,223 @@
+package secrets
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	"github.com/negz/secret-volume/api"
+	"github.com/negz/secret-volume/fixtures"
+)
+
+var httpsProducerTests = []struct {
+	name  string
+	u     string
+	ct    string
+	gz    bool
+	files int
+	t     api.SecretType
+}{
+	{"Gzipped", "/{{.ID}}?tag={{.Tags.Get \"tag\" | urlquery}}", "application/gzip; type=yaml", true, 3, api.YAMLSecretType},
+	{"Uncompressed", "/{{.ID}}?tag={{.Tags.Get \"tag\" | urlquery}}", "application/x-tar; type=json", false, 3, api.JSONSecretType},
+	{"Untyped", "/{{.ID}}?tag={{.Tags.Get \"tag\" | urlquery}}", "application/x-gzip", true, 3, api.UnknownSecretType},
+	{"UnsupportedContentType", "/{{.ID}}?tag={{.Tags.Get \"tag\" | urlquery}}", "text/plain", true, 0, api.UnknownSecretType},
+	{"NotFound", "/nope", "application/gzip", true, 0, api.UnknownSecretType},
+}
+
+func TestHTTPSProducer(t *testing.T) {
+	v, _ := fixtures.TestVolumeWithCert("../fixtures/cert.pem", "../fixtures/key.pem")
+	fs := afero.NewOsFs()
+
+	for _, tt := range httpsProducerTests {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/"+v.ID || r.URL.Query().Get("tag") != v.Tags.Get("tag") {
+				http.Error(w, "unexpected URL", http.StatusNotFound)
+				return
+			}
+			if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("X-Cool") != "very" {
+				http.Error(w, "unexpected headers", http.StatusUnauthorized)
+				return
+			}
+			if len(r.TLS.PeerCertificates) != 1 {
+				http.Error(w, "missing client certificate", http.StatusUnauthorized)
+				return
+			}
+			z, err := fs.Open("../fixtures/yaml.tar.gz")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			defer z.Close()
+			w.Header().Set("Content-Type", tt.ct)
+			if tt.gz {
+				io.Copy(w, z)
+				return
+			}
+			u, err := gzip.NewReader(z)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			io.Copy(w, u)
+		}))
+		ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		ts.StartTLS()
+		defer ts.Close()
+
+		sp, err := NewHTTPSProducer(ts.URL+tt.u, HTTPSBearerToken("token"), HTTPSHeader("X-Cool", "very"), HTTPSCA(serverCA(ts)))
+		if err != nil {
+			t.Errorf("NewHTTPSProducer(%v): %v", ts.URL+tt.u, err)
+			continue
+		}
+
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := sp.For(context.Background(), v)
+			if tt.files == 0 {
+				if err == nil {
+					s.Close()
+					t.Errorf("sp.For(context.Background(), %v): want error, got nil", v.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("sp.For(context.Background(), %v): %v", v.ID, err)
+				return
+			}
+			defer s.Close()
+
+			got := 0
+			for {
+				h, err := s.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Errorf("s.Next(): %v", err)
+					return
+				}
+				if h.Type != tt.t {
+					t.Errorf("h.Type: want %v, got %v", tt.t, h.Type)
+				}
+				got++
+			}
+			if got != tt.files {
+				t.Errorf("want %v files, got %v", tt.files, got)
+			}
+		})
+	}
+}
+
+func serverCA(ts *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+}
+
+func TestHTTPSProducerVerifiesServer(t *testing.T) {
+	v, _ := fixtures.TestVolumeWithCert("../fixtures/cert.pem", "../fixtures/key.pem")
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "should not be reached", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	sp, err := NewHTTPSProducer(ts.URL + "/{{.ID}}")
+	if err != nil {
+		t.Fatalf("NewHTTPSProducer(): %v", err)
+	}
+	if s, err := sp.For(context.Background(), v); err == nil || !strings.Contains(err.Error(), "certificate") {
+		if s != nil {
+			s.Close()
+		}
+		t.Errorf("sp.For(context.Background(), %v): want certificate error, got %v", v.ID, err)
+	}
+}
+
+func TestHTTPSProducerStreaming(t *testing.T) {
+	v, _ := fixtures.TestVolumeWithCert("../fixtures/cert.pem", "../fixtures/key.pem")
+
+	// The secret is much larger than a single read, so the response body must
+	// remain readable after For returns.
+	size := int64(4 << 20)
+	b := &bytes.Buffer{}
+	tw := tar.NewWriter(b)
+	if err := tw.WriteHeader(&tar.Header{Name: "big", Mode: 0600, Size: size, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("tw.WriteHeader(): %v", err)
+	}
+	if _, err := tw.Write(make([]byte, size)); err != nil {
+		t.Fatalf("tw.Write(): %v", err)
+	}
+	tw.Close()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-tar")
+		for chunk := make([]byte, 32<<10); ; {
+			n, err := b.Read(chunk)
+			w.Write(chunk[:n])
+			w.(http.Flusher).Flush()
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	sp, err := NewHTTPSProducer(ts.URL+"/{{.ID}}", HTTPSCA(serverCA(ts)))
+	if err != nil {
+		t.Fatalf("NewHTTPSProducer(): %v", err)
+	}
+	s, err := sp.For(context.Background(), v)
+	if err != nil {
+		t.Fatalf("sp.For(context.Background(), %v): %v", v.ID, err)
+	}
+	defer s.Close()
+	if _, err := s.Next(); err != nil {
+		t.Fatalf("s.Next(): %v", err)
+	}
+	got, err := io.Copy(ioutil.Discard, s)
+	if err != nil {
+		t.Errorf("io.Copy(ioutil.Discard, s): %v", err)
+	}
+	if got != size {
+		t.Errorf("io.Copy(ioutil.Discard, s): want %v bytes, got %v", size, got)
+	}
+}
+
+func TestHTTPSProducerRefusesHTTP(t *testing.T) {
+	sp, err := NewHTTPSProducer("http://example.org/{{.ID}}")
+	if err != nil {
+		t.Fatalf("NewHTTPSProducer(): %v", err)
+	}
+	if _, err := sp.For(context.Background(), fixtures.TestVolume); err == nil {
+		t.Errorf("sp.For(context.Background(), %v): want error, got nil", fixtures.TestVolume.ID)
+	}
+}
+
+func TestHTTPSProducerCancelled(t *testing.T) {
+	v, _ := fixtures.TestVolumeWithCert("../fixtures/cert.pem", "../fixtures/key.pem")
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "should not be reached", http.StatusInternalServerError)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	sp, err := NewHTTPSProducer(ts.URL+"/{{.ID}}", HTTPSCA(serverCA(ts)))
+	if err != nil {
+		t.Fatalf("NewHTTPSProducer(): %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sp.For(ctx, v); errors.Cause(err) != context.Canceled {
+		t.Errorf("sp.For(ctx, %v): want %v, got %v", v.ID, context.Canceled, err)
+	}
+}
@@ -0,0 +1,170 @@
+package secrets
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/negz/secret-volume/api"
+)
+
+// KubernetesSecretTag is the volume tag used to request Kubernetes secrets. Its
+// values should be of the form namespace/name.
+const KubernetesSecretTag = "secret"
+
+type kubernetesProducer struct {
+	server string
+	token  string
+	crts   []tls.Certificate
+	ca     *x509.CertPool
+	c      *http.Client
+}
+
+// A KubernetesProducerOption represents an argument to NewKubernetesProducer.
+type KubernetesProducerOption func(sp *kubernetesProducer) error
+
+// KubernetesToken specifies a (typically service account) bearer token with
+// which to authenticate to the Kubernetes API server.
+func KubernetesToken(t string) KubernetesProducerOption {
+	return func(sp *kubernetesProducer) error {
+		sp.token = t
+		return nil
+	}
+}
+
+// KubernetesKeyPair specifies a client certificate with which to authenticate
+// to the Kubernetes API server.
+func KubernetesKeyPair(kp api.KeyPair) KubernetesProducerOption {
+	return func(sp *kubernetesProducer) error {
+		crt, err := kp.ToCertificate()
+		if err != nil {
+			return errors.Wrap(err, "cannot parse Kubernetes keypair")
+		}
+		sp.crts = []tls.Certificate{crt}
+		return nil
+	}
+}
+
+// KubernetesCA specifies PEM encoded CA certificates with which to verify the
+// Kubernetes API server. The system CA pool is used by default.
+func KubernetesCA(ca []byte) KubernetesProducerOption {
+	return func(sp *kubernetesProducer) error {
+		p, err := certPool(ca)
+		if err != nil {
+			return errors.Wrap(err, "cannot parse Kubernetes CA certificates")
+		}
+		sp.ca = p
+		return nil
+	}
+}
+
+// NewKubernetesProducer builds a Producer backed by the Secret objects of the
+// Kubernetes API server at the supplied URL. Volumes request Secrets via tags
+// of the form secret=namespace/name. Each key of each requested Secret becomes
+// a file at the root of the volume.
+func NewKubernetesProducer(server string, spo ...KubernetesProducerOption) (Producer, error) {
+	sp := &kubernetesProducer{server: strings.TrimSuffix(server, "/")}
+	for _, o := range spo {
+		if err := o(sp); err != nil {
+			return nil, errors.Wrap(err, "cannot apply Kubernetes producer option")
+		}
+	}
+	sp.c = tlsClient(sp.ca, sp.crts...)
+	return sp, nil
+}
+
+// A kubernetesSecret is the subset of a Kubernetes v1.Secret we care about.
+// The JSON decoder handles decoding its base64 encoded data.
+type kubernetesSecret struct {
+	Data map[string][]byte `json:"data"`
+}
+
+func (sp *kubernetesProducer) get(ctx context.Context, ns, name string) (*kubernetesSecret, error) {
+	p := &url.URL{Path: fmt.Sprintf("/api/v1/namespaces/%v/secrets/%v", ns, name)}
+	u := sp.server + p.String()
+	log.Debug("fetching secrets", zap.String("url", u))
+	rq, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot build request for %v", u)
+	}
+	rq.Header.Set("Accept", "application/json")
+	if sp.token != "" {
+		rq.Header.Set("Authorization", "Bearer "+sp.token)
+	}
+	r, err := ctxhttp.Do(ctx, sp.c, rq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot fetch secrets from %v", u)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		e, rerr := ioutil.ReadAll(r.Body)
+		if rerr != nil {
+			return nil, errors.Wrapf(rerr, "cannot read response body with status %v while fetching secrets from %v", r.Status, u)
+		}
+		return nil, errors.Errorf("cannot fetch secrets from %v: %v: %s", u, r.Status, e)
+	}
+	s := &kubernetesSecret{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		return nil, errors.Wrapf(err, "cannot decode secret from %v", u)
+	}
+	return s, nil
+}
+
+// validRefPart returns true if the supplied secret namespace or name may be
+// used in an API path.
+func validRefPart(p string) bool {
+	return p != "" && p != "." && p != ".."
+}
+
+func (sp *kubernetesProducer) For(ctx context.Context, v *api.Volume) (api.Secrets, error) {
+	refs := v.Tags[KubernetesSecretTag]
+	if len(refs) == 0 {
+		return nil, errors.Errorf("no %v tags for %v", KubernetesSecretTag, v.ID)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	fs := []File{}
+	from := map[string]string{}
+	for _, ref := range refs {
+		p := strings.Split(ref, "/")
+		if len(p) != 2 || !validRefPart(p[0]) || !validRefPart(p[1]) {
+			return nil, errors.Errorf("invalid secret %q: must be namespace/name", ref)
+		}
+		s, err := sp.get(ctx, p[0], p[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot get secret %v", ref)
+		}
+		keys := make([]string, 0, len(s.Data))
+		for k := range s.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if path.Base(k) != k || k == "." || k == ".." {
+				return nil, errors.Errorf("invalid key %q in secret %v", k, ref)
+			}
+			// Keys become files at the root of the volume, so keys of
+			// different secrets must not collide.
+			if other, ok := from[k]; ok {
+				return nil, errors.Errorf("key %q of secret %v conflicts with secret %v", k, ref, other)
+			}
+			from[k] = ref
+			fs = append(fs, File{Path: k, Type: TypeFromPath(k), Data: s.Data[k]})
+		}
+	}
+	return NewFiles(v, fs...), nil
+}
@@ -0,0 +1,114 @@
+package secrets
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/negz/secret-volume/api"
+)
+
+var kubernetesSecrets = map[string]string{
+	"/api/v1/namespaces/default/secrets/db":  `{"kind":"Secret","data":{"password":"aHVudGVyMg==","config.yaml":"dXNlcjogYWRtaW4K"}}`,
+	"/api/v1/namespaces/other/secrets/cache": `{"kind":"Secret","data":{"token":"c2VrcmV0"}}`,
+	"/api/v1/namespaces/other/secrets/db":    `{"kind":"Secret","data":{"password":"aHVudGVyMw=="}}`,
+}
+
+var kubernetesProducerTests = []struct {
+	name  string
+	tags  url.Values
+	files []File
+}{
+	{
+		"SingleSecret",
+		url.Values{KubernetesSecretTag: []string{"default/db"}},
+		[]File{
+			{Path: "config.yaml", Type: api.YAMLSecretType, Data: []byte("user: admin\n")},
+			{Path: "password", Type: api.UnknownSecretType, Data: []byte("hunter2")},
+		},
+	},
+	{
+		"MultipleSecrets",
+		url.Values{KubernetesSecretTag: []string{"default/db", "other/cache"}},
+		[]File{
+			{Path: "config.yaml", Type: api.YAMLSecretType, Data: []byte("user: admin\n")},
+			{Path: "password", Type: api.UnknownSecretType, Data: []byte("hunter2")},
+			{Path: "token", Type: api.UnknownSecretType, Data: []byte("sekret")},
+		},
+	},
+	{"NotFound", url.Values{KubernetesSecretTag: []string{"default/nope"}}, nil},
+	{"DuplicateKey", url.Values{KubernetesSecretTag: []string{"default/db", "other/db"}}, nil},
+	{"InvalidReference", url.Values{KubernetesSecretTag: []string{"nope"}}, nil},
+	{"DotDotNamespace", url.Values{KubernetesSecretTag: []string{"../db"}}, nil},
+	{"DotName", url.Values{KubernetesSecretTag: []string{"default/."}}, nil},
+	{"NoTags", url.Values{}, nil},
+}
+
+func TestKubernetesProducer(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s, ok := kubernetesSecrets[r.URL.Path]
+		if !ok {
+			http.Error(w, `{"kind":"Status","reason":"NotFound"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(s))
+	}))
+	defer ts.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	sp, err := NewKubernetesProducer(ts.URL, KubernetesToken("token"), KubernetesCA(ca))
+	if err != nil {
+		t.Fatalf("NewKubernetesProducer(%v): %v", ts.URL, err)
+	}
+
+	for _, tt := range kubernetesProducerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &api.Volume{ID: "k8s", Source: api.KubernetesSecretSource, Tags: tt.tags}
+			s, err := sp.For(context.Background(), v)
+			if tt.files == nil {
+				if err == nil {
+					t.Errorf("sp.For(context.Background(), %v): want error, got nil", v.ID)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("sp.For(context.Background(), %v): %v", v.ID, err)
+				return
+			}
+			defer s.Close()
+
+			got := []File{}
+			for {
+				h, err := s.Next()
+				if err != nil {
+					break
+				}
+				b, err := ioutil.ReadAll(s)
+				if err != nil {
+					t.Errorf("ioutil.ReadAll(%v): %v", h.Path, err)
+					return
+				}
+				got = append(got, File{Path: h.Path, Type: h.Type, Data: b})
+			}
+			if !reflect.DeepEqual(got, tt.files) {
+				t.Errorf("sp.For(context.Background(), %v): want %v, got %v", v.ID, tt.files, got)
+			}
+		})
+	}
+}
+
+func TestKubernetesProducerInvalidCA(t *testing.T) {
+	if _, err := NewKubernetesProducer("https://example.org", KubernetesCA([]byte("notacert"))); err == nil {
+		t.Errorf("NewKubernetesProducer(KubernetesCA(%q)): want error, got nil", "notacert")
+	}
+}
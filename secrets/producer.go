@@ -2,13 +2,39 @@
 // secrets. i.e. files containing sensitive data such as passwords.
 package secrets
 
-import "github.com/negz/secret-volume/api"
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/negz/secret-volume/api"
+)
 
 // A Producer produces secrets files for the supplied api.Volume.
 type Producer interface {
 	// For returns the appropriate secrets files for the supplied api.Volume.
-	For(*api.Volume) (api.Secrets, error)
+	// Producing secrets is abandoned if the supplied context is cancelled,
+	// including while the returned secrets are being read.
+	For(context.Context, *api.Volume) (api.Secrets, error)
 }
 
 // Producers maps api.SecretSources to the Producer that handles them.
 type Producers map[api.SecretSource]Producer
+
+// A Renewable is a set of api.Secrets that expire, and that can produce their
+// own replacements.
+type Renewable interface {
+	// RenewAt returns the time at which these secrets should be renewed.
+	RenewAt() time.Time
+	// Renew returns replacement secrets.
+	Renew() (api.Secrets, error)
+}
+
+// A Resumer is a Producer whose Renewable secrets can be renewed after they were
+// written, for example by a process that restarted since producing them.
+type Resumer interface {
+	// Resume returns the Renewable secrets of the supplied api.Volume, given
+	// the files it previously produced beneath the supplied root.
+	Resume(v *api.Volume, fs afero.Fs, root string) (Renewable, error)
+}
@@ -1,14 +1,15 @@
 package secrets
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"time"
 
-	"golang.org/x/net/context"
 	"golang.org/x/net/context/ctxhttp"
 
 	"github.com/negz/secret-volume/api"
@@ -19,18 +20,22 @@ import (
 )
 
 type talosProducer struct {
-	lb  lb.LoadBalancer
-	ctx context.Context
+	lb lb.LoadBalancer
+	ca *x509.CertPool
 }
 
 // A TalosProducerOption represents an argument to NewTalosProducer.
 type TalosProducerOption func(sp *talosProducer) error
 
-// WithContext provides an alternative parent context.Context() for HTTP
-// requests to Talos. context.Background() is used by default.
-func WithContext(ctx context.Context) TalosProducerOption {
+// TalosCA specifies PEM encoded CA certificates with which to verify Talos.
+// The system CA pool is used by default.
+func TalosCA(ca []byte) TalosProducerOption {
 	return func(sp *talosProducer) error {
-		sp.ctx = ctx
+		p, err := certPool(ca)
+		if err != nil {
+			return errors.Wrap(err, "cannot parse Talos CA certificates")
+		}
+		sp.ca = p
 		return nil
 	}
 }
@@ -39,7 +44,7 @@ func WithContext(ctx context.Context) TalosProducerOption {
 // The supplied lb.LoadBalancer should return the address of a Talos HTTP
 // backend.
 func NewTalosProducer(lb lb.LoadBalancer, spo ...TalosProducerOption) (Producer, error) {
-	sp := &talosProducer{lb, context.Background()}
+	sp := &talosProducer{lb: lb}
 	for _, o := range spo {
 		if err := o(sp); err != nil {
 			return nil, errors.Wrap(err, "cannot apply Talos producer option")
@@ -48,16 +53,32 @@ func NewTalosProducer(lb lb.LoadBalancer, spo ...TalosProducerOption) (Producer,
 	return sp, nil
 }
 
-func httpClientFor(v *api.Volume) (*http.Client, error) {
+// certPool returns a pool of the supplied PEM encoded certificates.
+func certPool(ca []byte) (*x509.CertPool, error) {
+	p := x509.NewCertPool()
+	if !p.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates found")
+	}
+	return p, nil
+}
+
+// httpClientFor returns a client that authenticates using the supplied volume's
+// KeyPair, and verifies servers using the supplied CA pool. The system CA pool
+// is used if the supplied pool is nil.
+func httpClientFor(v *api.Volume, ca *x509.CertPool) (*http.Client, error) {
 	crt, err := v.KeyPair.ToCertificate()
 	if err != nil {
-		return nil, errors.Wrapf(err, "cannot parse keypair for %v", v)
+		return nil, errors.Wrapf(err, "cannot parse keypair for %v", v.ID)
 	}
 
-	cfg := &tls.Config{Certificates: []tls.Certificate{crt}, InsecureSkipVerify: true}
+	return tlsClient(ca, crt), nil
+}
+
+func tlsClient(ca *x509.CertPool, crts ...tls.Certificate) *http.Client {
+	cfg := &tls.Config{Certificates: crts, RootCAs: ca}
 	cfg.BuildNameToCertificate()
 
-	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}, nil
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
 }
 
 func (sp *talosProducer) url(tags url.Values) (string, error) {
@@ -68,29 +89,37 @@ func (sp *talosProducer) url(tags url.Values) (string, error) {
 	return fmt.Sprintf("https://%v?%v", h, tags.Encode()), nil
 }
 
-func (sp *talosProducer) For(v *api.Volume) (api.Secrets, error) {
+func (sp *talosProducer) For(ctx context.Context, v *api.Volume) (api.Secrets, error) {
 	url, err := sp.url(v.Tags)
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot build URL for %v", v.Tags)
 	}
 	log.Debug("fetching secrets", zap.String("url", url))
-	ctx, cancel := context.WithTimeout(sp.ctx, 15*time.Second)
-	defer cancel()
-	c, err := httpClientFor(v)
+	c, err := httpClientFor(v, sp.ca)
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot build HTTP client for %v", v)
 	}
+	// The response body is streamed by the returned Secrets, so the context
+	// must outlive this function. It is cancelled when the Secrets are closed.
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	r, err := ctxhttp.Get(ctx, c, url)
 	if err != nil {
+		cancel()
 		return nil, errors.Wrapf(err, "cannot fetch secrets from %v", url)
 	}
+	r.Body = &cancelOnClose{r.Body, cancel}
 	if r.StatusCode != http.StatusOK {
 		e, rerr := ioutil.ReadAll(r.Body)
+		r.Body.Close()
 		if rerr != nil {
 			return nil, errors.Wrapf(rerr, "cannot read response body with status %v while fetching secrets from %v", r.Status, url)
 		}
 		return nil, errors.Errorf("cannot fetch secrets from %v: %v: %s", url, r.Status, e)
 	}
 	s, err := NewTarGz(v, r.Body, TarGzSecretType(api.YAMLSecretType))
-	return s, errors.Wrap(err, "cannot build tar.gz secrets")
+	if err != nil {
+		r.Body.Close()
+		return nil, errors.Wrap(err, "cannot build tar.gz secrets")
+	}
+	return s, nil
 }
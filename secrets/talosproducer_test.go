@@ -1,6 +1,8 @@
 package secrets
 
 import (
+	"context"
+	"encoding/pem"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -51,16 +53,17 @@ func TestTalosProducer(t *testing.T) {
 			continue
 		}
 
-		sp, err := NewTalosProducer(lb)
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+		sp, err := NewTalosProducer(lb, TalosCA(ca))
 		if err != nil {
 			t.Errorf("NewTalosProducer(%v): %v", lb, err)
 			continue
 		}
 
 		t.Run("For", func(t *testing.T) {
-			actual, err := sp.For(v)
+			actual, err := sp.For(context.Background(), v)
 			if err != nil {
-				t.Errorf("sp.For(%v): %v", v, err)
+				t.Errorf("sp.For(context.Background(), %v): %v", v, err)
 				return
 			}
 			defer actual.Close()
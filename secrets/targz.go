@@ -18,6 +18,7 @@ type tarGz struct {
 	z *gzip.Reader
 	t *tar.Reader
 	s api.SecretType
+	u bool
 }
 
 // A TarGzOption represents an argument to NewTarGz.
@@ -31,19 +32,33 @@ func TarGzSecretType(s api.SecretType) TarGzOption {
 	}
 }
 
+// TarGzUncompressed specifies that the tarball of secret files is not gzipped.
+func TarGzUncompressed() TarGzOption {
+	return func(t *tarGz) error {
+		t.u = true
+		return nil
+	}
+}
+
 // NewTarGz creates an api.Secrets backed by the supplied io.ReadCloser, which
 // is expected to be a gzipped tarball of secret files.
 func NewTarGz(v *api.Volume, r io.ReadCloser, tgzo ...TarGzOption) (api.Secrets, error) {
-	z, err := gzip.NewReader(r)
-	if err != nil {
-		return nil, errors.Wrap(err, "cannot build new gzip reader")
-	}
-	t := &tarGz{v, r, z, tar.NewReader(z), api.UnknownSecretType}
+	t := &tarGz{v: v, r: r, s: api.UnknownSecretType}
 	for _, o := range tgzo {
 		if err := o(t); err != nil {
 			return nil, errors.Wrap(err, "cannot apply tar.gz secrets option")
 		}
 	}
+	if t.u {
+		t.t = tar.NewReader(r)
+		return t, nil
+	}
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build new gzip reader")
+	}
+	t.z = z
+	t.t = tar.NewReader(z)
 	return t, nil
 }
 
@@ -99,6 +114,9 @@ func (sd *tarGz) Read(b []byte) (int, error) {
 
 // Close closes the underlying gzip reader and tar readers.
 func (sd *tarGz) Close() error {
+	if sd.z == nil {
+		return errors.Wrap(sd.r.Close(), "cannot close tarball reader")
+	}
 	if err := sd.z.Close(); err != nil {
 		return errors.Wrap(err, "cannot close tarball reader")
 	}
@@ -3,8 +3,12 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/uber-go/zap"
@@ -26,10 +30,99 @@ func IsNotFound(err error) bool {
 	return ok && e.NotFound()
 }
 
+type forbidden interface {
+	// Forbidden is true if the error implementing this interface should be
+	// treated as an HTTP 403 forbidden.
+	Forbidden() bool
+}
+
+// IsForbidden determines whether the supplied error's cause should be treated
+// as a HTTP 403 forbidden.
+func IsForbidden(err error) bool {
+	e, ok := errors.Cause(err).(forbidden)
+	return ok && e.Forbidden()
+}
+
+type badRequest interface {
+	// BadRequest is true if the error implementing this interface should be
+	// treated as an HTTP 400 bad request.
+	BadRequest() bool
+}
+
+// IsBadRequest determines whether the supplied error's cause should be treated
+// as a HTTP 400 bad request.
+func IsBadRequest(err error) bool {
+	e, ok := errors.Cause(err).(badRequest)
+	return ok && e.BadRequest()
+}
+
+type conflict interface {
+	// Conflict is true if the error implementing this interface should be
+	// treated as an HTTP 409 conflict.
+	Conflict() bool
+}
+
+// IsConflict determines whether the supplied error's cause should be treated as
+// a HTTP 409 conflict.
+func IsConflict(err error) bool {
+	e, ok := errors.Cause(err).(conflict)
+	return ok && e.Conflict()
+}
+
+type insufficientStorage interface {
+	// InsufficientStorage is true if the error implementing this interface
+	// should be treated as an HTTP 507 insufficient storage.
+	InsufficientStorage() bool
+}
+
+// IsInsufficientStorage determines whether the supplied error's cause should be
+// treated as a HTTP 507 insufficient storage.
+func IsInsufficientStorage(err error) bool {
+	e, ok := errors.Cause(err).(insufficientStorage)
+	return ok && e.InsufficientStorage()
+}
+
+// IsCancelled determines whether the supplied error's cause is a cancelled
+// context, which should be treated as a HTTP 503 service unavailable. Requests
+// are cancelled when their client disconnects, or when the server stops.
+func IsCancelled(err error) bool {
+	return errors.Cause(err) == context.Canceled
+}
+
+// statusFor returns the HTTP status code with which to fail a request that
+// encountered the supplied error.
+func statusFor(err error) int {
+	switch {
+	case IsBadRequest(err):
+		return http.StatusBadRequest
+	case IsForbidden(err):
+		return http.StatusForbidden
+	case IsNotFound(err):
+		return http.StatusNotFound
+	case IsConflict(err):
+		return http.StatusConflict
+	case IsInsufficientStorage(err):
+		return http.StatusInsufficientStorage
+	case IsCancelled(err):
+		return http.StatusServiceUnavailable
+	case errors.Cause(err) == context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		// TODO(negz): This is just as likely to be StatusBadRequest (i.e. bad certificate)
+		return http.StatusInternalServerError
+	}
+}
+
+// SystemPrefix prefixes the paths of endpoints that do not operate on a single
+// volume. The Manager rejects volume IDs containing a '/', so these paths never
+// conflict with those of volumes.
+const SystemPrefix = "/_/"
+
 // HTTPHandlers contains HTTP handlers for secret volume CRD operations.
 type HTTPHandlers struct {
 	v     volume.Manager
 	r     HTTPRouter
+	sys   HTTPRouter
 	idKey string
 }
 
@@ -45,13 +138,26 @@ func HTTPHandlersRouter(r HTTPRouter) HTTPHandlersOption {
 	}
 }
 
+// HTTPHandlersSystemRouter provides an alternative HTTPRouter implementation to
+// be used for paths beginning with SystemPrefix.
+func HTTPHandlersSystemRouter(r HTTPRouter) HTTPHandlersOption {
+	return func(h *HTTPHandlers) error {
+		h.sys = r
+		return nil
+	}
+}
+
 // NewHTTPHandlers creates HTTP handlers for secret volume CRD operations.
 func NewHTTPHandlers(v volume.Manager, ho ...HTTPHandlersOption) (*HTTPHandlers, error) {
 	r, err := NewHRHTTPRouter()
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot create new HTTP router")
 	}
-	s := &HTTPHandlers{v, r, "id"}
+	sys, err := NewHRHTTPRouter()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create new HTTP router")
+	}
+	s := &HTTPHandlers{v, r, sys, "id"}
 	for _, o := range ho {
 		if err := o(s); err != nil {
 			return nil, errors.Wrap(err, "cannot apply HTTP handlers option")
@@ -64,15 +170,31 @@ func (h *HTTPHandlers) setupRoutes() {
 	// TODO(negz): Set content-length headers
 	h.r.GET("/", logReq(json(h.list)))
 	h.r.POST("/", logReq(json(h.create)))
-	h.r.GET("/:id", logReq(json(h.ensureParam(h.get, h.idKey))))
-	h.r.DELETE("/:id", logReq(h.ensureParam(h.delete, h.idKey)))
+	h.r.GET("/:id", logReq(json(h.ensureParam(h.r, h.get, h.idKey))))
+	h.r.PUT("/:id", logReq(json(h.ensureParam(h.r, h.update, h.idKey))))
+	h.r.POST("/:id/refresh", logReq(json(h.ensureParam(h.r, h.refresh, h.idKey))))
+	h.r.DELETE("/:id", logReq(h.ensureParam(h.r, h.delete, h.idKey)))
+
+	h.sys.GET(SystemPrefix+"capacity", logReq(json(h.capacity)))
+	h.sys.GET(SystemPrefix+"cleanups", logReq(json(h.cleanups)))
+	h.sys.DELETE(SystemPrefix+"volumes/:id", logReq(h.ensureParam(h.sys, h.forceDelete, h.idKey)))
+}
+
+// ServeHTTP routes requests for paths beginning with SystemPrefix to the system
+// router, and all other requests to the volume router.
+func (h *HTTPHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, SystemPrefix) {
+		h.sys.ServeHTTP(w, r)
+		return
+	}
+	h.r.ServeHTTP(w, r)
 }
 
 // HTTPServer returns a HTTP server configured to run at the supplied address
 // with the HTTP handlers defined within HTTPHandlers.
 func (h *HTTPHandlers) HTTPServer(addr string) *http.Server {
 	h.setupRoutes()
-	return &http.Server{Addr: addr, Handler: h.r}
+	return &http.Server{Addr: addr, Handler: h}
 }
 
 func (h *HTTPHandlers) list(w http.ResponseWriter, _ *http.Request) {
@@ -90,11 +212,7 @@ func (h *HTTPHandlers) get(w http.ResponseWriter, r *http.Request) {
 	id := h.r.GetParam(r, h.idKey)
 	v, err := h.v.Get(id)
 	if err != nil {
-		if IsNotFound(err) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), statusFor(err))
 		return
 	}
 
@@ -110,12 +228,31 @@ func (h *HTTPHandlers) create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.v.Create(v); err != nil {
-		// TODO(negz): This is just as likely to be StatusBadRequest (i.e. bad certificate)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	ctx := r.Context()
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	create := h.v.Create
+	if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async {
+		create = h.v.CreateAsync
+	}
+	if err := create(ctx, v); err != nil {
+		http.Error(w, err.Error(), statusFor(err))
 		return
 	}
 
+	if v.Status == api.VolumePending {
+		w.Header().Set("Location", "/"+v.ID)
+		w.WriteHeader(http.StatusAccepted)
+	}
 	// Reserialise (rather than return the sent copy) to strip out the keypair,
 	// which does not get returned in subsequent queries.
 	if err := v.WriteJSON(w); err != nil {
@@ -123,21 +260,83 @@ func (h *HTTPHandlers) create(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *HTTPHandlers) update(w http.ResponseWriter, r *http.Request) {
+	v, err := api.ReadVolumeJSONWithKeyPair(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := h.r.GetParam(r, h.idKey)
+	if v.ID != "" && v.ID != id {
+		http.Error(w, fmt.Sprintf("volume ID %v does not match URL", v.ID), http.StatusBadRequest)
+		return
+	}
+	v.ID = id
+
+	if err := h.v.Update(r.Context(), v); err != nil {
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+
+	if err := v.WriteJSON(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *HTTPHandlers) refresh(w http.ResponseWriter, r *http.Request) {
+	v, err := api.ReadVolumeJSONWithKeyPair(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rf, err := h.v.Refresh(r.Context(), h.r.GetParam(r, h.idKey), v.KeyPair)
+	if err != nil {
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+
+	if err := rf.WriteJSON(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (h *HTTPHandlers) delete(w http.ResponseWriter, r *http.Request) {
 	id := h.r.GetParam(r, h.idKey)
-	if err := h.v.Destroy(id); err != nil {
-		if IsNotFound(err) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
+	if err := h.v.Destroy(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+}
+
+func (h *HTTPHandlers) forceDelete(w http.ResponseWriter, r *http.Request) {
+	id := h.sys.GetParam(r, h.idKey)
+	if err := h.v.ForceDestroy(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+}
+
+func (h *HTTPHandlers) capacity(w http.ResponseWriter, _ *http.Request) {
+	c, err := h.v.Capacity()
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := c.WriteJSON(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *HTTPHandlers) cleanups(w http.ResponseWriter, _ *http.Request) {
+	if err := h.v.Cleanups().WriteJSON(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
-func (h *HTTPHandlers) ensureParam(fn http.HandlerFunc, p string) http.HandlerFunc {
+func (h *HTTPHandlers) ensureParam(rt HTTPRouter, fn http.HandlerFunc, p string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if h.r.GetParam(r, p) == "" {
+		if rt.GetParam(r, p) == "" {
 			http.Error(w, fmt.Sprintf("Missing URL component: %v", p), http.StatusBadRequest)
 			return
 		}
@@ -2,22 +2,44 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/negz/secret-volume/api"
 	"github.com/negz/secret-volume/fixtures"
+	"github.com/negz/secret-volume/volume"
 )
 
 type noopVolumeManager struct{}
 
-func (v *noopVolumeManager) Create(_ *api.Volume) error {
+func (v *noopVolumeManager) Create(_ context.Context, _ *api.Volume) error {
+	return nil
+}
+
+func (v *noopVolumeManager) CreateAsync(_ context.Context, p *api.Volume) error {
+	p.Status = api.VolumePending
+	return nil
+}
+
+func (v *noopVolumeManager) Update(_ context.Context, _ *api.Volume) error {
+	return nil
+}
+
+func (v *noopVolumeManager) Refresh(_ context.Context, id string, _ api.KeyPair) (*api.Refresh, error) {
+	return testRefresh, nil
+}
+
+func (v *noopVolumeManager) Destroy(_ context.Context, id string) error {
 	return nil
 }
 
-func (v *noopVolumeManager) Destroy(id string) error {
+func (v *noopVolumeManager) ForceDestroy(_ context.Context, id string) error {
 	return nil
 }
 
@@ -29,10 +51,31 @@ func (v *noopVolumeManager) List() (api.Volumes, error) {
 	return fixtures.TestVolumes, nil
 }
 
+func (v *noopVolumeManager) Capacity() (*api.Capacity, error) {
+	return testCapacity, nil
+}
+
+func (v *noopVolumeManager) Cleanups() api.Cleanups {
+	return testCleanups
+}
+
 func (v *noopVolumeManager) MetadataFile() string {
 	return ".meta"
 }
 
+var testCleanups = api.Cleanups{{ID: "busy", Since: time.Unix(1476240696, 0).UTC(), Attempts: 2, Error: "volume is busy"}}
+
+var testRefresh = &api.Refresh{
+	ID:      "id",
+	Version: 2,
+	Time:    time.Unix(1476240696, 0).UTC(),
+	Added:   []api.FileHash{{Path: "new", HMAC: "9d3e6b8c0c2a1f4e7b5d9a8c6e4f2a1b3c5d7e9f0a2b4c6d8e0f1a3b5c7d9e1f"}},
+	Removed: []api.FileHash{},
+	Changed: []api.FileHash{},
+}
+
+var testCapacity = &api.Capacity{BudgetBytes: 100 << 20, AllocatedBytes: 50 << 20, UsedBytes: 1 << 10, Volumes: 1}
+
 func TestHTTPHandlers(t *testing.T) {
 	h, err := NewHTTPHandlers(&noopVolumeManager{})
 	if err != nil {
@@ -111,4 +154,296 @@ func TestHTTPHandlers(t *testing.T) {
 			t.Errorf("Wanted %v, got %v", fixtures.TestVolume, v)
 		}
 	})
+	t.Run("CreateAsync", func(t *testing.T) {
+		b := &bytes.Buffer{}
+		fixtures.TestVolume.WriteJSON(b)
+
+		w := httptest.NewRecorder()
+		h.r.ServeHTTP(w, httptest.NewRequest("POST", "/?async=true", b))
+
+		if w.Code != http.StatusAccepted {
+			t.Errorf("w.Code want %v, got %v (%v)", http.StatusAccepted, w.Code, w.Body.String())
+			return
+		}
+		if l := w.Header().Get("Location"); l != "/"+fixtures.TestVolume.ID {
+			t.Errorf("Location want %v, got %v", "/"+fixtures.TestVolume.ID, l)
+		}
+
+		v, err := api.ReadVolumeJSON(w.Body)
+		if err != nil {
+			t.Errorf("api.ReadVolumeJSON(%v): %v", w.Body, err)
+			return
+		}
+		if v.Status != api.VolumePending {
+			t.Errorf("Wanted status %v, got %v", api.VolumePending, v.Status)
+		}
+	})
+	t.Run("Update", func(t *testing.T) {
+		b := &bytes.Buffer{}
+		fixtures.TestVolume.WriteJSON(b)
+
+		w := httptest.NewRecorder()
+		h.r.ServeHTTP(w, httptest.NewRequest("PUT", "/"+fixtures.TestVolume.ID, b))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("w.Code want %v, got %v (%v)", http.StatusOK, w.Code, w.Body.String())
+			return
+		}
+
+		v, err := api.ReadVolumeJSON(w.Body)
+		if err != nil {
+			t.Errorf("api.ReadVolumeJSON(%v): %v", w.Body, err)
+			return
+		}
+
+		if !reflect.DeepEqual(v, fixtures.TestVolume) {
+			t.Errorf("Wanted %v, got %v", fixtures.TestVolume, v)
+		}
+	})
+	t.Run("UpdateWrongID", func(t *testing.T) {
+		b := &bytes.Buffer{}
+		fixtures.TestVolume.WriteJSON(b)
+
+		w := httptest.NewRecorder()
+		h.r.ServeHTTP(w, httptest.NewRequest("PUT", "/notthisone", b))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("w.Code want %v, got %v (%v)", http.StatusBadRequest, w.Code, w.Body.String())
+		}
+	})
+	t.Run("Refresh", func(t *testing.T) {
+		b := &bytes.Buffer{}
+		fixtures.TestVolume.WriteJSON(b)
+
+		w := httptest.NewRecorder()
+		h.r.ServeHTTP(w, httptest.NewRequest("POST", "/id/refresh", b))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("w.Code want %v, got %v (%v)", http.StatusOK, w.Code, w.Body.String())
+			return
+		}
+
+		rf, err := api.ReadRefreshJSON(w.Body)
+		if err != nil {
+			t.Errorf("api.ReadRefreshJSON(%v): %v", w.Body, err)
+			return
+		}
+
+		if !reflect.DeepEqual(rf, testRefresh) {
+			t.Errorf("Wanted %+v, got %+v", testRefresh, rf)
+		}
+	})
+	t.Run("Capacity", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", SystemPrefix+"capacity", nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("w.Code want %v, got %v (%v)", http.StatusOK, w.Code, w.Body.String())
+			return
+		}
+
+		c, err := api.ReadCapacityJSON(w.Body)
+		if err != nil {
+			t.Errorf("api.ReadCapacityJSON(%v): %v", w.Body, err)
+			return
+		}
+
+		if !reflect.DeepEqual(c, testCapacity) {
+			t.Errorf("Wanted %+v, got %+v", testCapacity, c)
+		}
+	})
+	t.Run("Cleanups", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", SystemPrefix+"cleanups", nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("w.Code want %v, got %v (%v)", http.StatusOK, w.Code, w.Body.String())
+			return
+		}
+
+		cs, err := api.ReadCleanupsJSON(w.Body)
+		if err != nil {
+			t.Errorf("api.ReadCleanupsJSON(%v): %v", w.Body, err)
+			return
+		}
+
+		if !reflect.DeepEqual(cs, testCleanups) {
+			t.Errorf("Wanted %v, got %v", testCleanups, cs)
+		}
+	})
+	t.Run("ForceDelete", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("DELETE", SystemPrefix+"volumes/id", nil))
+
+		if w.Code != http.StatusOK {
+			t.Errorf("w.Code want %v, got %v (%v)", http.StatusOK, w.Code, w.Body.String())
+			return
+		}
+	})
+}
+
+type invalidVolumeManager struct {
+	noopVolumeManager
+}
+
+func (v *invalidVolumeManager) Create(_ context.Context, p *api.Volume) error {
+	return volume.ErrInvalid("invalid volume ID " + p.ID)
+}
+
+func TestHTTPHandlersCreateInvalid(t *testing.T) {
+	h, err := NewHTTPHandlers(&invalidVolumeManager{})
+	if err != nil {
+		t.Fatalf("NewHTTPHandlers(): %v", err)
+	}
+	h.setupRoutes()
+
+	b := &bytes.Buffer{}
+	fixtures.TestVolume.WriteJSON(b)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", b))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w.Code want %v, got %v (%v)", http.StatusBadRequest, w.Code, w.Body.String())
+	}
+}
+
+type existsVolumeManager struct {
+	noopVolumeManager
+}
+
+func (v *existsVolumeManager) Create(_ context.Context, _ *api.Volume) error {
+	return volume.ErrExists("volume exists with a different spec: Source: have Talos, want Exec")
+}
+
+func TestHTTPHandlersCreateConflict(t *testing.T) {
+	h, err := NewHTTPHandlers(&existsVolumeManager{})
+	if err != nil {
+		t.Fatalf("NewHTTPHandlers(): %v", err)
+	}
+	h.setupRoutes()
+
+	b := &bytes.Buffer{}
+	fixtures.TestVolume.WriteJSON(b)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", b))
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("w.Code want %v, got %v (%v)", http.StatusConflict, w.Code, w.Body.String())
+	}
+}
+
+var statusForTests = []struct {
+	err  error
+	want int
+}{
+	{volume.ErrInvalid("invalid volume ID"), http.StatusBadRequest},
+	{volume.ErrForbidden("forbidden"), http.StatusForbidden},
+	{volume.ErrNonExist("volume not found"), http.StatusNotFound},
+	{volume.ErrConflict("volume is being created or destroyed"), http.StatusConflict},
+	{volume.ErrInsufficientCapacity("budget exhausted"), http.StatusInsufficientStorage},
+	{errors.Wrap(context.Canceled, "cannot produce secrets"), http.StatusServiceUnavailable},
+	{errors.Wrap(context.DeadlineExceeded, "cannot produce secrets"), http.StatusGatewayTimeout},
+	{errors.New("boom"), http.StatusInternalServerError},
+}
+
+func TestStatusFor(t *testing.T) {
+	for _, tt := range statusForTests {
+		if got := statusFor(tt.err); got != tt.want {
+			t.Errorf("statusFor(%v): want %v, got %v", tt.err, tt.want, got)
+		}
+	}
+}
+
+type slowVolumeManager struct {
+	noopVolumeManager
+}
+
+func (v *slowVolumeManager) Create(ctx context.Context, _ *api.Volume) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (v *slowVolumeManager) Update(ctx context.Context, _ *api.Volume) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (v *slowVolumeManager) Refresh(ctx context.Context, _ string, _ api.KeyPair) (*api.Refresh, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (v *slowVolumeManager) Destroy(ctx context.Context, _ string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (v *slowVolumeManager) ForceDestroy(ctx context.Context, _ string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+var cancelledTests = []struct {
+	name   string
+	method string
+	path   string
+}{
+	{"Create", "POST", "/"},
+	{"Update", "PUT", "/" + fixtures.TestVolume.ID},
+	{"Refresh", "POST", "/id/refresh"},
+	{"Delete", "DELETE", "/id"},
+	{"ForceDelete", "DELETE", SystemPrefix + "volumes/id"},
+}
+
+func TestHTTPHandlersCancelled(t *testing.T) {
+	h, err := NewHTTPHandlers(&slowVolumeManager{})
+	if err != nil {
+		t.Fatalf("NewHTTPHandlers(): %v", err)
+	}
+	h.setupRoutes()
+
+	for _, tt := range cancelledTests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			fixtures.TestVolume.WriteJSON(b)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, b).WithContext(ctx))
+
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("w.Code want %v, got %v (%v)", http.StatusServiceUnavailable, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+var createTimeoutTests = []struct {
+	name string
+	q    string
+	code int
+}{
+	{"TimedOut", "?timeout=1ms", http.StatusGatewayTimeout},
+	{"BadTimeout", "?timeout=soon", http.StatusBadRequest},
+}
+
+func TestHTTPHandlersCreateTimeout(t *testing.T) {
+	h, err := NewHTTPHandlers(&slowVolumeManager{})
+	if err != nil {
+		t.Fatalf("NewHTTPHandlers(): %v", err)
+	}
+	h.setupRoutes()
+
+	for _, tt := range createTimeoutTests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			fixtures.TestVolume.WriteJSON(b)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/"+tt.q, b))
+
+			if w.Code != tt.code {
+				t.Errorf("w.Code want %v, got %v (%v)", tt.code, w.Code, w.Body.String())
+			}
+		})
+	}
 }
@@ -17,6 +17,8 @@ type HTTPRouter interface {
 	GET(path string, handler http.Handler)
 	// POST is a convenience wrapper around Handler.
 	POST(path string, handler http.Handler)
+	// PUT is a convenience wrapper around Handler.
+	PUT(path string, handler http.Handler)
 	// DELETE is a convenience wrapper around Handler.
 	DELETE(path string, handler http.Handler)
 	// ServeHTTP allows the use of a HTTPRouter as a http.Handler.
@@ -93,6 +95,10 @@ func (r *hrHTTPRouter) POST(p string, h http.Handler) {
 	r.Handler("POST", p, h)
 }
 
+func (r *hrHTTPRouter) PUT(p string, h http.Handler) {
+	r.Handler("PUT", p, h)
+}
+
 func (r *hrHTTPRouter) DELETE(p string, h http.Handler) {
 	r.Handler("DELETE", p, h)
 }
@@ -0,0 +1,76 @@
+package volume
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/negz/secret-volume/api"
+)
+
+var metadataBucket = []byte("volumes")
+
+type boltMetadataStore struct {
+	db *bolt.DB
+}
+
+// NewBoltMetadataStore creates a MetadataStore backed by an embedded
+// https://github.com/etcd-io/bbolt key/value database in the supplied file. The
+// file is created if it does not exist. Only one process may open the file at
+// a time.
+func NewBoltMetadataStore(file string) (MetadataStore, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open metadata database %v", file)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(metadataBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "cannot create metadata bucket")
+	}
+	return &boltMetadataStore{db}, nil
+}
+
+func (ms *boltMetadataStore) Put(v *api.Volume) error {
+	log.Debug("storing metadata", zap.String("id", v.ID), zap.String("db", ms.db.Path()))
+	b := &bytes.Buffer{}
+	if err := v.WriteJSON(b); err != nil {
+		return errors.Wrap(err, "cannot encode metadata")
+	}
+	return errors.Wrap(ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metadataBucket).Put([]byte(v.ID), b.Bytes())
+	}), "cannot store metadata")
+}
+
+func (ms *boltMetadataStore) Get(id string) (*api.Volume, error) {
+	var v *api.Volume
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metadataBucket).Get([]byte(id))
+		if b == nil {
+			return ErrNonExist("metadata not found")
+		}
+		// Bolt values are only valid for the life of the transaction, but the
+		// decoder copies what it needs.
+		var err error
+		v, err = api.ReadVolumeJSON(bytes.NewReader(b))
+		return err
+	})
+	return v, errors.Wrap(err, "cannot get metadata")
+}
+
+func (ms *boltMetadataStore) Delete(id string) error {
+	log.Debug("deleting metadata", zap.String("id", id), zap.String("db", ms.db.Path()))
+	return errors.Wrap(ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metadataBucket).Delete([]byte(id))
+	}), "cannot delete metadata")
+}
+
+func (ms *boltMetadataStore) Close() error {
+	return errors.Wrap(ms.db.Close(), "cannot close metadata database")
+}
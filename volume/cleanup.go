@@ -0,0 +1,263 @@
+package volume
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+
+	"github.com/negz/secret-volume/api"
+)
+
+func busy(err error) bool {
+	_, ok := errors.Cause(err).(ErrBusy)
+	return ok
+}
+
+// unmount unmounts the supplied volume, retrying with backoff while it is busy,
+// then lazily unmounting it if it remains busy and the Manager is so
+// configured. Retrying stops if the supplied context is done.
+func (sm *manager) unmount(ctx context.Context, id string, retries int) error {
+	err := sm.m.Unmount(id)
+	for i, d := 0, sm.backoff; i < retries && busy(err); i, d = i+1, d*2 {
+		log.Debug("volume is busy", zap.String("id", id), zap.Duration("retry", d))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+		err = sm.m.Unmount(id)
+	}
+	if !busy(err) || !sm.lazy {
+		return err
+	}
+	l, ok := sm.m.(LazyUnmounter)
+	if !ok {
+		return err
+	}
+	log.Info("lazily unmounting busy volume", zap.String("id", id), zap.String("path", sm.m.Path(id)))
+	return l.LazyUnmount(id)
+}
+
+// cleaning returns true if the supplied volume has been destroyed but not yet
+// cleaned up.
+func (sm *manager) cleaning(id string) bool {
+	sm.cmx.Lock()
+	defer sm.cmx.Unlock()
+	_, ok := sm.cleanups[id]
+	return ok
+}
+
+// defaultCleanupInterval is how often to retry cleaning up volumes that were
+// awaiting cleanup when the Manager was created, if it is not configured to
+// defer cleanup.
+const defaultCleanupInterval = 1 * time.Minute
+
+// deferCleanup records that the supplied busy volume was destroyed, then
+// arranges for it to be cleaned up later. The volume remains destroyed if the
+// Manager restarts before it is cleaned up.
+func (sm *manager) deferCleanup(id string, err error) error {
+	v, ok := sm.idx.get(id)
+	if !ok {
+		v = &api.Volume{ID: id}
+	}
+	v.Status, v.Error = api.VolumeDestroying, err.Error()
+	v.Cleanup = &api.Cleanup{ID: id, Since: time.Now(), Attempts: 1, Error: err.Error()}
+	if err := sm.ms.Put(v); err != nil {
+		return errors.Wrap(err, "cannot write metadata")
+	}
+	sm.idx.add(v)
+	sm.scheduleCleanup(v)
+	return nil
+}
+
+// scheduleCleanup arranges for the supplied destroyed volume to be cleaned up
+// later, unless it has already been attempted the maximum number of times.
+// Volumes destroyed before cleanup attempts were recorded are treated as having
+// been attempted once.
+func (sm *manager) scheduleCleanup(v *api.Volume) {
+	c := &api.Cleanup{ID: v.ID, Since: time.Now(), Attempts: 1, Error: v.Error}
+	if v.Cleanup != nil {
+		cc := *v.Cleanup
+		c = &cc
+	}
+	sm.cmx.Lock()
+	defer sm.cmx.Unlock()
+	sm.cleanups[v.ID] = c
+	if sm.attempts > 0 && c.Attempts >= sm.attempts {
+		log.Error("not cleaning up volume", zap.String("id", v.ID), zap.Int("attempts", c.Attempts), zap.String("error", c.Error))
+		return
+	}
+	log.Info("deferring cleanup of busy volume", zap.String("id", v.ID), zap.Duration("interval", sm.cleanupInterval()))
+	time.AfterFunc(sm.cleanupInterval(), func() { sm.cleanup(v.ID) })
+}
+
+func (sm *manager) cleanupInterval() time.Duration {
+	if sm.deferred > 0 {
+		return sm.deferred
+	}
+	return defaultCleanupInterval
+}
+
+func (sm *manager) cleanup(id string) {
+	if !sm.locks.tryLock(id) {
+		// The volume is being forcibly destroyed.
+		time.AfterFunc(sm.cleanupInterval(), func() { sm.cleanup(id) })
+		return
+	}
+	defer sm.locks.unlock(id)
+	if !sm.cleaning(id) {
+		// The volume was forcibly destroyed in the meantime.
+		return
+	}
+
+	// The volume may have been unmounted by an earlier attempt that failed to
+	// remove it, or before the Manager restarted.
+	mounted, err := sm.m.Mounted(id)
+	err = errors.Wrap(err, "cannot determine whether volume is mounted")
+	if err == nil && mounted {
+		err = sm.unmount(context.Background(), id, 0)
+	}
+	if err == nil {
+		err = errors.Wrap(sm.fs.RemoveAll(sm.m.Path(id)), "cannot remove volume path")
+	}
+	if err == nil {
+		err = errors.Wrap(sm.ms.Delete(id), "cannot delete metadata")
+	}
+	if err != nil {
+		sm.retryCleanup(id, err)
+		return
+	}
+
+	sm.cmx.Lock()
+	c := sm.cleanups[id]
+	delete(sm.cleanups, id)
+	sm.cmx.Unlock()
+	sm.idx.remove(id)
+	log.Info("destroyed volume", zap.String("id", id), zap.String("path", sm.m.Path(id)), zap.Int("attempts", c.Attempts+1))
+}
+
+// retryCleanup records a failed attempt to clean up the supplied volume, then
+// arranges for it to be retried unless the maximum attempts have been made.
+// Attempts are recorded in the volume's metadata so that they survive a
+// restart of the Manager.
+func (sm *manager) retryCleanup(id string, err error) {
+	sm.cmx.Lock()
+	c := sm.cleanups[id]
+	c.Attempts++
+	c.Error = err.Error()
+	abandon := sm.attempts > 0 && c.Attempts >= sm.attempts
+	if abandon {
+		c.Error = fmt.Sprintf("gave up after %v attempts: %v", c.Attempts, err)
+	}
+	cc := *c
+	sm.cmx.Unlock()
+
+	if v, ok := sm.idx.get(id); ok {
+		v.Cleanup = &cc
+		if perr := sm.ms.Put(v); perr != nil {
+			log.Warn("cannot record cleanup attempt", zap.String("id", id), zap.Error(perr))
+		}
+		sm.idx.add(v)
+	}
+
+	if abandon {
+		log.Error("giving up cleaning up volume", zap.String("id", id), zap.Int("attempts", cc.Attempts), zap.Error(err))
+		return
+	}
+	log.Debug("cannot clean up volume", zap.String("id", id), zap.Int("attempts", cc.Attempts), zap.Error(err))
+	time.AfterFunc(sm.cleanupInterval(), func() { sm.cleanup(id) })
+}
+
+func (sm *manager) ForceDestroy(ctx context.Context, id string) error {
+	log.Debug("forcibly destroying volume", zap.String("id", id))
+	cancelled := sm.cancelCreation(id)
+	if cancelled {
+		// Wait for the cancelled creation to roll back the volume.
+		if err := sm.locks.wait(ctx, id); err != nil {
+			return errors.Wrap(err, "cannot wait for volume creation to be cancelled")
+		}
+	}
+	if ok, err := sm.locks.lock(ctx, id); err != nil {
+		return errors.Wrap(err, "cannot lock volume")
+	} else if !ok {
+		return ErrConflict("volume is being created or destroyed")
+	}
+	defer sm.locks.unlock(id)
+
+	_, indexed := sm.idx.get(id)
+	if exists, err := sm.af.DirExists(sm.m.Path(id)); err != nil {
+		return errors.Wrap(err, "cannot test volume path existence")
+	} else if !exists && !indexed && !sm.cleaning(id) {
+		if cancelled {
+			log.Info("forcibly destroyed volume", zap.String("id", id), zap.String("path", sm.m.Path(id)))
+			return nil
+		}
+		return ErrNonExist("volume not found")
+	}
+	sm.cancelRenewal(id)
+	sm.forget(id)
+	mounted, err := sm.m.Mounted(id)
+	switch {
+	case err != nil:
+		// The volume may or may not be mounted. Try our best to unmount it.
+		log.Warn("cannot determine whether volume is mounted", zap.String("id", id), zap.Error(err))
+		if err := sm.forceUnmount(ctx, id); err != nil {
+			log.Warn("cannot unmount volume", zap.String("id", id), zap.Error(err))
+		}
+	case mounted:
+		if err := sm.forceUnmount(ctx, id); err != nil {
+			return errors.Wrap(err, "cannot unmount volume")
+		}
+	}
+	if err := sm.fs.RemoveAll(sm.m.Path(id)); err != nil {
+		return errors.Wrap(err, "cannot remove volume path")
+	}
+	if err := sm.ms.Delete(id); err != nil {
+		return errors.Wrap(err, "cannot delete metadata")
+	}
+
+	sm.cmx.Lock()
+	delete(sm.cleanups, id)
+	sm.cmx.Unlock()
+	sm.idx.remove(id)
+
+	log.Info("forcibly destroyed volume", zap.String("id", id), zap.String("path", sm.m.Path(id)))
+	return nil
+}
+
+// forceUnmount unmounts the supplied volume, retrying while it is busy then
+// lazily unmounting it regardless of whether the Manager is configured to.
+func (sm *manager) forceUnmount(ctx context.Context, id string) error {
+	err := sm.unmount(ctx, id, sm.retries)
+	if !busy(err) {
+		return err
+	}
+	l, ok := sm.m.(LazyUnmounter)
+	if !ok {
+		return err
+	}
+	log.Info("lazily unmounting busy volume", zap.String("id", id), zap.String("path", sm.m.Path(id)))
+	return l.LazyUnmount(id)
+}
+
+type bySince api.Cleanups
+
+func (cs bySince) Len() int           { return len(cs) }
+func (cs bySince) Less(i, j int) bool { return cs[i].Since.Before(cs[j].Since) }
+func (cs bySince) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+
+func (sm *manager) Cleanups() api.Cleanups {
+	sm.cmx.Lock()
+	defer sm.cmx.Unlock()
+	cs := make(api.Cleanups, 0, len(sm.cleanups))
+	for _, c := range sm.cleanups {
+		cc := *c
+		cs = append(cs, &cc)
+	}
+	sort.Sort(bySince(cs))
+	return cs
+}
@@ -0,0 +1,246 @@
+package volume
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+
+	"github.com/negz/secret-volume/api"
+)
+
+// A credentials store retains the KeyPair of each volume in memory so that its
+// secrets may be refreshed on behalf of the volume's creator. KeyPairs are
+// encrypted under a key generated when the store is created. The key and each
+// encrypted KeyPair are allocated from a single arena of memory outside the Go
+// heap that is locked so that it is never swapped to disk, and zeroed when they
+// are released.
+//
+// Not everything can be kept in the arena. The expanded AES key schedule is
+// held by the cipher on the Go heap. KeyPairs are briefly encoded on the heap
+// before they are encrypted, and that encoding is zeroed, but decrypted
+// KeyPairs are Go strings that cannot be zeroed; they remain on the heap until
+// the garbage collector reuses their memory.
+type credentials struct {
+	mx   sync.Mutex
+	a    *arena
+	key  span
+	aead cipher.AEAD
+	kps  map[string]span
+}
+
+func newCredentials(size int) (*credentials, error) {
+	a, err := newArena(size)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot allocate locked memory")
+	}
+	key, err := a.alloc(32)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot allocate key")
+	}
+	if _, err := io.ReadFull(rand.Reader, a.bytes(key)); err != nil {
+		a.release(key)
+		return nil, errors.Wrap(err, "cannot generate key")
+	}
+	b, err := aes.NewCipher(a.bytes(key))
+	if err != nil {
+		a.release(key)
+		return nil, errors.Wrap(err, "cannot create cipher")
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		a.release(key)
+		return nil, errors.Wrap(err, "cannot create cipher")
+	}
+	return &credentials{a: a, key: key, aead: aead, kps: make(map[string]span)}, nil
+}
+
+// put retains the supplied KeyPair for the supplied volume, replacing any
+// KeyPair already retained.
+func (c *credentials) put(id string, kp api.KeyPair) error {
+	pt, err := json.Marshal(kp)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode keypair")
+	}
+	defer zero(pt)
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	ns := c.aead.NonceSize()
+	sp, err := c.a.alloc(ns + len(pt) + c.aead.Overhead())
+	if err != nil {
+		return errors.Wrap(err, "cannot allocate memory for keypair")
+	}
+	ct := c.a.bytes(sp)
+	if _, err := io.ReadFull(rand.Reader, ct[:ns]); err != nil {
+		c.a.release(sp)
+		return errors.Wrap(err, "cannot generate nonce")
+	}
+	// The volume ID is authenticated, so a KeyPair cannot be used for another
+	// volume.
+	c.aead.Seal(ct[ns:ns], ct[:ns], pt, []byte(id))
+	if old, ok := c.kps[id]; ok {
+		c.a.release(old)
+	}
+	c.kps[id] = sp
+	return nil
+}
+
+// get returns the KeyPair retained for the supplied volume, if any.
+func (c *credentials) get(id string) (api.KeyPair, bool, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	sp, ok := c.kps[id]
+	if !ok {
+		return api.KeyPair{}, false, nil
+	}
+	ct := c.a.bytes(sp)
+	ns := c.aead.NonceSize()
+	pt, err := c.aead.Open(nil, ct[:ns], ct[ns:], []byte(id))
+	if err != nil {
+		return api.KeyPair{}, false, errors.Wrap(err, "cannot decrypt keypair")
+	}
+	defer zero(pt)
+	kp := api.KeyPair{}
+	return kp, true, errors.Wrap(json.Unmarshal(pt, &kp), "cannot decode keypair")
+}
+
+// remove zeroes and releases the KeyPair retained for the supplied volume, if
+// any.
+func (c *credentials) remove(id string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if sp, ok := c.kps[id]; ok {
+		c.a.release(sp)
+		delete(c.kps, id)
+	}
+}
+
+// An arena allocates buffers from a single region of memory that is allocated
+// outside the Go heap and locked into memory, so that retaining many small
+// buffers does not lock a page of memory for each of them.
+type arena struct {
+	mem []byte
+	// free spans, ordered by offset. Adjacent free spans are coalesced.
+	free []span
+}
+
+// A span is a buffer allocated from an arena.
+type span struct {
+	off, n int
+}
+
+func newArena(size int) (*arena, error) {
+	mem, err := lockedBuffer(size)
+	if err != nil {
+		return nil, err
+	}
+	return &arena{mem: mem, free: []span{{0, size}}}, nil
+}
+
+// alloc allocates a span of n bytes from the first free span large enough to
+// hold it. It returns ErrInsufficientCapacity if there is no such span.
+func (a *arena) alloc(n int) (span, error) {
+	for i, f := range a.free {
+		if f.n < n {
+			continue
+		}
+		if f.n == n {
+			a.free = append(a.free[:i], a.free[i+1:]...)
+		} else {
+			a.free[i] = span{f.off + n, f.n - n}
+		}
+		return span{f.off, n}, nil
+	}
+	return span{}, ErrInsufficientCapacity(fmt.Sprintf("insufficient locked memory for %v bytes", n))
+}
+
+// bytes returns the memory of the supplied span.
+func (a *arena) bytes(s span) []byte {
+	return a.mem[s.off : s.off+s.n : s.off+s.n]
+}
+
+// release zeroes the supplied span and returns it to the arena.
+func (a *arena) release(s span) {
+	zero(a.bytes(s))
+	i := sort.Search(len(a.free), func(i int) bool { return a.free[i].off > s.off })
+	a.free = append(a.free, span{})
+	copy(a.free[i+1:], a.free[i:])
+	a.free[i] = s
+	if i+1 < len(a.free) && a.free[i].off+a.free[i].n == a.free[i+1].off {
+		a.free[i].n += a.free[i+1].n
+		a.free = append(a.free[:i+1], a.free[i+2:]...)
+	}
+	if i > 0 && a.free[i-1].off+a.free[i-1].n == a.free[i].off {
+		a.free[i-1].n += a.free[i].n
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	}
+}
+
+// lockedBuffer returns a buffer of n bytes that is allocated outside the Go
+// heap and locked into memory.
+func lockedBuffer(n int) ([]byte, error) {
+	b, err := syscall.Mmap(-1, 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot map memory")
+	}
+	if err := syscall.Mlock(b); err != nil {
+		syscall.Munmap(b)
+		return nil, errors.Wrap(err, "cannot lock memory")
+	}
+	return b, nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// retain retains the KeyPair of the supplied volume, if the Manager is
+// configured to retain credentials and the volume has a KeyPair. It returns
+// ErrInsufficientCapacity if there is not enough locked memory to retain the
+// KeyPair.
+func (sm *manager) retain(v *api.Volume) error {
+	if sm.creds == nil || v.KeyPair == (api.KeyPair{}) {
+		return nil
+	}
+	if err := sm.creds.put(v.ID, v.KeyPair); err != nil {
+		return err
+	}
+	log.Debug("retained volume credentials", zap.String("id", v.ID))
+	return nil
+}
+
+// forget releases any KeyPair retained for the supplied volume.
+func (sm *manager) forget(id string) {
+	if sm.creds == nil {
+		return
+	}
+	sm.creds.remove(id)
+}
+
+// retained returns the supplied KeyPair, or the KeyPair retained for the
+// supplied volume if the supplied KeyPair is empty.
+func (sm *manager) retained(id string, kp api.KeyPair) (api.KeyPair, error) {
+	if sm.creds == nil || kp != (api.KeyPair{}) {
+		return kp, nil
+	}
+	r, ok, err := sm.creds.get(id)
+	if err != nil {
+		return kp, errors.Wrap(err, "cannot get retained credentials")
+	}
+	if ok {
+		log.Debug("using retained volume credentials", zap.String("id", id))
+		return r, nil
+	}
+	return kp, nil
+}
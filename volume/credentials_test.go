@@ -0,0 +1,47 @@
+package volume
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestArena(t *testing.T) {
+	a, err := newArena(64)
+	if err != nil {
+		t.Fatalf("newArena(64): %v", err)
+	}
+
+	spans := []span{}
+	for _, n := range []int{16, 16, 16, 16} {
+		s, err := a.alloc(n)
+		if err != nil {
+			t.Fatalf("a.alloc(%v): %v", n, err)
+		}
+		copy(a.bytes(s), "secretsecretsecret")
+		spans = append(spans, s)
+	}
+	if _, err := a.alloc(1); !isInsufficientCapacity(err) {
+		t.Errorf("a.alloc(1): want ErrInsufficientCapacity, got %v", err)
+	}
+
+	// Releasing adjacent spans coalesces them, regardless of order.
+	for _, i := range []int{2, 0, 1} {
+		a.release(spans[i])
+	}
+	if want := []span{{0, 48}}; !reflect.DeepEqual(a.free, want) {
+		t.Errorf("a.release(): want free spans %v, got %v", want, a.free)
+	}
+	for i, b := range a.mem[:48] {
+		if b != 0 {
+			t.Fatalf("a.release(): want released memory zeroed, got %q at %v", b, i)
+		}
+	}
+
+	s, err := a.alloc(40)
+	if err != nil {
+		t.Fatalf("a.alloc(40): %v", err)
+	}
+	if want := (span{0, 40}); s != want {
+		t.Errorf("a.alloc(40): want %v, got %v", want, s)
+	}
+}
@@ -0,0 +1,148 @@
+package volume
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/uber-go/zap"
+
+	"github.com/negz/secret-volume/api"
+)
+
+type dirMounter struct {
+	root string
+	fs   afero.Fs
+}
+
+// A DirMounterOption represents an argument to NewDirMounter.
+type DirMounterOption func(*dirMounter) error
+
+// DirFilesystem allows a dir Mounter to be backed by any filesystem
+// implementation supported by https://github.com/spf13/afero. It should match
+// the Manager's filesystem. The OS filesystem is used by default.
+func DirFilesystem(fs afero.Fs) DirMounterOption {
+	return func(m *dirMounter) error {
+		m.fs = fs
+		return nil
+	}
+}
+
+// NewDirMounter creates a Mounter that stores secrets in plain directories on
+// the host filesystem. It does not require root, and is intended for
+// development. Secrets are only kept out of persistent storage if root is on a
+// memory-backed filesystem. Unmounting a volume overwrites the contents of its
+// files before the Manager removes them, as does removing or replacing a file
+// while the volume is renewed or updated.
+func NewDirMounter(root string, mo ...DirMounterOption) (Mounter, error) {
+	m := &dirMounter{root, afero.NewOsFs()}
+	for _, o := range mo {
+		if err := o(m); err != nil {
+			return nil, errors.Wrap(err, "cannot apply dir mounter option")
+		}
+	}
+	return m, nil
+}
+
+func (m *dirMounter) Mount(v *api.Volume) error {
+	log.Debug("mount", zap.String("path", m.Path(v.ID)), zap.String("type", "dir"))
+	return nil
+}
+
+// Unmount overwrites the contents of all files in the volume with zeroes.
+// Directories are made writable so the Manager can remove their contents.
+func (m *dirMounter) Unmount(id string) error {
+	log.Debug("unmount", zap.String("path", m.Path(id)), zap.String("type", "dir"))
+	err := afero.Walk(m.fs, m.Path(id), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return errors.Wrapf(m.fs.Chmod(p, fi.Mode().Perm()|0700), "cannot make %v writable", p)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return errors.Wrapf(m.Wipe(p, func() error { return nil }), "cannot wipe %v", p)
+	})
+	return errors.Wrap(err, "cannot wipe volume")
+}
+
+// Wipe opens the supplied file, calls fn, then overwrites the contents of the
+// opened file with zeroes. The file is opened before fn is called so that if fn
+// replaces it, the replaced file is wiped rather than its replacement.
+func (m *dirMounter) Wipe(p string, fn func() error) error {
+	fi, err := m.fs.Stat(p)
+	if os.IsNotExist(err) || (err == nil && !fi.Mode().IsRegular()) {
+		return fn()
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot stat file")
+	}
+	// Secrets may be read-only, which would prevent us opening them for
+	// writing unless we're root.
+	if fi.Mode().Perm()&0200 == 0 {
+		if err := m.fs.Chmod(p, fi.Mode().Perm()|0200); err != nil {
+			return errors.Wrap(err, "cannot make file writable")
+		}
+	}
+	f, err := m.fs.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "cannot open file")
+	}
+	if err := fn(); err != nil {
+		f.Close()
+		return err
+	}
+	return wipe(f, fi.Size())
+}
+
+// wipe overwrites the first size bytes of the supplied file with zeroes, then
+// closes it.
+func wipe(f afero.File, size int64) error {
+	if _, err := io.CopyN(f, zeroes{}, size); err != nil {
+		f.Close()
+		return errors.Wrap(err, "cannot overwrite file")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "cannot sync file")
+	}
+	return errors.Wrap(f.Close(), "cannot close file")
+}
+
+type zeroes struct{}
+
+func (zeroes) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func (m *dirMounter) ReadOnly(id string) error {
+	// Any process running as our user could simply make the directory writable
+	// again, so we don't pretend otherwise.
+	log.Debug("remount", zap.String("path", m.Path(id)), zap.Bool("readonly", true), zap.String("type", "dir"))
+	return nil
+}
+
+func (m *dirMounter) Writable(id string) error {
+	log.Debug("remount", zap.String("path", m.Path(id)), zap.Bool("readonly", false), zap.String("type", "dir"))
+	return nil
+}
+
+// Mounted always returns true, as plain directories need not be mounted.
+func (m *dirMounter) Mounted(id string) (bool, error) {
+	return true, nil
+}
+
+func (m *dirMounter) Path(id string) string {
+	return path.Join(m.root, id)
+}
+
+func (m *dirMounter) Root() string {
+	return m.root
+}
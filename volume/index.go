@@ -0,0 +1,101 @@
+package volume
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/negz/secret-volume/api"
+)
+
+// An index is an in-memory index of volume metadata, keyed by volume ID.
+type index struct {
+	mx   sync.RWMutex
+	vols map[string]*api.Volume
+}
+
+func newIndex() *index {
+	return &index{vols: make(map[string]*api.Volume)}
+}
+
+// add indexes a copy of the supplied volume's metadata. The KeyPair is only
+// needed while the volume's secrets are first produced, and is not indexed.
+func (i *index) add(v *api.Volume) {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	cv := clone(v)
+	cv.KeyPair = api.KeyPair{}
+	i.vols[v.ID] = cv
+}
+
+func (i *index) remove(id string) {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	delete(i.vols, id)
+}
+
+// get returns a copy of the indexed metadata of the volume specified by id.
+func (i *index) get(id string) (*api.Volume, bool) {
+	i.mx.RLock()
+	defer i.mx.RUnlock()
+	v, ok := i.vols[id]
+	if !ok {
+		return nil, false
+	}
+	return clone(v), true
+}
+
+// clone returns a deep copy of the supplied volume, so that callers may not
+// modify indexed metadata.
+func clone(v *api.Volume) *api.Volume {
+	cv := *v
+	if v.Tags != nil {
+		cv.Tags = make(url.Values, len(v.Tags))
+		for k, vs := range v.Tags {
+			cv.Tags[k] = append([]string(nil), vs...)
+		}
+	}
+	if v.Owner != nil {
+		o := *v.Owner
+		cv.Owner = &o
+	}
+	if v.Mounted != nil {
+		m := *v.Mounted
+		cv.Mounted = &m
+	}
+	if v.Usage != nil {
+		u := *v.Usage
+		cv.Usage = &u
+	}
+	if v.Modes != nil {
+		m := *v.Modes
+		cv.Modes = &m
+	}
+	if v.Notify != nil {
+		n := *v.Notify
+		cv.Notify = &n
+	}
+	if v.Cleanup != nil {
+		c := *v.Cleanup
+		cv.Cleanup = &c
+	}
+	return &cv
+}
+
+type byID api.Volumes
+
+func (vs byID) Len() int           { return len(vs) }
+func (vs byID) Less(i, j int) bool { return vs[i].ID < vs[j].ID }
+func (vs byID) Swap(i, j int)      { vs[i], vs[j] = vs[j], vs[i] }
+
+// list returns copies of the indexed metadata of all volumes, sorted by ID.
+func (i *index) list() api.Volumes {
+	i.mx.RLock()
+	defer i.mx.RUnlock()
+	vs := make(api.Volumes, 0, len(i.vols))
+	for _, v := range i.vols {
+		vs = append(vs, clone(v))
+	}
+	sort.Sort(byID(vs))
+	return vs
+}
@@ -0,0 +1,88 @@
+package volume
+
+import (
+	"context"
+	"sync"
+)
+
+// locks are per-volume locks, keyed by volume ID. Volumes are locked while they
+// are being created, destroyed, or renewed.
+type locks struct {
+	mx   sync.Mutex
+	held map[string]*lock
+}
+
+// A lock is held on a volume either by a request, or by background work such as
+// renewing its secrets or cleaning it up.
+type lock struct {
+	background bool
+	released   chan struct{}
+}
+
+func newLocks() *locks {
+	return &locks{held: make(map[string]*lock)}
+}
+
+// tryLock locks the volume specified by id on behalf of background work,
+// returning false if it is already locked. Background work is expected to try
+// again later.
+func (l *locks) tryLock(id string) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if _, held := l.held[id]; held {
+		return false
+	}
+	l.held[id] = &lock{background: true, released: make(chan struct{})}
+	return true
+}
+
+// lock locks the volume specified by id on behalf of a request, returning false
+// if it is already locked by another request. Background work is brief, so
+// requests wait for it to release the lock rather than fail spuriously. An
+// error is returned if the supplied context is done while waiting.
+func (l *locks) lock(ctx context.Context, id string) (bool, error) {
+	for {
+		l.mx.Lock()
+		h, held := l.held[id]
+		if !held {
+			l.held[id] = &lock{released: make(chan struct{})}
+			l.mx.Unlock()
+			return true, nil
+		}
+		l.mx.Unlock()
+		if !h.background {
+			return false, nil
+		}
+		select {
+		case <-h.released:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// wait waits for the volume specified by id to be unlocked, if it is locked. An
+// error is returned if the supplied context is done while waiting.
+func (l *locks) wait(ctx context.Context, id string) error {
+	l.mx.Lock()
+	h, held := l.held[id]
+	l.mx.Unlock()
+	if !held {
+		return nil
+	}
+	select {
+	case <-h.released:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *locks) unlock(id string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if h, held := l.held[id]; held {
+		close(h.released)
+		delete(l.held, id)
+	}
+}
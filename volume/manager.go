@@ -3,9 +3,17 @@
 package volume
 
 import (
+	"context"
+	"crypto/rand"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
@@ -16,14 +24,21 @@ import (
 )
 
 // ErrExists is returned when when attempting to create a volume whose mount
-// point exists. Note this does not mean the volume already exists, just that a
-// conflicting path exists.
+// point exists, unless a healthy volume with the same source and tags exists.
+// Note this does not mean the volume already exists, just that a conflicting
+// path exists.
 type ErrExists string
 
 func (e ErrExists) Error() string {
 	return string(e)
 }
 
+// Conflict signals that this error should return a HTTP 409 conflict if it
+// causes a HTTP request to fail.
+func (e ErrExists) Conflict() bool {
+	return true
+}
+
 // ErrNonExist is returned when attempting to get or destroy a volume that does
 // not exist.
 type ErrNonExist string
@@ -38,18 +53,113 @@ func (e ErrNonExist) NotFound() bool {
 	return true
 }
 
+// ErrForbidden is returned when a volume requests something it is not
+// permitted to, for example an owner outside of the permitted range.
+type ErrForbidden string
+
+func (e ErrForbidden) Error() string {
+	return string(e)
+}
+
+// Forbidden signals that this error should return a HTTP 403 forbidden if it
+// causes a HTTP request to fail.
+func (e ErrForbidden) Forbidden() bool {
+	return true
+}
+
+// ErrInvalid is returned when a volume is malformed, for example when its ID
+// is not a valid path component.
+type ErrInvalid string
+
+func (e ErrInvalid) Error() string {
+	return string(e)
+}
+
+// BadRequest signals that this error should return a HTTP 400 bad request if it
+// causes a HTTP request to fail.
+func (e ErrInvalid) BadRequest() bool {
+	return true
+}
+
+// ErrInsufficientCapacity is returned when creating a volume would exceed the
+// memory budget.
+type ErrInsufficientCapacity string
+
+func (e ErrInsufficientCapacity) Error() string {
+	return string(e)
+}
+
+// InsufficientStorage signals that this error should return a HTTP 507
+// insufficient storage if it causes a HTTP request to fail.
+func (e ErrInsufficientCapacity) InsufficientStorage() bool {
+	return true
+}
+
+// ErrConflict is returned when attempting to create or destroy a volume while
+// another operation on the same volume is in progress.
+type ErrConflict string
+
+func (e ErrConflict) Error() string {
+	return string(e)
+}
+
+// Conflict signals that this error should return a HTTP 409 conflict if it
+// causes a HTTP request to fail.
+func (e ErrConflict) Conflict() bool {
+	return true
+}
+
 // A Manager manages CRD operations for secret volumes.
 type Manager interface {
-	// Create mounts and populates the requested secret volume.
-	Create(v *api.Volume) error
-	// Destroy destroys the secret volume specified by id.
-	Destroy(id string) error
+	// Create mounts and populates the requested secret volume. Creation is
+	// rolled back if the supplied context is cancelled before it completes.
+	// The effective size and modes of the volume are set on the supplied
+	// api.Volume. Creating a volume that already exists with the same source
+	// and tags succeeds without modifying it, setting the existing volume's
+	// metadata on the supplied api.Volume.
+	Create(ctx context.Context, v *api.Volume) error
+	// CreateAsync validates the requested secret volume and begins to create
+	// it in the background. The volume's status is pending until it is ready
+	// or has failed. Volumes that are not created within the CreateTimeout are
+	// removed.
+	CreateAsync(ctx context.Context, v *api.Volume) error
+	// Update replaces the tags of the supplied ready volume, then replaces its
+	// secrets with those produced for the new tags and KeyPair. All of its
+	// secrets are replaced at once, and files that are no longer produced are
+	// removed.
+	// The volume is untouched if its new secrets cannot be produced or
+	// written. The updated volume's metadata is set on the supplied api.Volume.
+	// The KeyPair may be omitted if the Manager retains credentials.
+	Update(ctx context.Context, v *api.Volume) error
+	// Refresh replaces the secrets of the supplied ready volume with secrets
+	// produced afresh for its existing tags and the supplied KeyPair, as per
+	// Update. It returns a description of the files that were added, removed,
+	// and changed. The KeyPair may be omitted if the Manager retains
+	// credentials.
+	Refresh(ctx context.Context, id string, kp api.KeyPair) (*api.Refresh, error)
+	// Destroy destroys the secret volume specified by id. Create, Update, and
+	// Destroy return ErrConflict while another request on the same volume is
+	// in progress, but wait for any renewal or cleanup of the volume to
+	// finish. Retrying the unmount of a busy volume stops if the supplied
+	// context is cancelled.
+	Destroy(ctx context.Context, id string) error
+	// ForceDestroy destroys the secret volume specified by id, even if it is
+	// broken, awaiting cleanup, or pending. The creation of pending volumes is
+	// cancelled. Busy volumes are lazily unmounted if the Mounter supports it.
+	ForceDestroy(ctx context.Context, id string) error
 	// Gets returns secret volumes by their id.
 	Get(id string) (*api.Volume, error)
 	// List lists all extant secret volumes.
 	List() (api.Volumes, error)
-	// MetadataFile returns the metadata filename. Each api.Volume is encoded as
-	// JSON in a metadata file at the root of its mountpoint.
+	// Capacity returns the memory allocated to and used by all secret volumes.
+	Capacity() (*api.Capacity, error)
+	// Cleanups returns destroyed secret volumes that could not be unmounted
+	// because they were busy, and will be cleaned up later.
+	Cleanups() api.Cleanups
+	// MetadataFile returns the legacy metadata filename. Earlier versions
+	// encoded each api.Volume as JSON in a metadata file at the root of its
+	// mountpoint. Such files are migrated to the MetadataStore when the
+	// Manager is created.
 	MetadataFile() string
 }
 
@@ -59,9 +169,42 @@ type manager struct {
 	af          *afero.Afero
 	producerFor secrets.Producers
 	meta        string
+	ms          MetadataStore
+	idx         *index
+	locks       *locks
+	mmode       os.FileMode
 	dmode       os.FileMode
 	fmode       os.FileMode
+	maxModes    *api.Modes
+	sizeMB      uint
+	maxSizeMB   uint
+	budget      int64
+	bmx         sync.Mutex
+	reserved    map[string]int64
+	retries     int
+	backoff     time.Duration
+	lazy        bool
+	deferred    time.Duration
+	attempts    int
+	timeout     time.Duration
+	pmx         sync.Mutex
+	pending     map[string]context.CancelFunc
+	cmx         sync.Mutex
+	cleanups    map[string]*api.Cleanup
 	jsonSecrets string
+	versionFile string
+	hashKey     []byte
+	retry       time.Duration
+	minOwner    int
+	maxOwner    int
+	rmx         sync.Mutex
+	renewals    map[string]*renewal
+	cgroups     string
+	proc        string
+	kill        func(pid int, sig syscall.Signal) error
+	hook        []string
+	hookTimeout time.Duration
+	creds       *credentials
 }
 
 // A ManagerOption represents an argument to NewManager.
@@ -78,9 +221,9 @@ func Filesystem(fs afero.Fs) ManagerOption {
 	}
 }
 
-// MetadataFile specifies an alternative metadata filename in which to store
-// JSON encoded representations of each api.Volume at their root directory. It
-// defaults to '.meta'.
+// MetadataFile specifies an alternative legacy metadata filename. Metadata
+// found in this file at the root of a volume is migrated to the MetadataStore.
+// It defaults to '.meta'.
 func MetadataFile(f string) ManagerOption {
 	return func(sm *manager) error {
 		sm.meta = f
@@ -88,6 +231,25 @@ func MetadataFile(f string) ManagerOption {
 	}
 }
 
+// RootMode specifies the octal mode of each secret volume's mountpoint. It
+// defaults to 0700.
+func RootMode(m os.FileMode) ManagerOption {
+	return func(sm *manager) error {
+		sm.mmode = m
+		return nil
+	}
+}
+
+// Metadata specifies the MetadataStore in which to store the metadata of each
+// volume. By default metadata is stored by a dir MetadataStore in a directory
+// alongside the Mounter's root, i.e. /secrets.metadata for /secrets.
+func Metadata(ms MetadataStore) ManagerOption {
+	return func(sm *manager) error {
+		sm.ms = ms
+		return nil
+	}
+}
+
 // DirMode specifies the octal mode with which to create directories beneath the
 // root of a secret volume. It defaults to 0700.
 func DirMode(m os.FileMode) ManagerOption {
@@ -106,6 +268,101 @@ func FileMode(m os.FileMode) ManagerOption {
 	}
 }
 
+// MaxModes specifies the permission bits volumes may request for their
+// mountpoint, directories, and files. Volumes may not request permissions
+// beyond the RootMode, DirMode, and FileMode by default.
+func MaxModes(m api.Modes) ManagerOption {
+	return func(sm *manager) error {
+		sm.maxModes = &m
+		return nil
+	}
+}
+
+// VolumeSizeMB specifies the size in megabytes of each secret volume, and the
+// maximum size a volume may request. They default to 100MB, i.e. volumes may
+// not request a larger size by default.
+func VolumeSizeMB(def, max uint) ManagerOption {
+	return func(sm *manager) error {
+		if def == 0 || max < def {
+			return errors.Errorf("invalid volume size %vMB with maximum %vMB", def, max)
+		}
+		sm.sizeMB = def
+		sm.maxSizeMB = max
+		return nil
+	}
+}
+
+// MemoryBudgetMB specifies the total size in megabytes that may be allocated
+// to secret volumes. Creating a volume whose size would exceed the budget fails
+// with ErrInsufficientCapacity. There is no budget by default.
+func MemoryBudgetMB(mb uint) ManagerOption {
+	return func(sm *manager) error {
+		sm.budget = int64(mb) << 20
+		return nil
+	}
+}
+
+// UnmountRetries specifies how many times to retry unmounting a busy volume
+// when it is destroyed. The delay between retries starts at backoff and doubles
+// with each retry. It defaults to 3 retries starting at 100 milliseconds.
+func UnmountRetries(retries int, backoff time.Duration) ManagerOption {
+	return func(sm *manager) error {
+		sm.retries = retries
+		sm.backoff = backoff
+		return nil
+	}
+}
+
+// LazyUnmount causes the Manager to lazily unmount volumes that remain busy
+// after any retries, if the Mounter is a LazyUnmounter. A lazily unmounted
+// volume is immediately inaccessible to new processes, but its memory is not
+// released until the processes using it close their files.
+func LazyUnmount() ManagerOption {
+	return func(sm *manager) error {
+		sm.lazy = true
+		return nil
+	}
+}
+
+// DeferCleanup causes the Manager to defer the cleanup of volumes that could
+// not be unmounted because they remained busy. Destroying such a volume
+// succeeds, and unmounting it is retried at the supplied interval until it
+// succeeds or MaxCleanupAttempts is reached. Volumes awaiting cleanup remain
+// so when the Manager restarts. Cleanup is not deferred by default.
+func DeferCleanup(interval time.Duration) ManagerOption {
+	return func(sm *manager) error {
+		sm.deferred = interval
+		return nil
+	}
+}
+
+// MaxCleanupAttempts specifies how many times to attempt to clean up a volume
+// whose cleanup was deferred. Volumes that cannot be cleaned up within this many
+// attempts remain awaiting cleanup until they are forcibly destroyed. It
+// defaults to 100. Zero means no limit.
+func MaxCleanupAttempts(n int) ManagerOption {
+	return func(sm *manager) error {
+		if n < 0 {
+			return errors.Errorf("invalid cleanup attempts %v", n)
+		}
+		sm.attempts = n
+		return nil
+	}
+}
+
+// CreateTimeout specifies how long volumes created in the background may take
+// to create. Volumes that cannot be created in time are removed, as are volumes
+// forcibly destroyed while they are being created. It defaults to five minutes.
+func CreateTimeout(d time.Duration) ManagerOption {
+	return func(sm *manager) error {
+		if d <= 0 {
+			return errors.Errorf("invalid create timeout %v", d)
+		}
+		sm.timeout = d
+		return nil
+	}
+}
+
 // WriteJSONSecrets will cause the manager to merge all secrets produced for
 // a volume into a file containing a JSON encoded map. The provided filename is
 // relative to the volume's root.
@@ -116,38 +373,252 @@ func WriteJSONSecrets(filename string) ManagerOption {
 	}
 }
 
+// VersionFile specifies the file, relative to the root of each volume, to
+// which a JSON encoded api.Refresh describing the changes made to the volume is
+// written each time it is refreshed or updated. It defaults to '.version'. An
+// empty filename disables the version file.
+func VersionFile(filename string) ManagerOption {
+	return func(sm *manager) error {
+		sm.versionFile = filename
+		return nil
+	}
+}
+
+// RenewalRetry specifies how long to wait before retrying a failed renewal of
+// secrets that expire. It defaults to one minute.
+func RenewalRetry(d time.Duration) ManagerOption {
+	return func(sm *manager) error {
+		sm.retry = d
+		return nil
+	}
+}
+
+// OwnerRange permits volumes to request an api.Owner whose UID and GID are both
+// between min and max inclusive. Volumes may not request an owner by default.
+func OwnerRange(min, max int) ManagerOption {
+	return func(sm *manager) error {
+		if min < 0 || max < min {
+			return errors.Errorf("invalid owner range %v-%v", min, max)
+		}
+		sm.minOwner = min
+		sm.maxOwner = max
+		return nil
+	}
+}
+
+// NotifySignals permits volumes to request that a process or the processes of
+// a cgroup be signalled when their secrets are renewed, refreshed, or updated.
+// Cgroups are relative to the supplied root of the cgroup filesystem, i.e.
+// /sys/fs/cgroup. Volumes may not request signals by default.
+func NotifySignals(cgroupRoot string) ManagerOption {
+	return func(sm *manager) error {
+		if cgroupRoot == "" {
+			return errors.New("cgroup root must be specified")
+		}
+		sm.cgroups = cgroupRoot
+		return nil
+	}
+}
+
+// NotifyHook specifies a command to run each time the secrets of any volume are
+// renewed, refreshed, or updated. The hook is killed if it runs for longer than
+// the supplied timeout.
+func NotifyHook(timeout time.Duration, command string, args ...string) ManagerOption {
+	return func(sm *manager) error {
+		sm.hook = append([]string{command}, args...)
+		sm.hookTimeout = timeout
+		return nil
+	}
+}
+
+// RetainCredentials causes the Manager to retain the KeyPair with which each
+// volume was created, updated, or refreshed, so that subsequent refreshes and
+// updates may omit the KeyPair. KeyPairs are retained in encrypted memory until
+// their volume is destroyed. The supplied number of kilobytes of memory are
+// locked at startup in which to retain them; creating, updating, or refreshing
+// a volume fails with ErrInsufficientCapacity once it is exhausted. KeyPairs
+// are not retained by default.
+func RetainCredentials(kb uint) ManagerOption {
+	return func(sm *manager) error {
+		if kb == 0 {
+			return errors.New("credential memory must be specified")
+		}
+		c, err := newCredentials(int(kb) << 10)
+		if err != nil {
+			return errors.Wrap(err, "cannot create credential store")
+		}
+		sm.creds = c
+		return nil
+	}
+}
+
 // NewManager creates a new Manager backed by the provided secret producers.
 func NewManager(m Mounter, sp secrets.Producers, mo ...ManagerOption) (Manager, error) {
 	fs := afero.NewOsFs()
-	sm := &manager{m, fs, &afero.Afero{Fs: fs}, sp, ".meta", 0700, 0600, ""}
+	sm := &manager{
+		m:           m,
+		fs:          fs,
+		af:          &afero.Afero{Fs: fs},
+		producerFor: sp,
+		meta:        ".meta",
+		versionFile: ".version",
+		mmode:       0700,
+		dmode:       0700,
+		fmode:       0600,
+		sizeMB:      100,
+		maxSizeMB:   100,
+		retries:     3,
+		backoff:     100 * time.Millisecond,
+		attempts:    100,
+		timeout:     5 * time.Minute,
+		retry:       1 * time.Minute,
+		minOwner:    0,
+		maxOwner:    -1,
+		renewals:    make(map[string]*renewal),
+		proc:        "/proc",
+		kill:        syscall.Kill,
+		reserved:    make(map[string]int64),
+		cleanups:    make(map[string]*api.Cleanup),
+		pending:     make(map[string]context.CancelFunc),
+		idx:         newIndex(),
+		locks:       newLocks(),
+	}
 	for _, o := range mo {
 		if err := o(sm); err != nil {
 			return nil, errors.Wrap(err, "cannot apply manager option")
 		}
 	}
+	if err := sm.permitDefaultModes(); err != nil {
+		return nil, err
+	}
+	// File hashes are keyed so that they cannot be used to confirm guesses at
+	// the contents of low-entropy secrets.
+	sm.hashKey = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, sm.hashKey); err != nil {
+		return nil, errors.Wrap(err, "cannot generate hash key")
+	}
+	if sm.ms == nil {
+		ms, err := NewDirMetadataStore(path.Clean(m.Root())+".metadata", DirMetadataFilesystem(sm.fs))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create metadata store")
+		}
+		sm.ms = ms
+	}
+	if err := sm.buildIndex(); err != nil {
+		return nil, errors.Wrap(err, "cannot index volumes")
+	}
 	return sm, nil
 }
 
-func (sm *manager) createFile(id, file string) (afero.File, error) {
-	p := path.Join(sm.m.Path(id), file)
+// buildIndex indexes the metadata of each volume under the Mounter's root,
+// migrating any legacy metadata files, and resumes renewing the secrets of
+// ready volumes. Volumes with missing or unreadable metadata, and ready volumes
+// that are no longer mounted, are indexed as broken.
+func (sm *manager) buildIndex() error {
+	if exists, err := sm.af.DirExists(sm.m.Root()); err != nil {
+		return errors.Wrap(err, "cannot test parent directory existence")
+	} else if !exists {
+		return nil
+	}
+
+	f, err := sm.fs.Open(sm.m.Root())
+	if err != nil {
+		return errors.Wrap(err, "cannot open parent directory for listing")
+	}
+	defer f.Close()
+
+	dirs, err := f.Readdirnames(0)
+	if err != nil {
+		return errors.Wrap(err, "cannot list volumes in parent directory")
+	}
+
+	for _, id := range dirs {
+		v, err := sm.readMetadata(id)
+		if _, ok := errors.Cause(err).(ErrNonExist); ok {
+			// Legacy metadata files are only migrated at startup; a volume
+			// with no stored metadata at any later point is simply broken.
+			v, err = sm.migrateMetadata(id)
+		}
+		if err != nil {
+			// TODO(negz): Metric-i-fy this.
+			log.Warn("broken volume", zap.String("id", id), zap.Error(err))
+			v = broken(id, errors.Wrap(err, "cannot read metadata"))
+		}
+		switch v.Status {
+		case api.VolumePending:
+			// We were stopped while creating this volume.
+			log.Warn("interrupted volume creation", zap.String("id", id))
+			sm.fail(context.Background(), v, errors.New("volume creation was interrupted"))
+			continue
+		case api.VolumeDestroying:
+			// We were stopped while waiting to clean up this volume.
+			sm.idx.add(v)
+			sm.scheduleCleanup(v)
+			continue
+		}
+		if ready(v) {
+			if err := sm.checkMounted(id); err != nil {
+				log.Warn("broken volume", zap.String("id", id), zap.Error(err))
+				v.Status, v.Error = api.VolumeBroken, err.Error()
+			}
+		}
+		sm.idx.add(v)
+		if ready(v) {
+			sm.resumeRenewal(v)
+		}
+	}
+	log.Debug("indexed volumes", zap.Int("volumes", len(dirs)))
+	return nil
+}
+
+// checkMounted returns an error if the supplied volume is not mounted, for
+// example because the host restarted since it was created, leaving an empty
+// directory at its path.
+func (sm *manager) checkMounted(id string) error {
+	mounted, err := sm.m.Mounted(id)
+	if err != nil {
+		return errors.Wrap(err, "cannot determine whether volume is mounted")
+	}
+	if !mounted {
+		return errors.New("volume is not mounted")
+	}
+	return nil
+}
+
+// modes returns the effective modes of the supplied volume.
+func (sm *manager) modes(v *api.Volume) api.Modes {
+	if v.Modes != nil {
+		return *v.Modes
+	}
+	return api.Modes{Mountpoint: api.FileMode(sm.mmode), Dir: api.FileMode(sm.dmode), File: api.FileMode(sm.fmode)}
+}
+
+// createFile creates the named file beneath the supplied root, which is
+// usually the root of the supplied volume.
+func (sm *manager) createFile(v *api.Volume, root, file string) (afero.File, error) {
+	md := sm.modes(v)
+	p := path.Join(root, file)
 	d := path.Dir(p)
 	// Talos serves tarballs without directories.
 	if exists, err := sm.af.DirExists(d); err != nil {
 		return nil, errors.Wrap(err, "cannot test directory existence while creating file")
 	} else if !exists {
 		log.Debug("creating directory", zap.String("path", d), zap.String("type", "implicit"))
-		if err := sm.af.MkdirAll(d, sm.dmode); err != nil {
+		if err := sm.af.MkdirAll(d, os.FileMode(md.Dir)); err != nil {
 			return nil, errors.Wrap(err, "cannot create parent directories while creating file")
 		}
 	}
 	log.Debug("creating file", zap.String("path", p))
 	m := os.O_CREATE | os.O_EXCL | os.O_WRONLY
-	f, err := sm.fs.OpenFile(p, m, sm.fmode)
+	f, err := sm.fs.OpenFile(p, m, os.FileMode(md.File))
 	return f, errors.Wrap(err, "cannot open file for creation")
 }
 
-func (sm *manager) writeSecrets(v *api.Volume, s api.Secrets) error {
+func (sm *manager) writeSecrets(ctx context.Context, v *api.Volume, root string, s api.Secrets, q *quota) error {
 	for {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "cannot iterate to next secret file")
+		}
 		h, err := s.Next()
 		if err == io.EOF {
 			return nil
@@ -155,19 +626,22 @@ func (sm *manager) writeSecrets(v *api.Volume, s api.Secrets) error {
 		if err != nil {
 			return errors.Wrap(err, "cannot iterate to next secret file")
 		}
+		if n, ok := sm.reservedName(h.Path); ok {
+			return errors.Errorf("secret %v conflicts with reserved name %v", h.Path, n)
+		}
 
 		if h.FileInfo.IsDir() {
-			d := path.Join(sm.m.Path(v.ID), h.Path)
+			d := path.Join(root, h.Path)
 			log.Debug("creating directory", zap.String("path", d), zap.String("type", "explicit"))
-			if err := sm.fs.MkdirAll(d, sm.dmode); err != nil {
+			if err := sm.fs.MkdirAll(d, os.FileMode(sm.modes(v).Dir)); err != nil {
 				return errors.Wrap(err, "cannot create secret directory")
 			}
 		} else {
-			f, err := sm.createFile(v.ID, h.Path)
+			f, err := sm.createFile(v, root, h.Path)
 			if err != nil {
 				return errors.Wrap(err, "cannot create secret file")
 			}
-			if _, err := io.Copy(f, s); err != nil {
+			if _, err := io.Copy(q.writer(f), ctxReader{ctx, s}); err != nil {
 				f.Close()
 				return errors.Wrapf(err, "cannot copy secret to file %v", f.Name())
 			}
@@ -178,12 +652,203 @@ func (sm *manager) writeSecrets(v *api.Volume, s api.Secrets) error {
 	}
 }
 
-func (sm *manager) writeJSONSecrets(v *api.Volume, s api.Secrets) error {
+// reservedName returns the name at the root of a volume that the supplied
+// secret path would be written to or beneath, and true if the Manager reserves
+// that name for its own files.
+func (sm *manager) reservedName(p string) (string, bool) {
+	n := strings.SplitN(strings.TrimPrefix(path.Clean(p), "/"), "/", 2)[0]
+	if n == "" {
+		return "", false
+	}
+	return n, reserved(n) || n == sm.versionFile || n == sm.jsonSecrets
+}
+
+// A ctxReader stops reading once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// replace calls fn, which removes or replaces the supplied file. The former
+// contents of the file are wiped if the Mounter is a Wiper.
+func (sm *manager) replace(p string, fn func() error) error {
+	w, ok := sm.m.(Wiper)
+	if !ok {
+		return fn()
+	}
+	return w.Wipe(p, fn)
+}
+
+// removeAll removes the supplied path and any children. The contents of any
+// files are wiped first if the Mounter is a Wiper.
+func (sm *manager) removeAll(p string) error {
+	if _, ok := sm.m.(Wiper); !ok {
+		return sm.fs.RemoveAll(p)
+	}
+	err := sm.af.Walk(p, func(fp string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return sm.replace(fp, func() error { return nil })
+	})
+	if err != nil {
+		return errors.Wrapf(err, "cannot wipe %v", p)
+	}
+	return sm.fs.RemoveAll(p)
+}
+
+// writable remounts a volume read-write while fn runs, then remounts it
+// read-only again regardless of whether fn succeeded.
+func (sm *manager) writable(id string, fn func() error) error {
+	if err := sm.m.Writable(id); err != nil {
+		return errors.Wrap(err, "cannot remount volume read-write")
+	}
+	err := fn()
+	if rerr := sm.m.ReadOnly(id); rerr != nil {
+		log.Error("cannot remount volume read-only", zap.String("id", id), zap.Error(rerr))
+		if err == nil {
+			err = errors.Wrap(rerr, "cannot remount volume read-only")
+		}
+	}
+	return err
+}
+
+// A renewal is the scheduled renewal of a volume's secrets.
+type renewal struct {
+	t *time.Timer
+	r secrets.Renewable
+}
+
+// scheduleRenewal arranges for the supplied secrets to be renewed before they
+// expire, if they are secrets.Renewable. Any renewal already scheduled for the
+// volume is cancelled.
+func (sm *manager) scheduleRenewal(id string, s api.Secrets) {
+	r, _ := s.(secrets.Renewable)
+	sm.schedule(id, r)
+}
+
+// resumeRenewal arranges for the secrets of the supplied volume, which were
+// written before the Manager was created, to be renewed before they expire if
+// their producer is a secrets.Resumer.
+func (sm *manager) resumeRenewal(v *api.Volume) {
+	sp, ok := sm.producerFor[v.Source].(secrets.Resumer)
+	if !ok {
+		return
+	}
+	r, err := sp.Resume(v, sm.fs, sm.m.Path(v.ID))
+	if err != nil {
+		log.Warn("cannot resume renewal of volume secrets", zap.String("id", v.ID), zap.Error(err))
+		return
+	}
+	sm.schedule(v.ID, r)
+}
+
+// schedule arranges for the supplied secrets to be renewed at the time they
+// request. Any renewal already scheduled for the volume is cancelled. Passing
+// nil secrets only cancels the scheduled renewal.
+func (sm *manager) schedule(id string, r secrets.Renewable) {
+	sm.rmx.Lock()
+	defer sm.rmx.Unlock()
+	if rn, ok := sm.renewals[id]; ok {
+		rn.t.Stop()
+		delete(sm.renewals, id)
+	}
+	if r == nil {
+		return
+	}
+	d := r.RenewAt().Sub(time.Now())
+	log.Debug("scheduling renewal", zap.String("id", id), zap.Duration("in", d))
+	rn := &renewal{r: r}
+	rn.t = time.AfterFunc(d, func() { sm.renew(id, rn) })
+	sm.renewals[id] = rn
+}
+
+func (sm *manager) cancelRenewal(id string) {
+	sm.rmx.Lock()
+	defer sm.rmx.Unlock()
+	if rn, ok := sm.renewals[id]; ok {
+		rn.t.Stop()
+		delete(sm.renewals, id)
+	}
+}
+
+// scheduled returns true if the supplied renewal is still scheduled, i.e. the
+// volume has not been destroyed or updated since it was scheduled.
+func (sm *manager) scheduled(id string, rn *renewal) bool {
+	sm.rmx.Lock()
+	defer sm.rmx.Unlock()
+	return sm.renewals[id] == rn
+}
+
+func (sm *manager) retryRenewal(id string, rn *renewal) {
+	sm.rmx.Lock()
+	defer sm.rmx.Unlock()
+	if sm.renewals[id] != rn {
+		// The volume was destroyed or updated while we were renewing it.
+		return
+	}
+	rn.t = time.AfterFunc(sm.retry, func() { sm.renew(id, rn) })
+}
+
+func (sm *manager) renew(id string, rn *renewal) {
+	log.Debug("renewing volume", zap.String("id", id))
+	s, err := rn.r.Renew()
+	if err != nil {
+		log.Error("cannot renew volume secrets", zap.String("id", id), zap.Error(err))
+		sm.retryRenewal(id, rn)
+		return
+	}
+	defer s.Close()
+	if !sm.locks.tryLock(id) {
+		// The volume is being updated or destroyed.
+		sm.retryRenewal(id, rn)
+		return
+	}
+	defer sm.locks.unlock(id)
+	if !sm.scheduled(id, rn) {
+		return
+	}
+	v, ok := sm.idx.get(id)
+	if !ok {
+		return
+	}
+	var rf *api.Refresh
+	err = sm.writable(id, func() error {
+		var err error
+		rf, err = sm.update(context.Background(), v, s, nil)
+		return err
+	})
+	if err != nil {
+		log.Error("cannot write renewed volume secrets", zap.String("id", id), zap.Error(err))
+		sm.retryRenewal(id, rn)
+		return
+	}
+	log.Info("renewed volume", zap.String("id", id), zap.String("path", sm.m.Path(id)), zap.Int("version", rf.Version))
+	sm.scheduleRenewal(id, s)
+	if changed(rf) {
+		sm.notify(v)
+	}
+}
+
+func (sm *manager) writeJSONSecrets(v *api.Volume, root string, s api.Secrets, q *quota) error {
 	if sm.jsonSecrets == "" {
 		return nil
 	}
 
-	f, err := sm.createFile(v.ID, sm.jsonSecrets)
+	f, err := sm.createFile(v, root, sm.jsonSecrets)
 	if err != nil {
 		return errors.Wrap(err, "cannot create JSON secrets file")
 	}
@@ -191,127 +856,568 @@ func (sm *manager) writeJSONSecrets(v *api.Volume, s api.Secrets) error {
 
 	// TODO(negz): Add an api.JSONable interface, write secrets if the passed
 	// secrets object fulfils that interface?
-	return errors.Wrap(secrets.WriteJSON(s, f), "cannot convert to JSON secrets")
+	return errors.Wrap(secrets.WriteJSON(s, q.writer(f)), "cannot convert to JSON secrets")
 }
 
-func (sm *manager) writeMetadata(v *api.Volume) error {
-	f, err := sm.createFile(v.ID, sm.meta)
-	if err != nil {
-		return errors.Wrap(err, "cannot create metadata file")
+func (sm *manager) permitOwner(o *api.Owner) error {
+	if o == nil {
+		return nil
 	}
-	defer f.Close()
-	return errors.Wrap(v.WriteJSON(f), "cannot write to metadata file")
+	for _, id := range []int{o.UID, o.GID} {
+		if id < sm.minOwner || id > sm.maxOwner {
+			return ErrForbidden(fmt.Sprintf("owner %v is not permitted", id))
+		}
+	}
+	return nil
+}
+
+// resolve sets the effective size and modes of the supplied volume, ensuring
+// any size and modes it requested are permitted. Modes the volume did not
+// request are set to their defaults.
+func (sm *manager) resolve(v *api.Volume) error {
+	if v.SizeMB == 0 {
+		v.SizeMB = sm.sizeMB
+	}
+	if v.SizeMB > sm.maxSizeMB {
+		return ErrForbidden(fmt.Sprintf("size %vMB exceeds maximum of %vMB", v.SizeMB, sm.maxSizeMB))
+	}
+
+	def := sm.modes(&api.Volume{})
+	max := def
+	if sm.maxModes != nil {
+		max = *sm.maxModes
+	}
+	md := def
+	if v.Modes != nil {
+		md = *v.Modes
+	}
+	if err := resolveMode("mountpoint", &md.Mountpoint, def.Mountpoint, max.Mountpoint); err != nil {
+		return err
+	}
+	if err := resolveMode("directory", &md.Dir, def.Dir, max.Dir); err != nil {
+		return err
+	}
+	if err := resolveMode("file", &md.File, def.File, max.File); err != nil {
+		return err
+	}
+	v.Modes = &md
+	return nil
 }
 
-func (sm *manager) Create(v *api.Volume) error {
+// permitDefaultModes ensures the default modes do not exceed the maximum modes,
+// which would cause every volume that did not request its own modes to be
+// forbidden.
+func (sm *manager) permitDefaultModes() error {
+	if sm.maxModes == nil {
+		return nil
+	}
+	def := sm.modes(&api.Volume{})
+	for _, m := range []struct {
+		name     string
+		def, max api.FileMode
+	}{
+		{"mountpoint", def.Mountpoint, sm.maxModes.Mountpoint},
+		{"directory", def.Dir, sm.maxModes.Dir},
+		{"file", def.File, sm.maxModes.File},
+	} {
+		if m.def&^m.max != 0 {
+			return errors.Errorf("default %v mode %#o exceeds maximum of %#o", m.name, m.def, m.max)
+		}
+	}
+	return nil
+}
+
+func resolveMode(name string, m *api.FileMode, def, max api.FileMode) error {
+	if *m == 0 {
+		*m = def
+	}
+	if *m&^max != 0 {
+		return ErrForbidden(fmt.Sprintf("%v mode %#o exceeds maximum of %#o", name, *m, max))
+	}
+	return nil
+}
+
+// chownAll changes the ownership of the supplied path and everything beneath
+// it to the supplied owner, if any.
+func (sm *manager) chownAll(p string, o *api.Owner) error {
+	if o == nil {
+		return nil
+	}
+	return afero.Walk(sm.fs, p, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		log.Debug("changing ownership", zap.String("path", p), zap.Int("uid", o.UID), zap.Int("gid", o.GID))
+		return errors.Wrapf(chown(sm.fs, p, o.UID, o.GID), "cannot change ownership of %v", p)
+	})
+}
+
+func (sm *manager) Create(ctx context.Context, v *api.Volume) error {
 	log.Debug("creating volume", zap.String("id", v.ID))
+	sp, err := sm.prepare(ctx, v)
+	if err != nil || sp == nil {
+		return err
+	}
+	defer sm.locks.unlock(v.ID)
+	defer sm.release(v.ID)
+	return sm.produce(ctx, sp, v)
+}
+
+// CreateAsync creates volumes in the background, so the supplied context only
+// applies to validating the request. Background creation is bounded by the
+// CreateTimeout, and cancelled if the volume is forcibly destroyed.
+func (sm *manager) CreateAsync(ctx context.Context, v *api.Volume) error {
+	log.Debug("creating volume asynchronously", zap.String("id", v.ID))
+	sp, err := sm.prepare(ctx, v)
+	if err != nil || sp == nil {
+		return err
+	}
+	if err := sm.pend(v); err != nil {
+		sm.release(v.ID)
+		sm.locks.unlock(v.ID)
+		return err
+	}
+	cv := *v
+	pctx, cancel := context.WithTimeout(context.Background(), sm.timeout)
+	sm.pmx.Lock()
+	sm.pending[cv.ID] = cancel
+	sm.pmx.Unlock()
+	go func() {
+		defer sm.locks.unlock(cv.ID)
+		defer sm.release(cv.ID)
+		defer sm.cancelCreation(cv.ID)
+		if err := sm.produce(pctx, sp, &cv); err != nil {
+			log.Error("cannot create volume", zap.String("id", cv.ID), zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// cancelCreation cancels the background creation of the supplied volume. It
+// returns false if the volume is not being created in the background.
+func (sm *manager) cancelCreation(id string) bool {
+	sm.pmx.Lock()
+	defer sm.pmx.Unlock()
+	cancel, ok := sm.pending[id]
+	if !ok {
+		return false
+	}
+	cancel()
+	delete(sm.pending, id)
+	return true
+}
+
+// validID returns an error unless the supplied volume ID may be used as a
+// single path component beneath the Mounter's root.
+func validID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.Contains(id, "/") {
+		return ErrInvalid(fmt.Sprintf("invalid volume ID %q", id))
+	}
+	return nil
+}
+
+// prepare validates a request to create the supplied volume, then locks it and
+// reserves its capacity. It returns the producer of the volume's secrets, or a
+// nil producer if an identical volume exists, in which case the existing
+// volume's metadata is set on the supplied volume and nothing is locked or
+// reserved.
+func (sm *manager) prepare(ctx context.Context, v *api.Volume) (secrets.Producer, error) {
+	if err := validID(v.ID); err != nil {
+		return nil, err
+	}
+	if err := sm.permitOwner(v.Owner); err != nil {
+		return nil, errors.Wrap(err, "cannot set volume owner")
+	}
+	if err := sm.permitNotify(v.Notify, v.Owner); err != nil {
+		return nil, errors.Wrap(err, "cannot set volume notification target")
+	}
+	if err := sm.resolve(v); err != nil {
+		return nil, errors.Wrap(err, "cannot determine volume size and modes")
+	}
+	ok, err := sm.locks.lock(ctx, v.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot lock volume")
+	}
+	if !ok {
+		// Pending volumes remain locked until they are ready or have failed.
+		if e, ok := sm.idx.get(v.ID); ok && e.Status == api.VolumePending && sm.specDiff(e, v) == "" {
+			*v = *e
+			return nil, nil
+		}
+		return nil, ErrConflict("volume is being created or destroyed")
+	}
 
 	if exists, err := sm.af.Exists(sm.m.Path(v.ID)); err != nil {
-		return errors.Wrap(err, "cannot test volume path existence")
+		sm.locks.unlock(v.ID)
+		return nil, errors.Wrap(err, "cannot test volume path existence")
 	} else if exists {
-		return ErrExists("volume exists")
+		sm.locks.unlock(v.ID)
+		return nil, sm.recreate(v)
 	}
 	sp, exists := sm.producerFor[v.Source]
 	if !exists {
-		return errors.New("no producer for secret type")
+		sm.locks.unlock(v.ID)
+		return nil, errors.New("no producer for secret type")
+	}
+	if err := sm.reserve(v); err != nil {
+		sm.locks.unlock(v.ID)
+		return nil, errors.Wrap(err, "cannot reserve volume capacity")
+	}
+	return sp, nil
+}
+
+// pend records that the supplied volume is pending creation.
+func (sm *manager) pend(v *api.Volume) error {
+	v.Status = api.VolumePending
+	if err := sm.fs.MkdirAll(sm.m.Path(v.ID), os.FileMode(v.Modes.Mountpoint)); err != nil {
+		return errors.Wrap(err, "cannot create volume path")
+	}
+	if err := sm.ms.Put(v); err != nil {
+		return sm.fail(context.Background(), v, errors.Wrap(err, "cannot write metadata"))
 	}
-	s, err := sp.For(v)
+	sm.idx.add(v)
+	return nil
+}
+
+// produce produces and writes the secrets of the supplied volume, which must
+// be locked and reserved.
+func (sm *manager) produce(ctx context.Context, sp secrets.Producer, v *api.Volume) error {
+	s, err := sp.For(ctx, v)
 	if err != nil {
-		return errors.Wrap(err, "cannot produce secret")
+		return sm.fail(ctx, v, errors.Wrap(err, "cannot produce secret"))
 	}
 	defer s.Close()
-	if err := sm.fs.MkdirAll(sm.m.Path(v.ID), sm.dmode); err != nil {
-		return errors.Wrap(err, "cannot create volume path")
+	if err := sm.retain(v); err != nil {
+		return sm.fail(ctx, v, errors.Wrap(err, "cannot retain credentials"))
+	}
+	if err := sm.fs.MkdirAll(sm.m.Path(v.ID), os.FileMode(v.Modes.Mountpoint)); err != nil {
+		return sm.fail(ctx, v, errors.Wrap(err, "cannot create volume path"))
+	}
+	v.Status = api.VolumeReady
+	if err := sm.populate(ctx, v, s); err != nil {
+		return sm.fail(ctx, v, err)
+	}
+	sm.idx.add(v)
+	sm.scheduleRenewal(v.ID, s)
+	log.Info("created volume", zap.String("id", v.ID), zap.String("path", sm.m.Path(v.ID)))
+	return nil
+}
+
+// fail records that creation of the supplied volume failed due to the supplied
+// error, which it returns. Failed volumes whose path exists occupy their ID,
+// and must be destroyed. Volumes whose creation was cancelled are rolled back
+// rather than failed, if possible.
+func (sm *manager) fail(ctx context.Context, v *api.Volume, err error) error {
+	sm.forget(v.ID)
+	if exists, _ := sm.af.Exists(sm.m.Path(v.ID)); !exists {
+		sm.idx.remove(v.ID)
+		return err
+	}
+	if ctx.Err() != nil {
+		rerr := sm.rollback(v.ID)
+		if rerr == nil {
+			log.Info("rolled back volume creation", zap.String("id", v.ID), zap.Error(err))
+			return err
+		}
+		log.Error("cannot roll back volume creation", zap.String("id", v.ID), zap.Error(rerr))
+	}
+	v.Status, v.Error = api.VolumeFailed, err.Error()
+	if perr := sm.ms.Put(v); perr != nil {
+		log.Error("cannot write metadata", zap.String("id", v.ID), zap.Error(perr))
+	}
+	sm.idx.add(v)
+	return err
+}
+
+// rollback unmounts and removes a volume whose creation was cancelled.
+func (sm *manager) rollback(id string) error {
+	mounted, err := sm.m.Mounted(id)
+	if err != nil {
+		return errors.Wrap(err, "cannot determine whether volume is mounted")
+	}
+	if mounted {
+		if err := sm.m.Unmount(id); err != nil {
+			return errors.Wrap(err, "cannot unmount volume")
+		}
+	}
+	if err := sm.fs.RemoveAll(sm.m.Path(id)); err != nil {
+		return errors.Wrap(err, "cannot remove volume path")
+	}
+	if err := sm.ms.Delete(id); err != nil {
+		return errors.Wrap(err, "cannot delete metadata")
+	}
+	sm.idx.remove(id)
+	return nil
+}
+
+// recreate handles requests to create a volume whose path exists. It succeeds
+// if the existing volume is ready and has the same spec.
+func (sm *manager) recreate(v *api.Volume) error {
+	e, ok := sm.idx.get(v.ID)
+	if !ok || sm.cleaning(v.ID) {
+		return ErrExists("conflicting volume path exists")
+	}
+	if !ready(e) {
+		return ErrExists(fmt.Sprintf("volume exists and is %v: %v", e.Status, e.Error))
+	}
+	if d := sm.specDiff(e, v); d != "" {
+		return ErrExists(fmt.Sprintf("volume exists with a different spec: %v", d))
+	}
+	log.Debug("volume exists with the same spec", zap.String("id", v.ID))
+	*v = *e
+	return nil
+}
+
+// ready returns true if the supplied volume is ready. Volumes created before
+// states were recorded have no status, and are ready.
+func ready(v *api.Volume) bool {
+	return v.Status == api.VolumeReady || v.Status == ""
+}
+
+// specDiff describes how the spec of the supplied existing volume differs from
+// that of the supplied resolved volume. It returns an empty string if they do
+// not. Existing volumes created before sizes and modes were recorded have the
+// default size and modes.
+func (sm *manager) specDiff(have, want *api.Volume) string {
+	d := []string{}
+	if have.Source != want.Source {
+		d = append(d, fmt.Sprintf("Source: have %v, want %v", have.Source, want.Source))
+	}
+	if (len(have.Tags) > 0 || len(want.Tags) > 0) && !reflect.DeepEqual(have.Tags, want.Tags) {
+		d = append(d, fmt.Sprintf("Tags: have %v, want %v", have.Tags, want.Tags))
+	}
+	if !reflect.DeepEqual(have.Owner, want.Owner) {
+		d = append(d, fmt.Sprintf("Owner: have %+v, want %+v", have.Owner, want.Owner))
+	}
+	if sm.allocated(have) != sm.allocated(want) {
+		d = append(d, fmt.Sprintf("SizeMB: have %v, want %v", sm.allocated(have)>>20, sm.allocated(want)>>20))
 	}
+	if hm, wm := sm.modes(have), sm.modes(want); hm != wm {
+		d = append(d, fmt.Sprintf("Modes: have %#o/%#o/%#o, want %#o/%#o/%#o",
+			hm.Mountpoint, hm.Dir, hm.File, wm.Mountpoint, wm.Dir, wm.File))
+	}
+	if !reflect.DeepEqual(have.Notify, want.Notify) {
+		d = append(d, fmt.Sprintf("Notify: have %+v, want %+v", have.Notify, want.Notify))
+	}
+	return strings.Join(d, "; ")
+}
+
+// populate mounts the supplied volume at its existing path, writes its secrets
+// and metadata, then remounts it read-only. Secrets are written to a directory
+// linked to by the volume's data link if the filesystem supports symbolic
+// links, so that they may later be replaced all at once.
+func (sm *manager) populate(ctx context.Context, v *api.Volume, s api.Secrets) error {
 	if err := sm.m.Mount(v); err != nil {
 		return errors.Wrap(err, "cannot mount volume")
 	}
-	if err := sm.writeSecrets(v, s); err != nil {
+	root := sm.m.Path(v.ID)
+	dir := root
+	if _, ok := links(sm.fs); ok {
+		var err error
+		if dir, err = sm.stage(v); err != nil {
+			return err
+		}
+	}
+	q := sm.newQuota(v)
+	if err := sm.writeSecrets(ctx, v, dir, s, q); err != nil {
 		return errors.Wrap(err, "cannot write secrets")
 	}
-	if err := sm.writeJSONSecrets(v, s); err != nil {
+	if err := sm.writeJSONSecrets(v, dir, s, q); err != nil {
 		return errors.Wrap(err, "cannot write JSON secrets")
 	}
-	if err := sm.writeMetadata(v); err != nil {
+	if err := sm.ms.Put(v); err != nil {
 		return errors.Wrap(err, "cannot write metadata")
 	}
-	log.Info("created volume", zap.String("id", v.ID), zap.String("path", sm.m.Path(v.ID)))
-	return nil
+	if err := sm.chownAll(root, v.Owner); err != nil {
+		return errors.Wrap(err, "cannot change volume ownership")
+	}
+	if dir != root {
+		if err := sm.activate(v, dir); err != nil {
+			return errors.Wrap(err, "cannot link secrets")
+		}
+	}
+	return errors.Wrap(sm.m.ReadOnly(v.ID), "cannot remount volume read-only")
 }
 
-func (sm *manager) Destroy(id string) error {
+// broken returns a broken volume with the supplied ID, broken due to the
+// supplied error.
+func broken(id string, err error) *api.Volume {
+	return &api.Volume{ID: id, Status: api.VolumeBroken, Error: err.Error()}
+}
+
+func (sm *manager) Destroy(ctx context.Context, id string) error {
 	log.Debug("destroying volume", zap.String("id", id))
+	if ok, err := sm.locks.lock(ctx, id); err != nil {
+		return errors.Wrap(err, "cannot lock volume")
+	} else if !ok {
+		return ErrConflict("volume is being created or destroyed")
+	}
+	defer sm.locks.unlock(id)
 
 	if exists, err := sm.af.DirExists(sm.m.Path(id)); err != nil {
 		return errors.Wrap(err, "cannot test volume path existence")
-	} else if !exists {
+	} else if !exists || sm.cleaning(id) {
 		return ErrNonExist("volume not found")
 	}
-	if err := sm.m.Unmount(id); err != nil {
-		return errors.Wrap(err, "cannot unmount volume")
+	sm.cancelRenewal(id)
+	sm.forget(id)
+	mounted, err := sm.m.Mounted(id)
+	if err != nil {
+		return errors.Wrap(err, "cannot determine whether volume is mounted")
+	}
+	if mounted {
+		err := sm.unmount(ctx, id, sm.retries)
+		if busy(err) && sm.deferred > 0 {
+			return errors.Wrap(sm.deferCleanup(id, err), "cannot defer cleanup")
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot unmount volume")
+		}
+	} else {
+		log.Warn("volume is not mounted", zap.String("id", id), zap.String("path", sm.m.Path(id)))
 	}
 	if err := sm.fs.RemoveAll(sm.m.Path(id)); err != nil {
 		return errors.Wrap(err, "cannot remove volume path")
 	}
+	if err := sm.ms.Delete(id); err != nil {
+		return errors.Wrap(err, "cannot delete metadata")
+	}
+	sm.idx.remove(id)
 
 	log.Info("destroyed volume", zap.String("id", id), zap.String("path", sm.m.Path(id)))
 	return nil
 }
 
 func (sm *manager) readMetadata(id string) (*api.Volume, error) {
-	f, err := sm.fs.Open(path.Join(sm.m.Path(id), sm.MetadataFile()))
+	v, err := sm.ms.Get(id)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot open metadata file")
+		return nil, errors.Wrap(err, "cannot get metadata")
+	}
+	log.Debug("read metadata", zap.String("id", v.ID))
+	return v, nil
+}
+
+// migrateMetadata moves metadata from the legacy metadata file at the root of
+// a volume to the MetadataStore.
+func (sm *manager) migrateMetadata(id string) (*api.Volume, error) {
+	p := path.Join(sm.m.Path(id), sm.meta)
+	f, err := sm.fs.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNonExist("metadata not found")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open legacy metadata file")
 	}
 	defer f.Close()
 
 	v, err := api.ReadVolumeJSON(f)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot read from metadata file")
+		return nil, errors.Wrap(err, "cannot read from legacy metadata file")
 	}
-
-	log.Debug("read metadata", zap.String("id", v.ID))
+	if err := sm.ms.Put(v); err != nil {
+		return nil, errors.Wrap(err, "cannot migrate legacy metadata")
+	}
+	err = sm.writable(id, func() error {
+		if err := sm.fs.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot remove legacy metadata file")
+	}
+	log.Info("migrated legacy metadata", zap.String("id", id), zap.String("path", p))
 	return v, nil
 }
 
 func (sm *manager) Get(id string) (*api.Volume, error) {
 	log.Debug("getting volume", zap.String("id", id))
 
-	if exists, err := sm.af.DirExists(sm.m.Path(id)); err != nil {
-		return nil, errors.Wrap(err, "cannot test volume path existence")
-	} else if !exists {
+	v, ok := sm.idx.get(id)
+	if !ok || sm.cleaning(id) {
 		return nil, ErrNonExist("volume not found")
 	}
-	return sm.readMetadata(id)
+	var err error
+	if v.Mounted, err = sm.mounted(id); err != nil {
+		return nil, err
+	}
+	if v.Status == api.VolumePending {
+		// The volume's files are still being written.
+		return v, nil
+	}
+	if v.Usage, err = sm.usage(v); err != nil {
+		return nil, errors.Wrap(err, "cannot determine volume usage")
+	}
+	return v, nil
 }
 
-func (sm *manager) List() (api.Volumes, error) {
-	log.Debug("listing volumes")
-
-	if exists, err := sm.af.DirExists(sm.m.Root()); err != nil {
-		return nil, errors.Wrap(err, "cannot test parent directory existence")
-	} else if !exists {
-		return nil, errors.New("parent directory does not exist")
+func (sm *manager) mounted(id string) (*bool, error) {
+	m, err := sm.m.Mounted(id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot determine whether volume %v is mounted", id)
 	}
+	return &m, nil
+}
 
-	f, err := sm.fs.Open(sm.m.Root())
+// usage returns the usage of the supplied volume. The bytes used by and size
+// of the volume are determined by the Mounter if it is a Statfser, and
+// otherwise from the volume's files and allocated size.
+func (sm *manager) usage(v *api.Volume) (*api.Usage, error) {
+	u, err := usage(sm.fs, sm.m.Path(v.ID))
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot open parent directory for listing")
+		return nil, err
 	}
-
-	dirs, err := f.Readdirnames(0)
+	u.SizeBytes = sm.allocated(v)
+	s, ok := sm.m.(Statfser)
+	if !ok {
+		return u, nil
+	}
+	used, size, err := s.Statfs(v.ID)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot list volumes in parent directory")
+		return nil, errors.Wrap(err, "cannot statfs volume")
+	}
+	// Filesystems that do not track usage, i.e. ramfs, report a size of zero.
+	if size > 0 {
+		u.UsedBytes, u.SizeBytes = used, size
 	}
+	return u, nil
+}
 
-	vols := make([]*api.Volume, 0, len(dirs))
-	for _, id := range dirs {
-		v, err := sm.readMetadata(id)
+// mountedAll returns a function that reports whether the supplied volume is
+// mounted. The Mounter is asked about all volumes at once if it is a
+// MountLister, and otherwise about each volume in turn.
+func (sm *manager) mountedAll() func(id string) (*bool, error) {
+	l, ok := sm.m.(MountLister)
+	if !ok {
+		return sm.mounted
+	}
+	ids, err := l.MountedIDs()
+	return func(id string) (*bool, error) {
 		if err != nil {
-			// TODO(negz): Metric-i-fy this.
-			log.Debug("unparseable volume", zap.Error(err))
+			return nil, errors.Wrap(err, "cannot determine which volumes are mounted")
+		}
+		m := ids[id]
+		return &m, nil
+	}
+}
+
+// List lists indexed volumes, omitting destroyed volumes that have not yet
+// been cleaned up. Volumes are only indexed once fully created, so the list
+// never includes a volume that is still being created. A volume's Mounted is
+// omitted if it cannot be determined.
+func (sm *manager) List() (api.Volumes, error) {
+	log.Debug("listing volumes")
+	all := sm.idx.list()
+	mounted := sm.mountedAll()
+	vols := make(api.Volumes, 0, len(all))
+	for _, v := range all {
+		if sm.cleaning(v.ID) {
 			continue
 		}
+		var err error
+		if v.Mounted, err = mounted(v.ID); err != nil {
+			log.Warn("cannot determine whether volume is mounted", zap.String("id", v.ID), zap.Error(err))
+		}
 		vols = append(vols, v)
 	}
 	return vols, nil
@@ -320,3 +1426,114 @@ func (sm *manager) List() (api.Volumes, error) {
 func (sm *manager) MetadataFile() string {
 	return sm.meta
 }
+
+// A chowner is a filesystem that supports changing file ownership.
+type chowner interface {
+	Chown(name string, uid, gid int) error
+}
+
+// chown changes the ownership of the named file, if the supplied filesystem
+// supports it. Ownership is silently ignored by filesystems that don't, for
+// example afero's MemMapFs.
+func chown(fs afero.Fs, name string, uid, gid int) error {
+	switch f := fs.(type) {
+	case chowner:
+		return f.Chown(name, uid, gid)
+	case *afero.OsFs:
+		return os.Chown(name, uid, gid)
+	default:
+		return nil
+	}
+}
+
+// A linker is a filesystem that supports symbolic links.
+type linker interface {
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+}
+
+type osLinker struct{}
+
+func (osLinker) Symlink(oldname, newname string) error { return os.Symlink(oldname, newname) }
+func (osLinker) Readlink(name string) (string, error)  { return os.Readlink(name) }
+
+// links returns a linker for the supplied filesystem, and false if it does not
+// support symbolic links, for example afero's MemMapFs.
+func links(fs afero.Fs) (linker, bool) {
+	switch f := fs.(type) {
+	case linker:
+		return f, true
+	case *afero.OsFs:
+		return osLinker{}, true
+	default:
+		return nil, false
+	}
+}
+
+// allocated returns the number of bytes allocated to the supplied volume.
+func (sm *manager) allocated(v *api.Volume) int64 {
+	if v.SizeMB == 0 {
+		// Volumes created before sizes were recorded have the default size.
+		return int64(sm.sizeMB) << 20
+	}
+	return int64(v.SizeMB) << 20
+}
+
+// reserve ensures the supplied volume fits within the memory budget, and holds
+// its allocation until it is released. Allocations are held while volumes are
+// created, before their metadata is written.
+func (sm *manager) reserve(v *api.Volume) error {
+	if sm.budget == 0 {
+		return nil
+	}
+	sm.bmx.Lock()
+	defer sm.bmx.Unlock()
+	c, err := sm.capacity(false)
+	if err != nil {
+		return errors.Wrap(err, "cannot determine capacity")
+	}
+	if c.AllocatedBytes+sm.allocated(v) > sm.budget {
+		return ErrInsufficientCapacity(fmt.Sprintf("%v bytes of %v byte budget are allocated", c.AllocatedBytes, sm.budget))
+	}
+	sm.reserved[v.ID] = sm.allocated(v)
+	return nil
+}
+
+func (sm *manager) release(id string) {
+	sm.bmx.Lock()
+	defer sm.bmx.Unlock()
+	delete(sm.reserved, id)
+}
+
+// capacity returns the memory allocated to all extant volumes, and optionally
+// the memory used by them. The caller must hold sm.bmx.
+func (sm *manager) capacity(used bool) (*api.Capacity, error) {
+	// Volumes that are yet to be cleaned up still consume memory.
+	vs := sm.idx.list()
+	c := &api.Capacity{BudgetBytes: sm.budget, Volumes: len(vs)}
+	for _, v := range vs {
+		// Volumes that are being created are counted via their reservation.
+		if _, ok := sm.reserved[v.ID]; !ok {
+			c.AllocatedBytes += sm.allocated(v)
+		}
+		if !used {
+			continue
+		}
+		u, err := usage(sm.fs, sm.m.Path(v.ID))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot determine usage of volume %v", v.ID)
+		}
+		c.UsedBytes += u.UsedBytes
+	}
+	for _, r := range sm.reserved {
+		c.AllocatedBytes += r
+	}
+	return c, nil
+}
+
+func (sm *manager) Capacity() (*api.Capacity, error) {
+	log.Debug("determining capacity")
+	sm.bmx.Lock()
+	defer sm.bmx.Unlock()
+	return sm.capacity(true)
+}
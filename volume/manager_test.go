@@ -1,12 +1,23 @@
 package volume
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
 	"path"
 	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/afero"
@@ -20,7 +31,7 @@ type boringProducer struct {
 	s api.Secrets
 }
 
-func (sp *boringProducer) For(v *api.Volume) (api.Secrets, error) {
+func (sp *boringProducer) For(_ context.Context, v *api.Volume) (api.Secrets, error) {
 	return sp.s, nil
 }
 
@@ -52,15 +63,15 @@ func TestManager(t *testing.T) {
 		vm, _ := NewManager(m, sp, Filesystem(fs), MetadataFile("someta"))
 
 		t.Run("DestroyBeforeCreated", func(t *testing.T) {
-			err := vm.Destroy(tt.v.ID)
+			err := vm.Destroy(context.Background(), tt.v.ID)
 			if _, ok := errors.Cause(err).(ErrNonExist); !ok {
-				t.Errorf("vm.Destroy(%v): %v", tt.v.ID, err)
+				t.Errorf("vm.Destroy(context.Background(), %v): %v", tt.v.ID, err)
 			}
 		})
 
 		t.Run("Create", func(t *testing.T) {
-			if err := vm.Create(tt.v); err != nil {
-				t.Errorf("vm.Create(%v): %v", tt.v, err)
+			if err := vm.Create(context.Background(), tt.v); err != nil {
+				t.Errorf("vm.Create(context.Background(), %v): %v", tt.v, err)
 			}
 			for {
 				h, err := s.Next()
@@ -104,9 +115,14 @@ func TestManager(t *testing.T) {
 		})
 
 		t.Run("CreateWhenExists", func(t *testing.T) {
-			err := vm.Create(tt.v)
-			if _, ok := errors.Cause(err).(ErrExists); !ok {
-				t.Errorf("vm.Create(%v): %v", tt.v, err)
+			if err := vm.Create(context.Background(), tt.v); err != nil {
+				t.Errorf("vm.Create(context.Background(), %v): want success recreating identical volume, got %v", tt.v, err)
+			}
+			d := *tt.v
+			d.Tags = map[string][]string{"tag": {"different"}}
+			err := vm.Create(context.Background(), &d)
+			if !isExists(err) || !strings.Contains(err.Error(), "Tags: have map[tag:[awesome]], want map[tag:[different]]") {
+				t.Errorf("vm.Create(context.Background(), %v): want ErrExists with diff, got %v", d, err)
 			}
 		})
 
@@ -119,6 +135,10 @@ func TestManager(t *testing.T) {
 				t.Errorf("len(%v): want 1, got %v", l, len(l))
 				return
 			}
+			if l[0].Mounted == nil || !*l[0].Mounted {
+				t.Errorf("vm.List()[0].Mounted: want true, got %v", l[0].Mounted)
+			}
+			l[0].Mounted = nil
 			if !reflect.DeepEqual(l[0], tt.v) {
 				t.Errorf("vm.Get(%v): Want %v, got %v", tt.v.ID, tt.v, l[0])
 			}
@@ -130,15 +150,2133 @@ func TestManager(t *testing.T) {
 				t.Errorf("vm.Get(%v): %v", tt.v.ID, err)
 				return
 			}
+			if v.Usage == nil || v.Usage.Files == 0 {
+				t.Errorf("vm.Get(%v).Usage: want usage, got %+v", tt.v.ID, v.Usage)
+			} else if v.Usage.SizeBytes != 100<<20 {
+				t.Errorf("vm.Get(%v).Usage.SizeBytes: want %v, got %v", tt.v.ID, 100<<20, v.Usage.SizeBytes)
+			}
+			if v.Mounted == nil || !*v.Mounted {
+				t.Errorf("vm.Get(%v).Mounted: want true, got %v", tt.v.ID, v.Mounted)
+			}
+			v.Usage, v.Mounted = nil, nil
 			if !reflect.DeepEqual(v, tt.v) {
 				t.Errorf("vm.Get(%v): Want %v, got %v", tt.v.ID, tt.v, v)
 			}
 		})
 
 		t.Run("Destroy", func(t *testing.T) {
-			if err := vm.Destroy(tt.v.ID); err != nil {
-				t.Errorf("vm.Destroy(%v): %v", tt.v.ID, err)
+			if err := vm.Destroy(context.Background(), tt.v.ID); err != nil {
+				t.Errorf("vm.Destroy(context.Background(), %v): %v", tt.v.ID, err)
+			}
+		})
+	}
+}
+
+type renewableSecrets struct {
+	api.Secrets
+	at      time.Time
+	renewed api.Secrets
+}
+
+func (s *renewableSecrets) RenewAt() time.Time {
+	return s.at
+}
+
+func (s *renewableSecrets) Renew() (api.Secrets, error) {
+	return s.renewed, nil
+}
+
+// A testEnv is an in-memory filesystem holding volumes mounted by a
+// NoopMounter at /noop, and their metadata at /metadata. Tests may wrap its
+// filesystem and Mounter before creating a Manager.
+type testEnv struct {
+	fs afero.Fs
+	m  Mounter
+	ms MetadataStore
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	fs := afero.NewMemMapFs()
+	m := NewNoopMounter("/noop")
+	if err := fs.MkdirAll(m.Root(), 0700); err != nil {
+		t.Fatalf("fs.MkdirAll(%v): %v", m.Root(), err)
+	}
+	ms, err := NewDirMetadataStore("/metadata", DirMetadataFilesystem(fs))
+	if err != nil {
+		t.Fatalf("NewDirMetadataStore(): %v", err)
+	}
+	return &testEnv{fs, m, ms}
+}
+
+// manager returns a Manager of the environment's volumes, failing the test if
+// it cannot be created. Creating another Manager simulates a restart.
+func (e *testEnv) manager(t *testing.T, sp secrets.Producers, mo ...ManagerOption) Manager {
+	vm, err := NewManager(e.m, sp, append([]ManagerOption{Filesystem(e.fs), Metadata(e.ms)}, mo...)...)
+	if err != nil {
+		t.Fatalf("NewManager(): %v", err)
+	}
+	return vm
+}
+
+func TestManagerRenewal(t *testing.T) {
+	e := newTestEnv(t)
+	fs, m := e.fs, e.m
+	v := fixtures.TestVolume
+
+	renewed := &renewableSecrets{
+		secrets.NewFiles(v, secrets.File{Path: "cert.pem", Data: []byte("new")}),
+		time.Now().Add(time.Hour),
+		nil,
+	}
+	s := &renewableSecrets{
+		secrets.NewFiles(v, secrets.File{Path: "cert.pem", Data: []byte("old")}),
+		time.Now().Add(50 * time.Millisecond),
+		renewed,
+	}
+	sp := secrets.Producers{api.TalosSecretSource: &boringProducer{s}}
+	vm := e.manager(t, sp)
+
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v, err)
+	}
+	defer vm.Destroy(context.Background(), v.ID)
+
+	af := &afero.Afero{Fs: fs}
+	p := path.Join(m.Path(v.ID), "cert.pem")
+	if b, err := af.ReadFile(p); err != nil || string(b) != "old" {
+		t.Fatalf("af.ReadFile(%v): want old, got %s (%v)", p, b, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, err := af.ReadFile(p); err == nil && string(b) == "new" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("af.ReadFile(%v): secrets were not renewed", p)
+}
+
+// A resumingProducer produces secrets that are not Renewable until they are
+// resumed.
+type resumingProducer struct {
+	renewed api.Secrets
+}
+
+func (sp *resumingProducer) For(_ context.Context, v *api.Volume) (api.Secrets, error) {
+	return secrets.NewFiles(v, secrets.File{Path: "cert.pem", Data: []byte("old")}), nil
+}
+
+func (sp *resumingProducer) Resume(v *api.Volume, fs afero.Fs, root string) (secrets.Renewable, error) {
+	if _, err := fs.Stat(path.Join(root, "cert.pem")); err != nil {
+		return nil, err
+	}
+	return &renewableSecrets{nil, time.Now(), sp.renewed}, nil
+}
+
+func TestManagerResumeRenewal(t *testing.T) {
+	e := newTestEnv(t)
+	v := fixtures.TestVolume
+
+	renewed := &renewableSecrets{
+		secrets.NewFiles(v, secrets.File{Path: "cert.pem", Data: []byte("new")}),
+		time.Now().Add(time.Hour),
+		nil,
+	}
+	sp := secrets.Producers{api.TalosSecretSource: &resumingProducer{renewed}}
+	vm := e.manager(t, sp)
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v, err)
+	}
+
+	// A new Manager, i.e. after a restart, resumes renewing the volume.
+	vm = e.manager(t, sp)
+	defer vm.Destroy(context.Background(), v.ID)
+
+	af := &afero.Afero{Fs: e.fs}
+	p := path.Join(e.m.Path(v.ID), "cert.pem")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, err := af.ReadFile(p); err == nil && string(b) == "new" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("af.ReadFile(%v): secrets were not renewed", p)
+}
+
+// A readOnlyMounter tracks which volumes are mounted read-only, and refuses
+// to create files in them via its Fs.
+type readOnlyMounter struct {
+	Mounter
+	mx sync.Mutex
+	ro map[string]bool
+}
+
+func (m *readOnlyMounter) ReadOnly(id string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.ro[id] = true
+	return nil
+}
+
+func (m *readOnlyMounter) Writable(id string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.ro[id] = false
+	return nil
+}
+
+func (m *readOnlyMounter) readOnly(id string) bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.ro[id]
+}
+
+func (m *readOnlyMounter) readOnlyPath(p string) bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for id, ro := range m.ro {
+		if ro && strings.HasPrefix(p, m.Path(id)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type readOnlyFs struct {
+	afero.Fs
+	m *readOnlyMounter
+}
+
+func (fs *readOnlyFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if fs.m.readOnlyPath(name) && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, errors.Errorf("%v is read-only", name)
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func TestManagerReadOnly(t *testing.T) {
+	e := newTestEnv(t)
+	m := &readOnlyMounter{Mounter: e.m, ro: make(map[string]bool)}
+	fs := &readOnlyFs{e.fs, m}
+	e.m, e.fs = m, fs
+	v := fixtures.TestVolume
+
+	renewed := &renewableSecrets{
+		secrets.NewFiles(v, secrets.File{Path: "cert.pem", Data: []byte("new")}),
+		time.Now().Add(time.Hour),
+		nil,
+	}
+	s := &renewableSecrets{
+		secrets.NewFiles(v, secrets.File{Path: "cert.pem", Data: []byte("old")}),
+		time.Now().Add(50 * time.Millisecond),
+		renewed,
+	}
+	sp := secrets.Producers{api.TalosSecretSource: &boringProducer{s}}
+	vm := e.manager(t, sp)
+
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v, err)
+	}
+	defer vm.Destroy(context.Background(), v.ID)
+
+	if !m.readOnly(v.ID) {
+		t.Errorf("m.readOnly(%v): want true after create, got false", v.ID)
+	}
+
+	af := &afero.Afero{Fs: fs}
+	p := path.Join(m.Path(v.ID), "cert.pem")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, err := af.ReadFile(p); err == nil && string(b) == "new" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b, _ := af.ReadFile(p); string(b) != "new" {
+		t.Errorf("af.ReadFile(%v): secrets were not renewed", p)
+	}
+	if !m.readOnly(v.ID) {
+		t.Errorf("m.readOnly(%v): want true after renewal, got false", v.ID)
+	}
+}
+
+type unboundedMounter struct {
+	Mounter
+}
+
+func (m *unboundedMounter) Unbounded() {}
+
+var quotaTests = []struct {
+	name string
+	mb   uint
+	data []byte
+	err  bool
+}{
+	{"WithinLimit", 1, []byte("small"), false},
+	{"ExceedsLimit", 1, make([]byte, 2<<20), true},
+}
+
+func TestManagerQuota(t *testing.T) {
+	for _, tt := range quotaTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.m = &unboundedMounter{e.m}
+			v := &api.Volume{ID: "quota", Source: api.TalosSecretSource}
+			s := secrets.NewFiles(v, secrets.File{Path: "secret", Data: tt.data})
+			sp := secrets.Producers{api.TalosSecretSource: &boringProducer{s}}
+			vm := e.manager(t, sp, VolumeSizeMB(tt.mb, tt.mb))
+
+			err := vm.Create(context.Background(), v)
+			if tt.err {
+				if _, ok := errors.Cause(err).(ErrTooLarge); !ok {
+					t.Errorf("vm.Create(context.Background(), %v): want ErrTooLarge, got %v", v.ID, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			}
+		})
+	}
+}
+
+func TestManagerDirMounter(t *testing.T) {
+	e := newTestEnv(t)
+	fs := e.fs
+	m, err := NewDirMounter("/dirs", DirFilesystem(fs))
+	if err != nil {
+		t.Fatalf("NewDirMounter(): %v", err)
+	}
+	e.m = m
+	v := &api.Volume{ID: "dirs", Source: api.TalosSecretSource, Modes: &api.Modes{File: 0400}}
+	sp := &mutableProducer{[]secrets.File{{Path: "secret", Data: []byte("supersecret")}, {Path: "old", Data: []byte("oldsecret")}}}
+	vm := e.manager(t, secrets.Producers{api.TalosSecretSource: sp}, MaxModes(api.Modes{Mountpoint: 0700, Dir: 0700, File: 0600}))
+
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+
+	// Files that are replaced or removed when a volume is refreshed are wiped.
+	p := path.Join(m.Path(v.ID), "secret")
+	old := path.Join(m.Path(v.ID), "old")
+	replaced, err := fs.Open(p)
+	if err != nil {
+		t.Fatalf("fs.Open(%v): %v", p, err)
+	}
+	defer replaced.Close()
+	removed, err := fs.Open(old)
+	if err != nil {
+		t.Fatalf("fs.Open(%v): %v", old, err)
+	}
+	defer removed.Close()
+	sp.files = []secrets.File{{Path: "secret", Data: []byte("newsecret")}}
+	if _, err := vm.Refresh(context.Background(), v.ID, api.KeyPair{}); err != nil {
+		t.Fatalf("vm.Refresh(context.Background(), %v): %v", v.ID, err)
+	}
+	for _, f := range []afero.File{replaced, removed} {
+		got, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Errorf("ioutil.ReadAll(%v): %v", f.Name(), err)
+			continue
+		}
+		if strings.Trim(string(got), "\x00") != "" {
+			t.Errorf("vm.Refresh(context.Background(), %v): want %v wiped, got %q", v.ID, f.Name(), got)
+		}
+	}
+	if got, _ := afero.ReadFile(fs, p); string(got) != "newsecret" {
+		t.Errorf("vm.Refresh(context.Background(), %v): want %v to contain %q, got %q", v.ID, p, "newsecret", got)
+	}
+
+	if err := m.Unmount(v.ID); err != nil {
+		t.Fatalf("m.Unmount(%v): %v", v.ID, err)
+	}
+	got, err := afero.ReadFile(fs, p)
+	if err != nil {
+		t.Fatalf("afero.ReadFile(%v): %v", p, err)
+	}
+	want := make([]byte, len("newsecret"))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("m.Unmount(%v): want %v to contain %v, got %v", v.ID, p, want, got)
+	}
+	if err := vm.Destroy(context.Background(), v.ID); err != nil {
+		t.Errorf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+	}
+	if exists, _ := afero.Exists(fs, m.Path(v.ID)); exists {
+		t.Errorf("vm.Destroy(context.Background(), %v): %v still exists", v.ID, m.Path(v.ID))
+	}
+}
+
+type chownFs struct {
+	afero.Fs
+	mx     sync.Mutex
+	owners map[string]api.Owner
+}
+
+func (fs *chownFs) Chown(name string, uid, gid int) error {
+	fs.mx.Lock()
+	defer fs.mx.Unlock()
+	fs.owners[name] = api.Owner{UID: uid, GID: gid}
+	return nil
+}
+
+var ownerTests = []struct {
+	name  string
+	owner *api.Owner
+	err   bool
+}{
+	{"NoOwner", nil, false},
+	{"Permitted", &api.Owner{UID: 1000, GID: 1001}, false},
+	{"UIDForbidden", &api.Owner{UID: 0, GID: 1000}, true},
+	{"GIDForbidden", &api.Owner{UID: 1000, GID: 2001}, true},
+}
+
+func TestManagerOwner(t *testing.T) {
+	for _, tt := range ownerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			fs := &chownFs{Fs: e.fs, owners: make(map[string]api.Owner)}
+			e.fs = fs
+			m := e.m
+			v := &api.Volume{ID: "owned", Source: api.TalosSecretSource, Owner: tt.owner}
+			s := secrets.NewFiles(v, secrets.File{Path: "dir/secret", Data: []byte("secret")})
+			sp := secrets.Producers{api.TalosSecretSource: &boringProducer{s}}
+			vm := e.manager(t, sp, OwnerRange(1000, 2000))
+
+			err := vm.Create(context.Background(), v)
+			if tt.err {
+				if _, ok := errors.Cause(err).(ErrForbidden); !ok {
+					t.Errorf("vm.Create(context.Background(), %v): want ErrForbidden, got %v", v.ID, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			}
+
+			for _, p := range []string{"", "dir", "dir/secret"} {
+				p = path.Join(m.Path(v.ID), p)
+				got, ok := fs.owners[p]
+				if tt.owner == nil {
+					if ok {
+						t.Errorf("vm.Create(context.Background(), %v): want %v unchanged, got owner %+v", v.ID, p, got)
+					}
+					continue
+				}
+				if got != *tt.owner {
+					t.Errorf("vm.Create(context.Background(), %v): want %v owned by %+v, got %+v", v.ID, p, *tt.owner, got)
+				}
+			}
+		})
+	}
+}
+
+var invalidIDTests = []struct {
+	name string
+	id   string
+}{
+	{"Empty", ""},
+	{"Dot", "."},
+	{"DotDot", ".."},
+	{"Escape", "../escape"},
+	{"Nested", "nested/id"},
+}
+
+func TestManagerInvalidID(t *testing.T) {
+	for _, tt := range invalidIDTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			v := &api.Volume{ID: tt.id, Source: api.TalosSecretSource}
+			s := secrets.NewFiles(v, secrets.File{Path: "secret", Data: []byte("secret")})
+			vm := e.manager(t, secrets.Producers{api.TalosSecretSource: &boringProducer{s}})
+
+			for name, create := range map[string]func(context.Context, *api.Volume) error{"vm.Create": vm.Create, "vm.CreateAsync": vm.CreateAsync} {
+				err := create(context.Background(), v)
+				if _, ok := errors.Cause(err).(ErrInvalid); !ok {
+					t.Errorf("%v(context.Background(), %q): want ErrInvalid, got %v", name, v.ID, err)
+				}
+			}
+			if exists, _ := afero.Exists(e.fs, path.Join(e.m.Root(), "..", "escape")); exists {
+				t.Errorf("vm.Create(context.Background(), %q): want nothing created outside the root", v.ID)
+			}
+		})
+	}
+}
+
+var resolveTests = []struct {
+	name   string
+	sizeMB uint
+	modes  *api.Modes
+	want   *api.Volume
+	err    bool
+}{
+	{
+		name: "Defaults",
+		want: &api.Volume{SizeMB: 100, Modes: &api.Modes{Mountpoint: 0700, Dir: 0700, File: 0600}},
+	},
+	{
+		name:   "Overrides",
+		sizeMB: 200,
+		modes:  &api.Modes{Dir: 0750, File: 0640},
+		want:   &api.Volume{SizeMB: 200, Modes: &api.Modes{Mountpoint: 0700, Dir: 0750, File: 0640}},
+	},
+	{
+		name:   "SizeForbidden",
+		sizeMB: 600,
+		err:    true,
+	},
+	{
+		name:  "ModeForbidden",
+		modes: &api.Modes{File: 0644},
+		err:   true,
+	},
+}
+
+func TestManagerSizeAndModes(t *testing.T) {
+	for _, tt := range resolveTests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &api.Volume{ID: "resolve", Source: api.TalosSecretSource, SizeMB: tt.sizeMB, Modes: tt.modes}
+			s := secrets.NewFiles(v, secrets.File{Path: "secret", Data: []byte("secret")})
+			sp := secrets.Producers{api.TalosSecretSource: &boringProducer{s}}
+			vm := newTestEnv(t).manager(t, sp,
+				VolumeSizeMB(100, 500),
+				MaxModes(api.Modes{Mountpoint: 0750, Dir: 0750, File: 0640}))
+
+			err := vm.Create(context.Background(), v)
+			if tt.err {
+				if _, ok := errors.Cause(err).(ErrForbidden); !ok {
+					t.Errorf("vm.Create(context.Background(), %v): want ErrForbidden, got %v", v.ID, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			}
+
+			got, err := vm.Get(v.ID)
+			if err != nil {
+				t.Fatalf("vm.Get(%v): %v", v.ID, err)
+			}
+			if got.SizeMB != tt.want.SizeMB {
+				t.Errorf("vm.Get(%v).SizeMB: want %v, got %v", v.ID, tt.want.SizeMB, got.SizeMB)
+			}
+			if !reflect.DeepEqual(got.Modes, tt.want.Modes) {
+				t.Errorf("vm.Get(%v).Modes: want %+v, got %+v", v.ID, tt.want.Modes, got.Modes)
+			}
+		})
+	}
+}
+
+var recreateTests = []struct {
+	name string
+	v    *api.Volume
+	diff string
+}{
+	{
+		name: "Identical",
+		v:    &api.Volume{Owner: &api.Owner{UID: 1000, GID: 1000}, SizeMB: 100, Notify: &api.Notify{Cgroup: "docker/cool"}},
+	},
+	{
+		name: "DifferentOwner",
+		v:    &api.Volume{Owner: &api.Owner{UID: 1001, GID: 1000}, Notify: &api.Notify{Cgroup: "docker/cool"}},
+		diff: "Owner: have &{UID:1000 GID:1000}, want &{UID:1001 GID:1000}",
+	},
+	{
+		name: "DifferentSize",
+		v:    &api.Volume{Owner: &api.Owner{UID: 1000, GID: 1000}, SizeMB: 200, Notify: &api.Notify{Cgroup: "docker/cool"}},
+		diff: "SizeMB: have 100, want 200",
+	},
+	{
+		name: "DifferentModes",
+		v:    &api.Volume{Owner: &api.Owner{UID: 1000, GID: 1000}, Modes: &api.Modes{File: 0400}, Notify: &api.Notify{Cgroup: "docker/cool"}},
+		diff: "Modes: have 0700/0700/0600, want 0700/0700/0400",
+	},
+	{
+		name: "DifferentNotify",
+		v:    &api.Volume{Owner: &api.Owner{UID: 1000, GID: 1000}},
+		diff: "Notify: have &{PID:0 Cgroup:docker/cool Signal:}, want <nil>",
+	},
+}
+
+func TestManagerRecreate(t *testing.T) {
+	for _, tt := range recreateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.fs = &chownFs{Fs: e.fs, owners: make(map[string]api.Owner)}
+			sp := secrets.Producers{api.TalosSecretSource: filesProducer{}}
+			vm := e.manager(t, sp, VolumeSizeMB(100, 200), OwnerRange(1000, 2000), NotifySignals("/cgroup"))
+
+			v := &api.Volume{ID: "recreated", Source: api.TalosSecretSource, Owner: &api.Owner{UID: 1000, GID: 1000}, Notify: &api.Notify{Cgroup: "docker/cool"}}
+			if err := vm.Create(context.Background(), v); err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			}
+			r := *tt.v
+			r.ID, r.Source = v.ID, v.Source
+			err := vm.Create(context.Background(), &r)
+			if tt.diff == "" {
+				if err != nil {
+					t.Errorf("vm.Create(context.Background(), %v): want success recreating identical volume, got %v", r.ID, err)
+				}
+				return
+			}
+			if !isExists(err) || !strings.Contains(err.Error(), tt.diff) {
+				t.Errorf("vm.Create(context.Background(), %v): want ErrExists with diff %q, got %v", r.ID, tt.diff, err)
+			}
+		})
+	}
+}
+
+func TestManagerDefaultModesExceedMax(t *testing.T) {
+	e := newTestEnv(t)
+	max := api.Modes{Mountpoint: 0640, Dir: 0640, File: 0640}
+	if _, err := NewManager(e.m, secrets.Producers{}, Filesystem(e.fs), Metadata(e.ms), MaxModes(max)); err == nil {
+		t.Errorf("NewManager(MaxModes(%+v)): want error for default modes exceeding maximum, got nil", max)
+	}
+}
+
+func TestManagerMemoryBudget(t *testing.T) {
+	sp := secrets.Producers{api.TalosSecretSource: &boringProducer{secrets.NewFiles(fixtures.TestVolume)}}
+	vm := newTestEnv(t).manager(t, sp, VolumeSizeMB(100, 200), MemoryBudgetMB(250))
+
+	for _, v := range []*api.Volume{
+		{ID: "one", Source: api.TalosSecretSource},
+		{ID: "two", Source: api.TalosSecretSource, SizeMB: 150},
+	} {
+		if err := vm.Create(context.Background(), v); err != nil {
+			t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+		}
+	}
+
+	v := &api.Volume{ID: "three", Source: api.TalosSecretSource, SizeMB: 1}
+	if _, ok := errors.Cause(vm.Create(context.Background(), v)).(ErrInsufficientCapacity); !ok {
+		t.Errorf("vm.Create(context.Background(), %v): want ErrInsufficientCapacity", v.ID)
+	}
+
+	c, err := vm.Capacity()
+	if err != nil {
+		t.Fatalf("vm.Capacity(): %v", err)
+	}
+	want := &api.Capacity{BudgetBytes: 250 << 20, AllocatedBytes: 250 << 20, Volumes: 2}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("vm.Capacity(): want %+v, got %+v", want, c)
+	}
+
+	if err := vm.Destroy(context.Background(), "one"); err != nil {
+		t.Fatalf("vm.Destroy(context.Background(), %v): %v", "one", err)
+	}
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Errorf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+}
+
+type statfsMounter struct {
+	Mounter
+	used, size int64
+}
+
+func (m *statfsMounter) Statfs(id string) (int64, int64, error) {
+	return m.used, m.size, nil
+}
+
+var statfsTests = []struct {
+	name string
+	m    *statfsMounter
+	want int64
+}{
+	{"Statfs", &statfsMounter{used: 4096, size: 1 << 20}, 1 << 20},
+	{"StatfsUnsupported", &statfsMounter{}, 100 << 20},
+}
+
+func TestManagerUsage(t *testing.T) {
+	for _, tt := range statfsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			m := *tt.m
+			m.Mounter, e.m = e.m, &m
+			v := &api.Volume{ID: "usage", Source: api.TalosSecretSource}
+			s := secrets.NewFiles(v, secrets.File{Path: "secret", Data: []byte("secret")})
+			sp := secrets.Producers{api.TalosSecretSource: &boringProducer{s}}
+			vm := e.manager(t, sp)
+
+			if err := vm.Create(context.Background(), v); err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			}
+			got, err := vm.Get(v.ID)
+			if err != nil {
+				t.Fatalf("vm.Get(%v): %v", v.ID, err)
+			}
+			if got.Usage.Files != 1 {
+				t.Errorf("vm.Get(%v).Usage.Files: want %v, got %v", v.ID, 1, got.Usage.Files)
+			}
+			if got.Usage.SizeBytes != tt.want {
+				t.Errorf("vm.Get(%v).Usage.SizeBytes: want %v, got %v", v.ID, tt.want, got.Usage.SizeBytes)
+			}
+			if got.Usage.Modified.IsZero() {
+				t.Errorf("vm.Get(%v).Usage.Modified: want non-zero time", v.ID)
 			}
 		})
 	}
 }
+
+// An unmountedMounter behaves as if its volumes were unmounted externally.
+type unmountedMounter struct {
+	Mounter
+}
+
+func (m *unmountedMounter) Mounted(id string) (bool, error) {
+	return false, nil
+}
+
+func (m *unmountedMounter) Unmount(id string) error {
+	return errors.New("not mounted")
+}
+
+func TestManagerUnmounted(t *testing.T) {
+	e := newTestEnv(t)
+	fs, m := e.fs, &unmountedMounter{e.m}
+	e.m = m
+	v := &api.Volume{ID: "unmounted", Source: api.TalosSecretSource}
+	sp := secrets.Producers{api.TalosSecretSource: &boringProducer{secrets.NewFiles(v)}}
+	vm := e.manager(t, sp)
+
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+	got, err := vm.Get(v.ID)
+	if err != nil {
+		t.Fatalf("vm.Get(%v): %v", v.ID, err)
+	}
+	if got.Mounted == nil || *got.Mounted {
+		t.Errorf("vm.Get(%v).Mounted: want false, got %v", v.ID, got.Mounted)
+	}
+	if err := vm.Destroy(context.Background(), v.ID); err != nil {
+		t.Errorf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+	}
+	if exists, _ := afero.Exists(fs, m.Path(v.ID)); exists {
+		t.Errorf("vm.Destroy(context.Background(), %v): %v still exists", v.ID, m.Path(v.ID))
+	}
+}
+
+func TestManagerUnmountedAtStartup(t *testing.T) {
+	e := newTestEnv(t)
+	v := &api.Volume{ID: "unmounted", Source: api.TalosSecretSource}
+	sp := secrets.Producers{api.TalosSecretSource: &mutableProducer{}}
+	vm := e.manager(t, sp)
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+
+	// The host restarted, so the volume is no longer mounted.
+	e.m = &unmountedMounter{e.m}
+	vm = e.manager(t, sp)
+	if got, err := vm.Get(v.ID); err != nil || got.Status != api.VolumeBroken {
+		t.Errorf("vm.Get(%v): want broken volume, got %+v (%v)", v.ID, got, err)
+	}
+	if err := vm.Create(context.Background(), &api.Volume{ID: v.ID, Source: v.Source}); !isExists(err) {
+		t.Errorf("vm.Create(context.Background(), %v): want ErrExists, got %v", v.ID, err)
+	}
+	if err := vm.Destroy(context.Background(), v.ID); err != nil {
+		t.Errorf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+	}
+}
+
+// A listingMounter is a MountLister that records how it is asked whether its
+// volumes are mounted.
+type listingMounter struct {
+	Mounter
+	mounted map[string]bool
+	lists   int
+	gets    int
+}
+
+func (m *listingMounter) Mounted(id string) (bool, error) {
+	m.gets++
+	return m.mounted[id], nil
+}
+
+func (m *listingMounter) MountedIDs() (map[string]bool, error) {
+	m.lists++
+	return m.mounted, nil
+}
+
+// An unknownMounter cannot determine whether its volumes are mounted.
+type unknownMounter struct {
+	Mounter
+}
+
+func (m *unknownMounter) Mounted(id string) (bool, error) {
+	return false, errors.New("cannot read mountinfo")
+}
+
+func TestManagerListMounted(t *testing.T) {
+	e := newTestEnv(t)
+	sp := secrets.Producers{api.TalosSecretSource: &mutableProducer{}}
+	vm := e.manager(t, sp)
+	for _, id := range []string{"one", "two", "three"} {
+		if err := vm.Create(context.Background(), &api.Volume{ID: id, Source: api.TalosSecretSource}); err != nil {
+			t.Fatalf("vm.Create(context.Background(), %v): %v", id, err)
+		}
+	}
+
+	m := &listingMounter{Mounter: e.m, mounted: map[string]bool{"one": true, "two": true}}
+	e.m = m
+	vm = e.manager(t, sp)
+	m.lists, m.gets = 0, 0
+	l, err := vm.List()
+	if err != nil {
+		t.Fatalf("vm.List(): %v", err)
+	}
+	if m.lists != 1 || m.gets != 0 {
+		t.Errorf("vm.List(): want mounted volumes listed once, got %v lists and %v gets", m.lists, m.gets)
+	}
+	for _, v := range l {
+		if v.Mounted == nil || *v.Mounted != m.mounted[v.ID] {
+			t.Errorf("vm.List(): want %v mounted %v, got %v", v.ID, m.mounted[v.ID], v.Mounted)
+		}
+	}
+
+	// A volume whose mount state cannot be determined is still listed.
+	e.m = &unknownMounter{e.m}
+	vm = e.manager(t, sp)
+	l, err = vm.List()
+	if err != nil {
+		t.Fatalf("vm.List(): %v", err)
+	}
+	if len(l) != 3 {
+		t.Fatalf("vm.List(): want 3 volumes, got %v", l)
+	}
+	for _, v := range l {
+		if v.Mounted != nil {
+			t.Errorf("vm.List(): want %v mounted unknown, got %v", v.ID, *v.Mounted)
+		}
+	}
+}
+
+func isNonExist(err error) bool {
+	_, ok := errors.Cause(err).(ErrNonExist)
+	return ok
+}
+
+// A busyMounter's volumes are busy until they have been unmounted a number of
+// times.
+type busyMounter struct {
+	Mounter
+	mx    sync.Mutex
+	busy  int
+	lazy  bool
+	calls int
+}
+
+func (m *busyMounter) Unmount(id string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.calls++
+	if m.calls <= m.busy {
+		return ErrBusy("volume is busy")
+	}
+	return nil
+}
+
+func (m *busyMounter) LazyUnmount(id string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.lazy = true
+	return nil
+}
+
+func (m *busyMounter) lazilyUnmounted() bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.lazy
+}
+
+var busyTests = []struct {
+	name     string
+	busy     int
+	mo       []ManagerOption
+	err      bool
+	lazy     bool
+	deferred bool
+}{
+	{name: "NoRetries", busy: 1, mo: []ManagerOption{UnmountRetries(0, time.Millisecond)}, err: true},
+	{name: "Retries", busy: 2, mo: []ManagerOption{UnmountRetries(2, time.Millisecond)}},
+	{name: "RetriesExhausted", busy: 3, mo: []ManagerOption{UnmountRetries(2, time.Millisecond)}, err: true},
+	{name: "Lazy", busy: 3, mo: []ManagerOption{UnmountRetries(2, time.Millisecond), LazyUnmount()}, lazy: true},
+	{name: "Deferred", busy: 3, mo: []ManagerOption{UnmountRetries(0, time.Millisecond), DeferCleanup(10 * time.Millisecond)}, deferred: true},
+}
+
+func TestManagerBusy(t *testing.T) {
+	for _, tt := range busyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			fs, m := e.fs, &busyMounter{Mounter: e.m, busy: tt.busy}
+			e.m = m
+			v := &api.Volume{ID: "busy", Source: api.TalosSecretSource}
+			sp := secrets.Producers{api.TalosSecretSource: &boringProducer{secrets.NewFiles(v)}}
+			vm := e.manager(t, sp, tt.mo...)
+
+			if err := vm.Create(context.Background(), v); err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			}
+			err := vm.Destroy(context.Background(), v.ID)
+			if tt.err {
+				if !busy(err) {
+					t.Errorf("vm.Destroy(context.Background(), %v): want ErrBusy, got %v", v.ID, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+			}
+			if m.lazilyUnmounted() != tt.lazy {
+				t.Errorf("vm.Destroy(context.Background(), %v): want lazy unmount %v, got %v", v.ID, tt.lazy, m.lazilyUnmounted())
+			}
+			if !tt.deferred {
+				if len(vm.Cleanups()) != 0 {
+					t.Errorf("vm.Cleanups(): want none, got %v", vm.Cleanups())
+				}
+				return
+			}
+
+			if cs := vm.Cleanups(); len(cs) != 1 || cs[0].ID != v.ID {
+				t.Fatalf("vm.Cleanups(): want %v, got %v", v.ID, cs)
+			}
+			if _, err := vm.Get(v.ID); !isNonExist(err) {
+				t.Errorf("vm.Get(%v): want ErrNonExist while cleaning up, got %v", v.ID, err)
+			}
+			if l, _ := vm.List(); len(l) != 0 {
+				t.Errorf("vm.List(): want no volumes while cleaning up, got %v", l)
+			}
+			for i := 0; i < 100 && len(vm.Cleanups()) > 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if cs := vm.Cleanups(); len(cs) != 0 {
+				t.Errorf("vm.Cleanups(): want none after cleanup, got %v", cs)
+			}
+			if exists, _ := afero.Exists(fs, m.Path(v.ID)); exists {
+				t.Errorf("cleanup(%v): %v still exists", v.ID, m.Path(v.ID))
+			}
+		})
+	}
+}
+
+func TestManagerDeferredCleanup(t *testing.T) {
+	e := newTestEnv(t)
+	e.m = &busyMounter{Mounter: e.m, busy: 1000}
+	v := &api.Volume{ID: "busy", Source: api.TalosSecretSource}
+	sp := secrets.Producers{api.TalosSecretSource: &boringProducer{secrets.NewFiles(v)}}
+	mo := []ManagerOption{UnmountRetries(0, time.Millisecond), DeferCleanup(time.Millisecond), MaxCleanupAttempts(3)}
+	vm := e.manager(t, sp, mo...)
+
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+	if err := vm.Destroy(context.Background(), v.ID); err != nil {
+		t.Fatalf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+	}
+
+	// Cleanup is abandoned once the maximum attempts are reached.
+	var cs api.Cleanups
+	for i := 0; i < 100; i++ {
+		if cs = vm.Cleanups(); len(cs) == 1 && cs[0].Attempts == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(cs) != 1 || cs[0].Attempts != 3 || !strings.Contains(cs[0].Error, "gave up") {
+		t.Fatalf("vm.Cleanups(): want %v abandoned after 3 attempts, got %+v", v.ID, cs)
+	}
+	since := cs[0].Since
+
+	// The volume remains destroyed when the Manager restarts.
+	vm = e.manager(t, sp, mo...)
+	if _, err := vm.Get(v.ID); !isNonExist(err) {
+		t.Errorf("vm.Get(%v): want ErrNonExist after restart, got %v", v.ID, err)
+	}
+	// Cleanup is not retried after a restart once the maximum attempts are
+	// reached.
+	time.Sleep(20 * time.Millisecond)
+	if cs := vm.Cleanups(); len(cs) != 1 || cs[0].ID != v.ID || cs[0].Attempts != 3 || !cs[0].Since.Equal(since) {
+		t.Errorf("vm.Cleanups(): want %v abandoned after 3 attempts since %v after restart, got %+v", v.ID, since, cs)
+	}
+	if err := vm.ForceDestroy(context.Background(), v.ID); err != nil {
+		t.Errorf("vm.ForceDestroy(context.Background(), %v): %v", v.ID, err)
+	}
+}
+
+func TestManagerDeferredCleanupUnmounted(t *testing.T) {
+	e := newTestEnv(t)
+	m := e.m
+	e.m = &busyMounter{Mounter: m, busy: 1000}
+	v := &api.Volume{ID: "busy", Source: api.TalosSecretSource}
+	sp := secrets.Producers{api.TalosSecretSource: &boringProducer{secrets.NewFiles(v)}}
+	mo := []ManagerOption{UnmountRetries(0, time.Millisecond), DeferCleanup(time.Hour)}
+	vm := e.manager(t, sp, mo...)
+
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+	if err := vm.Destroy(context.Background(), v.ID); err != nil {
+		t.Fatalf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+	}
+
+	// The volume was unmounted while the Manager was stopped.
+	e.m = &unmountedMounter{m}
+	vm = e.manager(t, sp, UnmountRetries(0, time.Millisecond), DeferCleanup(time.Millisecond))
+	for i := 0; i < 100 && len(vm.Cleanups()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cs := vm.Cleanups(); len(cs) != 0 {
+		t.Errorf("vm.Cleanups(): want none after cleanup, got %+v", cs)
+	}
+	if exists, _ := afero.Exists(e.fs, m.Path(v.ID)); exists {
+		t.Errorf("cleanup(%v): %v still exists", v.ID, m.Path(v.ID))
+	}
+	if _, err := e.ms.Get(v.ID); !isNonExist(err) {
+		t.Errorf("ms.Get(%v): want ErrNonExist after cleanup, got %v", v.ID, err)
+	}
+}
+
+func TestManagerMigrateMetadata(t *testing.T) {
+	e := newTestEnv(t)
+	fs, m, ms := e.fs, e.m, e.ms
+	v := &api.Volume{ID: "legacy", Source: api.TalosSecretSource, Tags: map[string][]string{"tag": {"awesome"}}}
+	legacy := path.Join(m.Path(v.ID), ".meta")
+	fs.MkdirAll(m.Path(v.ID), 0700)
+	f, _ := fs.Create(legacy)
+	v.WriteJSON(f)
+	f.Close()
+
+	vm := e.manager(t, secrets.Producers{})
+
+	l, err := vm.List()
+	if err != nil {
+		t.Fatalf("vm.List(): %v", err)
+	}
+	if len(l) != 1 || l[0].ID != v.ID {
+		t.Fatalf("vm.List(): want %v, got %v", v.ID, l)
+	}
+	if exists, _ := afero.Exists(fs, legacy); exists {
+		t.Errorf("vm.List(): want %v removed, but it still exists", legacy)
+	}
+	got, err := ms.Get(v.ID)
+	if err != nil {
+		t.Fatalf("ms.Get(%v): %v", v.ID, err)
+	}
+	if !reflect.DeepEqual(got, v) {
+		t.Errorf("ms.Get(%v): want %v, got %v", v.ID, v, got)
+	}
+
+	// Legacy metadata files are only migrated at startup. A consumer could
+	// otherwise write one to a volume whose metadata was lost.
+	ms.Delete(v.ID)
+	f, _ = fs.Create(legacy)
+	v.WriteJSON(f)
+	f.Close()
+	if _, err := vm.(*manager).readMetadata(v.ID); !isNonExist(err) {
+		t.Errorf("vm.readMetadata(%v): want ErrNonExist after startup, got %v", v.ID, err)
+	}
+	if exists, _ := afero.Exists(fs, legacy); !exists {
+		t.Errorf("vm.readMetadata(%v): want %v left in place, but it was removed", v.ID, legacy)
+	}
+	ms.Put(v)
+
+	if err := vm.Destroy(context.Background(), v.ID); err != nil {
+		t.Fatalf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+	}
+	if _, err := ms.Get(v.ID); !isNonExist(err) {
+		t.Errorf("ms.Get(%v): want ErrNonExist after destroy, got %v", v.ID, err)
+	}
+}
+
+// A filesProducer produces a fresh set of secrets for each volume, optionally
+// after a delay.
+type filesProducer struct {
+	delay time.Duration
+}
+
+func (sp filesProducer) For(_ context.Context, v *api.Volume) (api.Secrets, error) {
+	time.Sleep(sp.delay)
+	return secrets.NewFiles(v, secrets.File{Path: "secret", Data: []byte("secret")}), nil
+}
+
+func TestManagerIndex(t *testing.T) {
+	e := newTestEnv(t)
+	sp := secrets.Producers{api.TalosSecretSource: filesProducer{}}
+	vm := e.manager(t, sp)
+
+	ids := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	wg := &sync.WaitGroup{}
+	for _, id := range ids {
+		wg.Add(2)
+		go func(id string) {
+			defer wg.Done()
+			if err := vm.Create(context.Background(), &api.Volume{ID: id, Source: api.TalosSecretSource}); err != nil {
+				t.Errorf("vm.Create(context.Background(), %v): %v", id, err)
+			}
+		}(id)
+		go func() {
+			defer wg.Done()
+			if _, err := vm.List(); err != nil {
+				t.Errorf("vm.List(): %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := vm.Destroy(context.Background(), "a"); err != nil {
+		t.Fatalf("vm.Destroy(context.Background(), %v): %v", "a", err)
+	}
+	want := ids[1:]
+
+	// A new Manager rebuilds its index from the metadata store.
+	rebuilt := e.manager(t, sp)
+	for _, vm := range []Manager{vm, rebuilt} {
+		l, err := vm.List()
+		if err != nil {
+			t.Fatalf("vm.List(): %v", err)
+		}
+		got := make([]string, 0, len(l))
+		for _, v := range l {
+			got = append(got, v.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("vm.List(): want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestManagerIndexCopies(t *testing.T) {
+	e := newTestEnv(t)
+	e.fs = &chownFs{Fs: e.fs, owners: make(map[string]api.Owner)}
+	sp := secrets.Producers{api.TalosSecretSource: filesProducer{}}
+	vm := e.manager(t, sp, OwnerRange(1000, 2000), NotifySignals("/cgroup"))
+	v := &api.Volume{
+		ID:      "copied",
+		Source:  api.TalosSecretSource,
+		Tags:    url.Values{"a": []string{"1"}},
+		Owner:   &api.Owner{UID: 1000, GID: 1000},
+		Notify:  &api.Notify{Cgroup: "docker/cool"},
+		KeyPair: api.KeyPair{Certificate: "cert", PrivateKey: "key"},
+	}
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+	defer vm.Destroy(context.Background(), v.ID)
+
+	got, err := vm.Get(v.ID)
+	if err != nil {
+		t.Fatalf("vm.Get(%v): %v", v.ID, err)
+	}
+	if got.KeyPair != (api.KeyPair{}) {
+		t.Errorf("vm.Get(%v).KeyPair: want empty, got %+v", v.ID, got.KeyPair)
+	}
+
+	// Modifying the volume that was created, or one that was returned, does
+	// not modify the index.
+	v.Tags["a"][0] = "2"
+	got.Tags.Add("b", "3")
+	got.Owner.UID = 0
+	got.Modes.File = 0777
+	got.Notify.Cgroup = "../escape"
+	again, err := vm.Get(v.ID)
+	if err != nil {
+		t.Fatalf("vm.Get(%v): %v", v.ID, err)
+	}
+	want := url.Values{"a": []string{"1"}}
+	if !reflect.DeepEqual(again.Tags, want) {
+		t.Errorf("vm.Get(%v).Tags: want %v, got %v", v.ID, want, again.Tags)
+	}
+	if again.Owner.UID != 1000 || again.Modes.File == 0777 || again.Notify.Cgroup != "docker/cool" {
+		t.Errorf("vm.Get(%v): want indexed metadata unmodified, got %+v", v.ID, again)
+	}
+}
+
+// A brokenMounter cannot mount volumes.
+type brokenMounter struct {
+	Mounter
+}
+
+func (m *brokenMounter) Mount(v *api.Volume) error {
+	return errors.New("cannot mount")
+}
+
+func TestManagerBroken(t *testing.T) {
+	e := newTestEnv(t)
+	fs, m := e.fs, &brokenMounter{e.m}
+	e.m = m
+
+	// A volume with no metadata, and a volume with unparseable metadata.
+	fs.MkdirAll(m.Path("nometa"), 0700)
+	fs.MkdirAll(m.Path("badmeta"), 0700)
+	afero.WriteFile(fs, "/metadata/badmeta.json", []byte("{"), 0600)
+
+	sp := secrets.Producers{api.TalosSecretSource: filesProducer{}}
+	vm := e.manager(t, sp)
+
+	// A volume that could not be mounted.
+	v := &api.Volume{ID: "unmountable", Source: api.TalosSecretSource}
+	if err := vm.Create(context.Background(), v); err == nil {
+		t.Errorf("vm.Create(context.Background(), %v): want error, got nil", v.ID)
+	}
+
+	l, err := vm.List()
+	if err != nil {
+		t.Fatalf("vm.List(): %v", err)
+	}
+	want := []string{"badmeta", "nometa", "unmountable"}
+	status := []api.VolumeStatus{api.VolumeBroken, api.VolumeBroken, api.VolumeFailed}
+	if len(l) != len(want) {
+		t.Fatalf("vm.List(): want %v, got %v", want, l)
+	}
+	for i, v := range l {
+		if v.ID != want[i] || v.Status != status[i] || v.Error == "" {
+			t.Errorf("vm.List()[%v]: want %v volume %v, got %+v", i, status[i], want[i], v)
+		}
+	}
+	if v, err := vm.Get("nometa"); err != nil || v.Status != api.VolumeBroken {
+		t.Errorf("vm.Get(%v): want broken volume, got %+v (%v)", "nometa", v, err)
+	}
+
+	for _, id := range want {
+		if err := vm.ForceDestroy(context.Background(), id); err != nil {
+			t.Errorf("vm.ForceDestroy(context.Background(), %v): %v", id, err)
+		}
+		if exists, _ := afero.Exists(fs, m.Path(id)); exists {
+			t.Errorf("vm.ForceDestroy(context.Background(), %v): %v still exists", id, m.Path(id))
+		}
+	}
+	if l, _ := vm.List(); len(l) != 0 {
+		t.Errorf("vm.List(): want no volumes after force destroy, got %v", l)
+	}
+	if err := vm.ForceDestroy(context.Background(), "nometa"); !isNonExist(err) {
+		t.Errorf("vm.ForceDestroy(context.Background(), %v): want ErrNonExist, got %v", "nometa", err)
+	}
+}
+
+func TestManagerForceDestroyBusy(t *testing.T) {
+	e := newTestEnv(t)
+	m := &busyMounter{Mounter: e.m, busy: 100}
+	e.m = m
+	v := &api.Volume{ID: "busy", Source: api.TalosSecretSource}
+	sp := secrets.Producers{api.TalosSecretSource: filesProducer{}}
+	vm := e.manager(t, sp, UnmountRetries(1, time.Millisecond), DeferCleanup(time.Hour))
+
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+	if err := vm.Destroy(context.Background(), v.ID); err != nil {
+		t.Fatalf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+	}
+	if cs := vm.Cleanups(); len(cs) != 1 {
+		t.Fatalf("vm.Cleanups(): want %v, got %v", v.ID, cs)
+	}
+	if err := vm.ForceDestroy(context.Background(), v.ID); err != nil {
+		t.Fatalf("vm.ForceDestroy(context.Background(), %v): %v", v.ID, err)
+	}
+	if !m.lazilyUnmounted() {
+		t.Errorf("vm.ForceDestroy(context.Background(), %v): want lazy unmount", v.ID)
+	}
+	if cs := vm.Cleanups(); len(cs) != 0 {
+		t.Errorf("vm.Cleanups(): want none after force destroy, got %v", cs)
+	}
+	if c, _ := vm.Capacity(); c.Volumes != 0 {
+		t.Errorf("vm.Capacity().Volumes: want 0 after force destroy, got %v", c.Volumes)
+	}
+}
+
+func TestManagerWaitsForBackgroundWork(t *testing.T) {
+	e := newTestEnv(t)
+	sp := &mutableProducer{[]secrets.File{{Path: "secret", Data: []byte("secret")}}}
+	vm := e.manager(t, secrets.Producers{api.TalosSecretSource: sp})
+	v := &api.Volume{ID: "background", Source: api.TalosSecretSource}
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+
+	// Requests wait for background work, such as a renewal, to finish.
+	l := vm.(*manager).locks
+	if !l.tryLock(v.ID) {
+		t.Fatalf("l.tryLock(%v): want true, got false", v.ID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := vm.Refresh(ctx, v.ID, api.KeyPair{}); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("vm.Refresh(ctx, %v): want %v, got %v", v.ID, context.DeadlineExceeded, err)
+	}
+	done := make(chan error)
+	go func() { done <- vm.Destroy(context.Background(), v.ID) }()
+	time.Sleep(10 * time.Millisecond)
+	l.unlock(v.ID)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("vm.Destroy(context.Background(), %v): still waiting after lock was released", v.ID)
+	}
+}
+
+func isConflict(err error) bool {
+	_, ok := errors.Cause(err).(ErrConflict)
+	return ok
+}
+
+func isExists(err error) bool {
+	_, ok := errors.Cause(err).(ErrExists)
+	return ok
+}
+
+func isInsufficientCapacity(err error) bool {
+	_, ok := errors.Cause(err).(ErrInsufficientCapacity)
+	return ok
+}
+
+func TestManagerConcurrency(t *testing.T) {
+	e := newTestEnv(t)
+	fs, m, ms := e.fs, e.m, e.ms
+	// Slow secret production widens the window for races.
+	sp := secrets.Producers{api.TalosSecretSource: filesProducer{time.Millisecond}}
+	vm := e.manager(t, sp)
+
+	ids := []string{"a", "b", "c"}
+	// The number of times each volume was successfully created, less the number
+	// of times it was successfully destroyed.
+	mx := &sync.Mutex{}
+	live := make(map[string]int)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				id := ids[(w+i)%len(ids)]
+				switch i % 4 {
+				case 0, 1:
+					// Unique tags ensure a volume is never idempotently recreated.
+					tags := map[string][]string{"attempt": {fmt.Sprintf("%v-%v", w, i)}}
+					err := vm.Create(context.Background(), &api.Volume{ID: id, Source: api.TalosSecretSource, Tags: tags})
+					if err == nil {
+						mx.Lock()
+						live[id]++
+						mx.Unlock()
+					} else if !isExists(err) && !isConflict(err) {
+						t.Errorf("vm.Create(context.Background(), %v): %v", id, err)
+					}
+				case 2:
+					err := vm.Destroy(context.Background(), id)
+					if err == nil {
+						mx.Lock()
+						live[id]--
+						mx.Unlock()
+					} else if !isNonExist(err) && !isConflict(err) {
+						t.Errorf("vm.Destroy(context.Background(), %v): %v", id, err)
+					}
+				case 3:
+					if _, err := vm.List(); err != nil {
+						t.Errorf("vm.List(): %v", err)
+					}
+					if v, err := vm.Get(id); err == nil && v.Status != api.VolumeReady {
+						t.Errorf("vm.Get(%v).Status: want ready volume, got %v (%v)", id, v.Status, v.Error)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	l, err := vm.List()
+	if err != nil {
+		t.Fatalf("vm.List(): %v", err)
+	}
+	listed := make(map[string]bool)
+	for _, v := range l {
+		listed[v.ID] = true
+	}
+	for _, id := range ids {
+		exists, _ := afero.DirExists(fs, m.Path(id))
+		_, err := ms.Get(id)
+		stored := err == nil
+		if listed[id] != exists || listed[id] != stored {
+			t.Errorf("%v: want listed, path existence, and stored metadata to agree, got %v, %v, %v", id, listed[id], exists, stored)
+		}
+		want := 0
+		if listed[id] {
+			want = 1
+		}
+		if live[id] != want {
+			t.Errorf("%v: want %v more successful creates than destroys, got %v", id, want, live[id])
+		}
+	}
+}
+
+// A gatedProducer produces secrets, or fails, once its gate is opened or its
+// context is done.
+type gatedProducer struct {
+	gate chan struct{}
+	err  error
+}
+
+func (sp *gatedProducer) For(ctx context.Context, v *api.Volume) (api.Secrets, error) {
+	select {
+	case <-sp.gate:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if sp.err != nil {
+		return nil, sp.err
+	}
+	return secrets.NewFiles(v, secrets.File{Path: "secret", Data: []byte("secret")}), nil
+}
+
+// waitFor polls the supplied volume until it is no longer pending.
+func waitFor(vm Manager, id string) (*api.Volume, error) {
+	for i := 0; i < 100; i++ {
+		v, err := vm.Get(id)
+		if err != nil || v.Status != api.VolumePending {
+			return v, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, errors.New("volume is still pending")
+}
+
+var asyncTests = []struct {
+	name   string
+	err    error
+	status api.VolumeStatus
+}{
+	{name: "Ready", status: api.VolumeReady},
+	{name: "Failed", err: errors.New("boom"), status: api.VolumeFailed},
+}
+
+func TestManagerCreateAsync(t *testing.T) {
+	for _, tt := range asyncTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			ms := e.ms
+			sp := &gatedProducer{make(chan struct{}), tt.err}
+			vm := e.manager(t, secrets.Producers{api.TalosSecretSource: sp})
+
+			v := &api.Volume{ID: "async", Source: api.TalosSecretSource}
+			if err := vm.CreateAsync(context.Background(), v); err != nil {
+				t.Fatalf("vm.CreateAsync(context.Background(), %v): %v", v.ID, err)
+			}
+			if v.Status != api.VolumePending {
+				t.Errorf("vm.CreateAsync(context.Background(), %v).Status: want %v, got %v", v.ID, api.VolumePending, v.Status)
+			}
+			if got, err := vm.Get(v.ID); err != nil || got.Status != api.VolumePending {
+				t.Errorf("vm.Get(%v): want pending volume, got %+v (%v)", v.ID, got, err)
+			}
+			retry := &api.Volume{ID: v.ID, Source: v.Source}
+			if err := vm.CreateAsync(context.Background(), retry); err != nil || retry.Status != api.VolumePending {
+				t.Errorf("vm.CreateAsync(context.Background(), %v): want pending volume, got %+v (%v)", v.ID, retry, err)
+			}
+			if err := vm.Destroy(context.Background(), v.ID); !isConflict(err) {
+				t.Errorf("vm.Destroy(context.Background(), %v): want ErrConflict while pending, got %v", v.ID, err)
+			}
+
+			close(sp.gate)
+			got, err := waitFor(vm, v.ID)
+			if err != nil {
+				t.Fatalf("vm.Get(%v): %v", v.ID, err)
+			}
+			if got.Status != tt.status {
+				t.Errorf("vm.Get(%v).Status: want %v, got %v (%v)", v.ID, tt.status, got.Status, got.Error)
+			}
+			if tt.err != nil && !strings.Contains(got.Error, tt.err.Error()) {
+				t.Errorf("vm.Get(%v).Error: want %v, got %v", v.ID, tt.err, got.Error)
+			}
+			if stored, err := ms.Get(v.ID); err != nil || stored.Status != tt.status {
+				t.Errorf("ms.Get(%v): want %v volume, got %+v (%v)", v.ID, tt.status, stored, err)
+			}
+			if err := vm.Destroy(context.Background(), v.ID); err != nil {
+				t.Errorf("vm.Destroy(context.Background(), %v): %v", v.ID, err)
+			}
+		})
+	}
+}
+
+var cancelAsyncTests = []struct {
+	name  string
+	mo    []ManagerOption
+	force bool
+}{
+	{name: "ForceDestroyed", force: true},
+	{name: "TimedOut", mo: []ManagerOption{CreateTimeout(10 * time.Millisecond)}},
+}
+
+func TestManagerCreateAsyncCancelled(t *testing.T) {
+	for _, tt := range cancelAsyncTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			sp := &gatedProducer{make(chan struct{}), nil}
+			vm := e.manager(t, secrets.Producers{api.TalosSecretSource: sp}, tt.mo...)
+
+			v := &api.Volume{ID: "async", Source: api.TalosSecretSource}
+			if err := vm.CreateAsync(context.Background(), v); err != nil {
+				t.Fatalf("vm.CreateAsync(context.Background(), %v): %v", v.ID, err)
+			}
+			if tt.force {
+				if err := vm.ForceDestroy(context.Background(), v.ID); err != nil {
+					t.Errorf("vm.ForceDestroy(context.Background(), %v): %v", v.ID, err)
+				}
+			}
+			if _, err := waitFor(vm, v.ID); !isNonExist(err) {
+				t.Errorf("vm.Get(%v): want ErrNonExist after creation was cancelled, got %v", v.ID, err)
+			}
+			if exists, _ := afero.Exists(e.fs, e.m.Path(v.ID)); exists {
+				t.Errorf("vm.CreateAsync(context.Background(), %v): want %v removed, but it exists", v.ID, e.m.Path(v.ID))
+			}
+			if _, err := e.ms.Get(v.ID); !isNonExist(err) {
+				t.Errorf("ms.Get(%v): want ErrNonExist after creation was cancelled, got %v", v.ID, err)
+			}
+			close(sp.gate)
+			if err := vm.Create(context.Background(), v); err != nil {
+				t.Errorf("vm.Create(context.Background(), %v): want success after creation was cancelled, got %v", v.ID, err)
+			}
+		})
+	}
+}
+
+func TestManagerInterruptedCreate(t *testing.T) {
+	e := newTestEnv(t)
+	ms := e.ms
+	v := &api.Volume{ID: "interrupted", Source: api.TalosSecretSource, Status: api.VolumePending}
+	e.fs.MkdirAll(e.m.Path(v.ID), 0700)
+	ms.Put(v)
+
+	vm := e.manager(t, secrets.Producers{})
+	got, err := vm.Get(v.ID)
+	if err != nil {
+		t.Fatalf("vm.Get(%v): %v", v.ID, err)
+	}
+	if got.Status != api.VolumeFailed {
+		t.Errorf("vm.Get(%v).Status: want %v, got %v", v.ID, api.VolumeFailed, got.Status)
+	}
+	if stored, err := ms.Get(v.ID); err != nil || stored.Status != api.VolumeFailed {
+		t.Errorf("ms.Get(%v): want failed volume, got %+v (%v)", v.ID, stored, err)
+	}
+}
+
+// A cancellingProducer cancels the creation of the volumes it produces secrets
+// for, as if the client had disconnected.
+type cancellingProducer struct {
+	cancel context.CancelFunc
+}
+
+func (sp *cancellingProducer) For(_ context.Context, v *api.Volume) (api.Secrets, error) {
+	sp.cancel()
+	return secrets.NewFiles(v, secrets.File{Path: "secret", Data: []byte("secret")}), nil
+}
+
+func TestManagerCreateCancelled(t *testing.T) {
+	e := newTestEnv(t)
+	fs, m, ms := e.fs, e.m, e.ms
+	ctx, cancel := context.WithCancel(context.Background())
+	sp := secrets.Producers{api.TalosSecretSource: &cancellingProducer{cancel}}
+	vm := e.manager(t, sp)
+
+	v := &api.Volume{ID: "cancelled", Source: api.TalosSecretSource}
+	if err := vm.Create(ctx, v); errors.Cause(err) != context.Canceled {
+		t.Errorf("vm.Create(%v): want %v, got %v", v.ID, context.Canceled, err)
+	}
+	if exists, _ := afero.Exists(fs, m.Path(v.ID)); exists {
+		t.Errorf("vm.Create(%v): want %v rolled back, but it exists", v.ID, m.Path(v.ID))
+	}
+	if _, err := ms.Get(v.ID); !isNonExist(err) {
+		t.Errorf("ms.Get(%v): want ErrNonExist after rollback, got %v", v.ID, err)
+	}
+	if l, _ := vm.List(); len(l) != 0 {
+		t.Errorf("vm.List(): want no volumes after rollback, got %v", l)
+	}
+}
+
+// A tagsProducer produces a file for each of a volume's tags. Volumes tagged
+// 'fail' fail part way through reading their secrets.
+type tagsProducer struct{}
+
+func (sp tagsProducer) For(_ context.Context, v *api.Volume) (api.Secrets, error) {
+	fs := []secrets.File{}
+	for k := range v.Tags {
+		fs = append(fs, secrets.File{Path: path.Join("tags", k), Data: []byte(v.Tags.Get(k))})
+	}
+	s := secrets.NewFiles(v, fs...)
+	if v.Tags.Get("fail") != "" {
+		return &failingSecrets{Secrets: s}, nil
+	}
+	return s, nil
+}
+
+type failingSecrets struct {
+	api.Secrets
+	read int
+}
+
+func (s *failingSecrets) Next() (*api.SecretsHeader, error) {
+	if s.read++; s.read > 1 {
+		return nil, errors.New("boom")
+	}
+	return s.Secrets.Next()
+}
+
+var updateTests = []struct {
+	name  string
+	v     *api.Volume
+	files map[string]string
+	err   func(error) bool
+}{
+	{
+		name:  "Updated",
+		v:     &api.Volume{ID: "updated", Tags: url.Values{"a": []string{"3"}, "c": []string{"4"}}},
+		files: map[string]string{"tags/a": "3", "tags/c": "4"},
+	},
+	{
+		name:  "Unchanged",
+		v:     &api.Volume{ID: "unchanged", Source: api.TalosSecretSource, Tags: url.Values{"a": []string{"1"}, "b": []string{"2"}}},
+		files: map[string]string{"tags/a": "1", "tags/b": "2"},
+	},
+	{
+		name:  "FailedToWrite",
+		v:     &api.Volume{ID: "failed", Tags: url.Values{"a": []string{"3"}, "fail": []string{"yes"}}},
+		files: map[string]string{"tags/a": "1", "tags/b": "2"},
+		err:   func(err error) bool { return err != nil },
+	},
+	{
+		name:  "DifferentSource",
+		v:     &api.Volume{ID: "source", Source: api.ExecSecretSource, Tags: url.Values{"a": []string{"3"}}},
+		files: map[string]string{"tags/a": "1", "tags/b": "2"},
+		err:   isConflict,
+	},
+}
+
+func TestManagerUpdate(t *testing.T) {
+	e := newTestEnv(t)
+	af, m := &afero.Afero{Fs: e.fs}, e.m
+	sp := secrets.Producers{api.TalosSecretSource: tagsProducer{}}
+	vm := e.manager(t, sp)
+
+	if err := vm.Update(context.Background(), &api.Volume{ID: "nonexistent"}); !isNonExist(err) {
+		t.Errorf("vm.Update(context.Background(), nonexistent): want ErrNonExist, got %v", err)
+	}
+
+	for _, tt := range updateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &api.Volume{ID: tt.v.ID, Source: api.TalosSecretSource, Tags: url.Values{"a": []string{"1"}, "b": []string{"2"}}}
+			if err := vm.Create(context.Background(), v); err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			}
+			defer vm.Destroy(context.Background(), v.ID)
+
+			err := vm.Update(context.Background(), tt.v)
+			switch {
+			case tt.err == nil && err != nil:
+				t.Errorf("vm.Update(context.Background(), %v): %v", tt.v.ID, err)
+			case tt.err != nil && !tt.err(err):
+				t.Errorf("vm.Update(context.Background(), %v): unexpected error %v", tt.v.ID, err)
+			}
+
+			want := v.Tags
+			if tt.err == nil {
+				want = tt.v.Tags
+			}
+			if got, _ := vm.Get(v.ID); got == nil || !reflect.DeepEqual(got.Tags, want) || got.Status != api.VolumeReady {
+				t.Errorf("vm.Get(%v): want ready with tags %v, got %+v", v.ID, want, got)
+			}
+
+			found := map[string]string{}
+			af.Walk(m.Path(v.ID), func(p string, fi os.FileInfo, err error) error {
+				if err == nil && !fi.IsDir() && path.Base(p) != ".version" {
+					b, _ := af.ReadFile(p)
+					found[strings.TrimPrefix(p, m.Path(v.ID)+"/")] = string(b)
+				}
+				return nil
+			})
+			if !reflect.DeepEqual(found, tt.files) {
+				t.Errorf("vm.Update(context.Background(), %v): want files %v, got %v", tt.v.ID, tt.files, found)
+			}
+		})
+	}
+}
+
+// A linkingFs is the OS filesystem, which supports symbolic links. Its renames
+// fail while failRename is set.
+type linkingFs struct {
+	afero.Fs
+	failRename bool
+}
+
+func (fs *linkingFs) Rename(oldname, newname string) error {
+	if fs.failRename {
+		return errors.New("boom")
+	}
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func (fs *linkingFs) Symlink(oldname, newname string) error { return os.Symlink(oldname, newname) }
+func (fs *linkingFs) Readlink(name string) (string, error)  { return os.Readlink(name) }
+
+// A failingMetadataStore fails to put metadata while failPut is set.
+type failingMetadataStore struct {
+	MetadataStore
+	failPut bool
+}
+
+func (ms *failingMetadataStore) Put(v *api.Volume) error {
+	if ms.failPut {
+		return errors.New("boom")
+	}
+	return ms.MetadataStore.Put(v)
+}
+
+var linkedUpdateTests = []struct {
+	name       string
+	failRename bool
+	failPut    bool
+	tags       url.Values
+}{
+	{"Updated", false, false, url.Values{"a": []string{"3"}, "c": []string{"4"}}},
+	{"RenameFailed", true, false, url.Values{"a": []string{"1"}, "b": []string{"2"}}},
+	{"PutFailed", false, true, url.Values{"a": []string{"1"}, "b": []string{"2"}}},
+}
+
+func TestManagerLinkedUpdate(t *testing.T) {
+	for _, tt := range linkedUpdateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "secret-volume")
+			if err != nil {
+				t.Fatalf("ioutil.TempDir(): %v", err)
+			}
+			defer os.RemoveAll(dir)
+			fs := &linkingFs{Fs: afero.NewOsFs()}
+			dms, err := NewDirMetadataStore("/metadata", DirMetadataFilesystem(afero.NewMemMapFs()))
+			if err != nil {
+				t.Fatalf("NewDirMetadataStore(): %v", err)
+			}
+			ms := &failingMetadataStore{MetadataStore: dms}
+			e := &testEnv{fs, NewNoopMounter(dir), ms}
+			vm := e.manager(t, secrets.Producers{api.TalosSecretSource: tagsProducer{}})
+
+			v := &api.Volume{ID: "linked", Source: api.TalosSecretSource, Tags: url.Values{"a": []string{"1"}, "b": []string{"2"}}}
+			if err := vm.Create(context.Background(), v); err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			}
+
+			fs.failRename, ms.failPut = tt.failRename, tt.failPut
+			err = vm.Update(context.Background(), &api.Volume{ID: v.ID, Tags: url.Values{"a": []string{"3"}, "c": []string{"4"}}})
+			if failed := tt.failRename || tt.failPut; failed != (err != nil) {
+				t.Errorf("vm.Update(context.Background(), %v): want error %v, got %v", v.ID, failed, err)
+			}
+			fs.failRename, ms.failPut = false, false
+
+			if got, _ := vm.Get(v.ID); got == nil || !reflect.DeepEqual(got.Tags, tt.tags) {
+				t.Errorf("vm.Get(%v): want tags %v, got %+v", v.ID, tt.tags, got)
+			}
+			if got, _ := ms.Get(v.ID); got == nil || !reflect.DeepEqual(got.Tags, tt.tags) {
+				t.Errorf("ms.Get(%v): want tags %v, got %+v", v.ID, tt.tags, got)
+			}
+			root := e.m.Path(v.ID)
+			for _, k := range []string{"a", "b", "c"} {
+				p := path.Join(root, "tags", k)
+				b, err := afero.ReadFile(fs, p)
+				if want := tt.tags.Get(k); string(b) != want || (err != nil) != (want == "") {
+					t.Errorf("afero.ReadFile(%v): want %q, got %q (%v)", p, want, b, err)
+				}
+			}
+			if _, err := os.Readlink(path.Join(root, "tags")); err != nil {
+				t.Errorf("os.Readlink(%v): want tags linked through %v, got %v", path.Join(root, "tags"), dataLink, err)
+			}
+			fis, err := afero.ReadDir(fs, root)
+			if err != nil {
+				t.Fatalf("afero.ReadDir(%v): %v", root, err)
+			}
+			dirs := 0
+			for _, fi := range fis {
+				if reserved(fi.Name()) && fi.Name() != dataLink {
+					dirs++
+				}
+			}
+			if dirs != 1 {
+				t.Errorf("afero.ReadDir(%v): want one data directory, got %v", root, fis)
+			}
+		})
+	}
+}
+
+// A mutableProducer produces its current files for every volume.
+type mutableProducer struct {
+	files []secrets.File
+}
+
+func (sp *mutableProducer) For(_ context.Context, v *api.Volume) (api.Secrets, error) {
+	return secrets.NewFiles(v, sp.files...), nil
+}
+
+// hmacHex returns the hex encoded HMAC-SHA256 of s, keyed by the supplied
+// Manager's hash key.
+func hmacHex(vm Manager, s string) string {
+	h := hmac.New(sha256.New, vm.(*manager).hashKey)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestManagerRefresh(t *testing.T) {
+	e := newTestEnv(t)
+	fs, af, m := e.fs, &afero.Afero{Fs: e.fs}, e.m
+	sp := &mutableProducer{[]secrets.File{{Path: "a", Data: []byte("1")}, {Path: "b", Data: []byte("2")}}}
+	vm := e.manager(t, secrets.Producers{api.TalosSecretSource: sp})
+
+	if _, err := vm.Refresh(context.Background(), "nonexistent", api.KeyPair{}); !isNonExist(err) {
+		t.Errorf("vm.Refresh(context.Background(), nonexistent): want ErrNonExist, got %v", err)
+	}
+
+	v := &api.Volume{ID: "refreshed", Source: api.TalosSecretSource}
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+	defer vm.Destroy(context.Background(), v.ID)
+
+	sp.files = []secrets.File{{Path: "a", Data: []byte("3")}, {Path: "c", Data: []byte("4")}}
+	rf, err := vm.Refresh(context.Background(), v.ID, api.KeyPair{})
+	if err != nil {
+		t.Fatalf("vm.Refresh(context.Background(), %v): %v", v.ID, err)
+	}
+	want := &api.Refresh{
+		ID:      v.ID,
+		Version: 1,
+		Time:    rf.Time,
+		Added:   []api.FileHash{{Path: "c", HMAC: hmacHex(vm, "4")}},
+		Removed: []api.FileHash{{Path: "b", HMAC: hmacHex(vm, "2")}},
+		Changed: []api.FileHash{{Path: "a", HMAC: hmacHex(vm, "3")}},
+	}
+	if !reflect.DeepEqual(rf, want) {
+		t.Errorf("vm.Refresh(context.Background(), %v): want %+v, got %+v", v.ID, want, rf)
+	}
+
+	p := path.Join(m.Path(v.ID), ".version")
+	f, err := fs.Open(p)
+	if err != nil {
+		t.Fatalf("fs.Open(%v): %v", p, err)
+	}
+	defer f.Close()
+	marker, err := api.ReadRefreshJSON(f)
+	if err != nil {
+		t.Fatalf("api.ReadRefreshJSON(%v): %v", p, err)
+	}
+	if marker.Version != want.Version || !reflect.DeepEqual(marker.Changed, want.Changed) {
+		t.Errorf("api.ReadRefreshJSON(%v): want %+v, got %+v", p, want, marker)
+	}
+	if exists, _ := af.Exists(path.Join(m.Path(v.ID), "b")); exists {
+		t.Errorf("vm.Refresh(context.Background(), %v): removed file b still exists", v.ID)
+	}
+
+	rf, err = vm.Refresh(context.Background(), v.ID, api.KeyPair{})
+	if err != nil {
+		t.Fatalf("vm.Refresh(context.Background(), %v): %v", v.ID, err)
+	}
+	if rf.Version != 2 || len(rf.Added)+len(rf.Removed)+len(rf.Changed) != 0 {
+		t.Errorf("vm.Refresh(context.Background(), %v): want version 2 with no changes, got %+v", v.ID, rf)
+	}
+}
+
+var reservedNameTests = []struct {
+	name string
+	path string
+	err  bool
+}{
+	{"DataLink", "..data", true},
+	{"BeneathDataLink", "..data/secret", true},
+	{"DataDirectory", "..1234/secret", true},
+	{"Escape", "../secret", true},
+	{"VersionFile", ".version", true},
+	{"JSONSecrets", "secrets.json", true},
+	{"Nested", "dir/.version", false},
+	{"Hidden", ".secret", false},
+}
+
+func TestManagerReservedNames(t *testing.T) {
+	for _, tt := range reservedNameTests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			v := &api.Volume{ID: "reserved", Source: api.TalosSecretSource}
+			sp := &mutableProducer{[]secrets.File{{Path: "secret", Data: []byte("1")}}}
+			vm := e.manager(t, secrets.Producers{api.TalosSecretSource: sp}, WriteJSONSecrets("secrets.json"))
+			if err := vm.Create(context.Background(), v); err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			}
+
+			sp.files = []secrets.File{{Path: tt.path, Data: []byte("2")}}
+			_, err := vm.Refresh(context.Background(), v.ID, api.KeyPair{})
+			if (err != nil) != tt.err {
+				t.Errorf("vm.Refresh(context.Background(), %v): want error %v, got %v", v.ID, tt.err, err)
+			}
+			if !tt.err {
+				return
+			}
+			p := path.Join(e.m.Path(v.ID), "secret")
+			if b, err := afero.ReadFile(e.fs, p); err != nil || string(b) != "1" {
+				t.Errorf("afero.ReadFile(%v): want existing secret 1, got %q (%v)", p, b, err)
+			}
+		})
+	}
+}
+
+var consumer = &api.Owner{UID: 1000, GID: 1000}
+
+var notifyPermitTests = []struct {
+	name    string
+	signals bool
+	n       *api.Notify
+	owner   *api.Owner
+	err     func(error) bool
+}{
+	{"NoTarget", false, nil, nil, nil},
+	{"SignalsNotPermitted", false, &api.Notify{PID: 1234}, consumer, isForbidden},
+	{"PID", true, &api.Notify{PID: 1234, Signal: "SIGUSR1"}, consumer, nil},
+	{"PIDWithoutOwner", true, &api.Notify{PID: 1234}, nil, isForbidden},
+	{"PIDOwnedByAnother", true, &api.Notify{PID: 4321}, consumer, isForbidden},
+	{"PIDNotFound", true, &api.Notify{PID: 5678}, consumer, isForbidden},
+	{"Cgroup", true, &api.Notify{Cgroup: "docker/cool"}, consumer, nil},
+	{"CgroupWithoutOwner", true, &api.Notify{Cgroup: "docker/cool"}, nil, isForbidden},
+	{"SignalNotPermitted", true, &api.Notify{PID: 1234, Signal: "SIGKILL"}, consumer, isForbidden},
+	{"Init", true, &api.Notify{PID: 1}, consumer, isForbidden},
+	{"Self", true, &api.Notify{PID: os.Getpid()}, consumer, isForbidden},
+	{"PIDAndCgroup", true, &api.Notify{PID: 1234, Cgroup: "docker/cool"}, consumer, isForbidden},
+	{"Nothing", true, &api.Notify{Signal: "SIGHUP"}, nil, isForbidden},
+}
+
+// writeProcessStatus writes a minimal process status file for the supplied
+// PID, owned by the supplied UID.
+func writeProcessStatus(t *testing.T, fs afero.Fs, pid, uid int) {
+	p := fmt.Sprintf("/proc/%d/status", pid)
+	s := fmt.Sprintf("Name:\tconsumer\nPid:\t%d\nUid:\t%d\t%d\t%d\t%d\n", pid, uid, uid, uid, uid)
+	if err := afero.WriteFile(fs, p, []byte(s), 0644); err != nil {
+		t.Fatalf("afero.WriteFile(%v): %v", p, err)
+	}
+}
+
+func isForbidden(err error) bool {
+	_, ok := errors.Cause(err).(ErrForbidden)
+	return ok
+}
+
+func TestManagerNotifyPermit(t *testing.T) {
+	for _, tt := range notifyPermitTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mo := []ManagerOption{OwnerRange(1000, 2000)}
+			if tt.signals {
+				mo = append(mo, NotifySignals("/cgroup"))
+			}
+			e := newTestEnv(t)
+			writeProcessStatus(t, e.fs, 1234, 1000)
+			writeProcessStatus(t, e.fs, 4321, 0)
+			writeProcessStatus(t, e.fs, os.Getpid(), 1000)
+			vm := e.manager(t, secrets.Producers{api.TalosSecretSource: filesProducer{}}, mo...)
+			v := &api.Volume{ID: "notify", Source: api.TalosSecretSource, Notify: tt.n, Owner: tt.owner}
+			err := vm.Create(context.Background(), v)
+			switch {
+			case tt.err == nil && err != nil:
+				t.Errorf("vm.Create(context.Background(), %v): %v", v.ID, err)
+			case tt.err != nil && !tt.err(err):
+				t.Errorf("vm.Create(context.Background(), %v): unexpected error %v", v.ID, err)
+			}
+		})
+	}
+}
+
+type signalled struct {
+	pid int
+	sig syscall.Signal
+}
+
+func TestManagerNotify(t *testing.T) {
+	e := newTestEnv(t)
+	af := &afero.Afero{Fs: e.fs}
+	af.WriteFile("/cgroup/docker/cool/cgroup.procs", []byte(fmt.Sprintf("1\n10\n11\n12\n%d\n", os.Getpid())), 0644)
+	writeProcessStatus(t, e.fs, 1, 1000)
+	writeProcessStatus(t, e.fs, 10, 1000)
+	writeProcessStatus(t, e.fs, 11, 1000)
+	writeProcessStatus(t, e.fs, 12, 0)
+	writeProcessStatus(t, e.fs, os.Getpid(), 1000)
+	writeProcessStatus(t, e.fs, 1234, 1000)
+
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	out := path.Join(dir, "hooked")
+
+	sp := &mutableProducer{[]secrets.File{{Path: "a", Data: []byte("1")}}}
+	vm := e.manager(t, secrets.Producers{api.TalosSecretSource: sp},
+		NotifySignals("/cgroup"),
+		OwnerRange(1000, 2000),
+		NotifyHook(5*time.Second, "/bin/sh", "-c", "cat >> "+out))
+	sig := make(chan signalled, 10)
+	vm.(*manager).kill = func(pid int, s syscall.Signal) error {
+		sig <- signalled{pid, s}
+		return nil
+	}
+
+	vols := []*api.Volume{
+		{ID: "pid", Source: api.TalosSecretSource, Owner: consumer, Notify: &api.Notify{PID: 1234, Signal: "SIGUSR1"}},
+		{ID: "cgroup", Source: api.TalosSecretSource, Owner: consumer, Notify: &api.Notify{Cgroup: "../../docker/cool"}},
+	}
+	for _, v := range vols {
+		if err := vm.Create(context.Background(), v); err != nil {
+			t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+		}
+		defer vm.Destroy(context.Background(), v.ID)
+	}
+
+	// Refreshing volumes whose secrets did not change does not notify.
+	for _, v := range vols {
+		if _, err := vm.Refresh(context.Background(), v.ID, api.KeyPair{}); err != nil {
+			t.Fatalf("vm.Refresh(context.Background(), %v): %v", v.ID, err)
+		}
+	}
+	sp.files = []secrets.File{{Path: "a", Data: []byte("2")}}
+	for _, v := range vols {
+		if _, err := vm.Refresh(context.Background(), v.ID, api.KeyPair{}); err != nil {
+			t.Fatalf("vm.Refresh(context.Background(), %v): %v", v.ID, err)
+		}
+	}
+
+	got := map[signalled]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case s := <-sig:
+			got[s] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("vm.Refresh(): want 3 signals, got %v", got)
+		}
+	}
+	want := map[signalled]bool{{1234, syscall.SIGUSR1}: true, {10, syscall.SIGHUP}: true, {11, syscall.SIGHUP}: true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("vm.Refresh(): want signals %v, got %v", want, got)
+	}
+
+	// PIDs are permitted again when they are signalled, in case they were
+	// reused by another process.
+	writeProcessStatus(t, e.fs, 1234, 0)
+	if err := vm.(*manager).signal(vols[0]); !isForbidden(err) {
+		t.Errorf("vm.signal(%v): want ErrForbidden for reused PID, got %v", vols[0].ID, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b, _ := ioutil.ReadFile(out)
+		if strings.Count(string(b), `"ID"`) == len(vols) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b, _ := ioutil.ReadFile(out)
+	t.Errorf("vm.Refresh(): want hook to run %v times, got output %s", len(vols), b)
+}
+
+func TestManagerNotifyHookTimeout(t *testing.T) {
+	e := newTestEnv(t)
+	// The hook exits immediately, but leaves a child holding its output open.
+	vm := e.manager(t, secrets.Producers{}, NotifyHook(100*time.Millisecond, "/bin/sh", "-c", "sleep 30 & head -c 10000 /dev/zero"))
+	v := &api.Volume{ID: "hooked", Source: api.TalosSecretSource}
+
+	start := time.Now()
+	err := vm.(*manager).runHook(v)
+	if errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("vm.runHook(%v): want context.DeadlineExceeded, got %v", v.ID, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("vm.runHook(%v): want hook killed after timeout, ran for %v", v.ID, d)
+	}
+	if err != nil && len(err.Error()) > maxHookOutput+100 {
+		t.Errorf("vm.runHook(%v): want output limited to %v bytes, got %v byte error", v.ID, maxHookOutput, len(err.Error()))
+	}
+}
+
+// A keyPairProducer records the KeyPair of each volume it produces secrets for.
+type keyPairProducer struct {
+	mx  sync.Mutex
+	kps []api.KeyPair
+}
+
+func (sp *keyPairProducer) For(_ context.Context, v *api.Volume) (api.Secrets, error) {
+	sp.mx.Lock()
+	defer sp.mx.Unlock()
+	sp.kps = append(sp.kps, v.KeyPair)
+	return secrets.NewFiles(v, secrets.File{Path: "secret", Data: []byte(v.KeyPair.Certificate)}), nil
+}
+
+var (
+	kpA = api.KeyPair{Certificate: "a", PrivateKey: "a"}
+	kpB = api.KeyPair{Certificate: "b", PrivateKey: "b"}
+)
+
+var retainTests = []struct {
+	name   string
+	retain bool
+	want   []api.KeyPair
+}{
+	{"Retained", true, []api.KeyPair{kpA, kpA, kpB, kpB, {}, {}}},
+	{"NotRetained", false, []api.KeyPair{kpA, {}, kpB, {}, {}, {}}},
+}
+
+func TestManagerRetainCredentials(t *testing.T) {
+	for _, tt := range retainTests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := &keyPairProducer{}
+			mo := []ManagerOption{}
+			if tt.retain {
+				mo = append(mo, RetainCredentials(64))
+			}
+			vm := newTestEnv(t).manager(t, secrets.Producers{api.TalosSecretSource: sp}, mo...)
+
+			id := "retained"
+			if err := vm.Create(context.Background(), &api.Volume{ID: id, Source: api.TalosSecretSource, KeyPair: kpA}); err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", id, err)
+			}
+			vm.Refresh(context.Background(), id, api.KeyPair{})
+			vm.Update(context.Background(), &api.Volume{ID: id, KeyPair: kpB})
+			vm.Refresh(context.Background(), id, api.KeyPair{})
+
+			// Destroying a volume forgets its credentials.
+			if err := vm.Destroy(context.Background(), id); err != nil {
+				t.Fatalf("vm.Destroy(context.Background(), %v): %v", id, err)
+			}
+			if err := vm.Create(context.Background(), &api.Volume{ID: id, Source: api.TalosSecretSource}); err != nil {
+				t.Fatalf("vm.Create(context.Background(), %v): %v", id, err)
+			}
+			vm.Refresh(context.Background(), id, api.KeyPair{})
+			defer vm.Destroy(context.Background(), id)
+
+			if !reflect.DeepEqual(sp.kps, tt.want) {
+				t.Errorf("sp.For(): want KeyPairs %v, got %v", tt.want, sp.kps)
+			}
+		})
+	}
+}
+
+func TestManagerRetainCredentialsExhausted(t *testing.T) {
+	e := newTestEnv(t)
+	vm := e.manager(t, secrets.Producers{api.TalosSecretSource: &keyPairProducer{}}, RetainCredentials(1))
+	big := api.KeyPair{Certificate: api.PEM(strings.Repeat("c", 1024)), PrivateKey: "k"}
+
+	v := &api.Volume{ID: "exhausted", Source: api.TalosSecretSource, KeyPair: big}
+	if err := vm.Create(context.Background(), v); !isInsufficientCapacity(err) {
+		t.Errorf("vm.Create(context.Background(), %v): want ErrInsufficientCapacity, got %v", v.ID, err)
+	}
+	if got, err := vm.Get(v.ID); !isNonExist(err) {
+		t.Errorf("vm.Get(%v): want ErrNonExist, got %+v (%v)", v.ID, got, err)
+	}
+
+	v = &api.Volume{ID: "retained", Source: api.TalosSecretSource, KeyPair: kpA}
+	if err := vm.Create(context.Background(), v); err != nil {
+		t.Fatalf("vm.Create(context.Background(), %v): %v", v.ID, err)
+	}
+	defer vm.Destroy(context.Background(), v.ID)
+	if _, err := vm.Refresh(context.Background(), v.ID, big); !isInsufficientCapacity(err) {
+		t.Errorf("vm.Refresh(context.Background(), %v): want ErrInsufficientCapacity, got %v", v.ID, err)
+	}
+}
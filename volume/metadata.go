@@ -0,0 +1,112 @@
+package volume
+
+import (
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/uber-go/zap"
+
+	"github.com/negz/secret-volume/api"
+)
+
+// A MetadataStore stores the metadata of secret volumes, i.e. their ID, source,
+// and tags, outside of the volumes themselves.
+type MetadataStore interface {
+	// Put stores the metadata of the supplied volume, replacing any existing
+	// metadata for a volume with the same ID.
+	Put(v *api.Volume) error
+	// Get returns the metadata of the volume specified by id. It returns
+	// ErrNonExist if no such metadata exists.
+	Get(id string) (*api.Volume, error)
+	// Delete deletes the metadata of the volume specified by id. Deleting
+	// metadata that does not exist is not an error.
+	Delete(id string) error
+	// Close closes the MetadataStore.
+	Close() error
+}
+
+type dirMetadataStore struct {
+	dir   string
+	fs    afero.Fs
+	dmode os.FileMode
+	fmode os.FileMode
+}
+
+// A DirMetadataStoreOption represents an argument to NewDirMetadataStore.
+type DirMetadataStoreOption func(*dirMetadataStore) error
+
+// DirMetadataFilesystem allows a dir MetadataStore to be backed by any
+// filesystem implementation supported by https://github.com/spf13/afero. The OS
+// filesystem is used by default.
+func DirMetadataFilesystem(fs afero.Fs) DirMetadataStoreOption {
+	return func(ms *dirMetadataStore) error {
+		ms.fs = fs
+		return nil
+	}
+}
+
+// NewDirMetadataStore creates a MetadataStore that stores the metadata of each
+// volume as a JSON file in the supplied directory. The directory is created if
+// it does not exist.
+func NewDirMetadataStore(dir string, mso ...DirMetadataStoreOption) (MetadataStore, error) {
+	ms := &dirMetadataStore{dir, afero.NewOsFs(), 0700, 0600}
+	for _, o := range mso {
+		if err := o(ms); err != nil {
+			return nil, errors.Wrap(err, "cannot apply dir metadata store option")
+		}
+	}
+	return ms, nil
+}
+
+func (ms *dirMetadataStore) path(id string) string {
+	return path.Join(ms.dir, id+".json")
+}
+
+// Put atomically replaces any existing metadata by writing to a temporary file,
+// then renaming it.
+func (ms *dirMetadataStore) Put(v *api.Volume) error {
+	log.Debug("storing metadata", zap.String("id", v.ID), zap.String("dir", ms.dir))
+	if err := ms.fs.MkdirAll(ms.dir, ms.dmode); err != nil {
+		return errors.Wrap(err, "cannot create metadata directory")
+	}
+	tmp := path.Join(ms.dir, "."+v.ID+".tmp")
+	f, err := ms.fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, ms.fmode)
+	if err != nil {
+		return errors.Wrap(err, "cannot open temporary metadata file")
+	}
+	if err := v.WriteJSON(f); err != nil {
+		f.Close()
+		return errors.Wrap(err, "cannot write to temporary metadata file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "cannot close temporary metadata file")
+	}
+	return errors.Wrap(ms.fs.Rename(tmp, ms.path(v.ID)), "cannot replace metadata file")
+}
+
+func (ms *dirMetadataStore) Get(id string) (*api.Volume, error) {
+	f, err := ms.fs.Open(ms.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNonExist("metadata not found")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open metadata file")
+	}
+	defer f.Close()
+	v, err := api.ReadVolumeJSON(f)
+	return v, errors.Wrap(err, "cannot read from metadata file")
+}
+
+func (ms *dirMetadataStore) Delete(id string) error {
+	log.Debug("deleting metadata", zap.String("id", id), zap.String("dir", ms.dir))
+	if err := ms.fs.Remove(ms.path(id)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot remove metadata file")
+	}
+	return nil
+}
+
+func (ms *dirMetadataStore) Close() error {
+	return nil
+}
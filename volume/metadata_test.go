@@ -0,0 +1,67 @@
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+
+	"github.com/negz/secret-volume/fixtures"
+)
+
+func TestMetadataStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dms, _ := NewDirMetadataStore("/metadata", DirMetadataFilesystem(afero.NewMemMapFs()))
+	bms, err := NewBoltMetadataStore(path.Join(dir, "metadata.db"))
+	if err != nil {
+		t.Fatalf("NewBoltMetadataStore(): %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		ms   MetadataStore
+	}{
+		{"Dir", dms},
+		{"Bolt", bms},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.ms.Close()
+			v := fixtures.TestVolume
+
+			if _, err := tt.ms.Get(v.ID); !isNonExist(err) {
+				t.Errorf("ms.Get(%v): want ErrNonExist, got %v", v.ID, err)
+			}
+			if err := tt.ms.Put(v); err != nil {
+				t.Fatalf("ms.Put(%v): %v", v.ID, err)
+			}
+			// Putting a volume again replaces its metadata.
+			if err := tt.ms.Put(v); err != nil {
+				t.Fatalf("ms.Put(%v): %v", v.ID, err)
+			}
+			got, err := tt.ms.Get(v.ID)
+			if err != nil {
+				t.Fatalf("ms.Get(%v): %v", v.ID, err)
+			}
+			if !reflect.DeepEqual(got, v) {
+				t.Errorf("ms.Get(%v): want %v, got %v", v.ID, v, got)
+			}
+			if err := tt.ms.Delete(v.ID); err != nil {
+				t.Errorf("ms.Delete(%v): %v", v.ID, err)
+			}
+			if _, err := tt.ms.Get(v.ID); !isNonExist(err) {
+				t.Errorf("ms.Get(%v): want ErrNonExist after delete, got %v", v.ID, err)
+			}
+			if err := tt.ms.Delete(v.ID); err != nil {
+				t.Errorf("ms.Delete(%v): want no error deleting missing metadata, got %v", v.ID, err)
+			}
+		})
+	}
+}
@@ -8,6 +8,15 @@ type Mounter interface {
 	Mount(*api.Volume) error
 	// Unmount unmounts the secret volume specified by id.
 	Unmount(id string) error
+	// ReadOnly remounts the secret volume specified by id read-only, such that
+	// its consumers cannot modify their secrets.
+	ReadOnly(id string) error
+	// Writable remounts the secret volume specified by id read-write, such
+	// that its secrets may be updated.
+	Writable(id string) error
+	// Mounted returns true if the secret volume specified by id is actually
+	// mounted.
+	Mounted(id string) (bool, error)
 	// Path is a convenience function that returns the (theoretical) mountpoint
 	// of the secret volume specified by id. Note that it does not guarantee a
 	// volume with that id is currently or has ever been mounted.
@@ -16,3 +25,42 @@ type Mounter interface {
 	// Mounter.
 	Root() string
 }
+
+// ErrBusy is returned by a Mounter when a volume cannot be unmounted because it
+// is in use, i.e. because a process holds files in the volume open.
+type ErrBusy string
+
+func (e ErrBusy) Error() string {
+	return string(e)
+}
+
+// A LazyUnmounter Mounter can detach a busy volume, making it inaccessible to
+// new processes immediately and releasing it once it is no longer in use.
+type LazyUnmounter interface {
+	// LazyUnmount lazily unmounts the secret volume specified by id.
+	LazyUnmount(id string) error
+}
+
+// A MountLister Mounter can determine which of its secret volumes are mounted
+// all at once, more cheaply than determining whether each is mounted in turn.
+type MountLister interface {
+	// MountedIDs returns the set of IDs of the secret volumes that are
+	// actually mounted.
+	MountedIDs() (map[string]bool, error)
+}
+
+// A Statfser Mounter can report the bytes used by and size of the filesystems
+// it mounts.
+type Statfser interface {
+	// Statfs returns the bytes used by and size of the filesystem mounted for
+	// the supplied volume ID.
+	Statfs(id string) (used, size int64, err error)
+}
+
+// A Wiper Mounter stores secrets such that their contents may persist after
+// they are removed, i.e. on disk, unless they are overwritten first.
+type Wiper interface {
+	// Wipe calls fn, which removes or replaces the file at the supplied path,
+	// then overwrites the former contents of the file.
+	Wipe(p string, fn func() error) error
+}
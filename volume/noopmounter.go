@@ -28,6 +28,21 @@ func (m *noopMounter) Unmount(id string) error {
 	return nil
 }
 
+func (m *noopMounter) ReadOnly(id string) error {
+	log.Debug("remount", zap.String("path", m.Path(id)), zap.Bool("readonly", true))
+	return nil
+}
+
+func (m *noopMounter) Writable(id string) error {
+	log.Debug("remount", zap.String("path", m.Path(id)), zap.Bool("readonly", false))
+	return nil
+}
+
+// Mounted always returns true, as the noop Mounter never really mounts.
+func (m *noopMounter) Mounted(id string) (bool, error) {
+	return true, nil
+}
+
 func (m *noopMounter) Path(id string) string {
 	return path.Join(m.root, id)
 }
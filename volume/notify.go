@@ -0,0 +1,247 @@
+package volume
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uber-go/zap"
+
+	"github.com/negz/secret-volume/api"
+	"github.com/negz/secret-volume/secrets"
+)
+
+// maxHookOutput is the maximum number of bytes of a notification hook's output
+// that will be logged.
+const maxHookOutput = 4096
+
+// signals are the signals volumes may request be sent to their consumers when
+// their secrets change.
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// requestedSignal returns the signal requested by the supplied notification
+// target. It defaults to SIGHUP.
+func requestedSignal(n *api.Notify) (syscall.Signal, error) {
+	if n.Signal == "" {
+		return syscall.SIGHUP, nil
+	}
+	s, ok := signals[n.Signal]
+	if !ok {
+		return 0, ErrForbidden(fmt.Sprintf("signal %v is not permitted", n.Signal))
+	}
+	return s, nil
+}
+
+// permitNotify ensures volumes only request notification when the Manager is
+// configured to send signals, and that they request a permitted signal and a
+// valid target. Only volumes with an owner may request notification, and PID
+// targets must be owned by that owner.
+func (sm *manager) permitNotify(n *api.Notify, o *api.Owner) error {
+	if n == nil {
+		return nil
+	}
+	if sm.cgroups == "" {
+		return ErrForbidden("signalling consumers is not permitted")
+	}
+	if _, err := requestedSignal(n); err != nil {
+		return err
+	}
+	switch {
+	case n.PID != 0 && n.Cgroup != "":
+		return ErrForbidden("cannot signal both a PID and a cgroup")
+	case n.PID == 0 && n.Cgroup == "":
+		return ErrForbidden("no PID or cgroup to signal")
+	case n.PID != 0:
+		return sm.permitPID(n.PID, o)
+	case o == nil:
+		return ErrForbidden("only volumes with an owner may signal a cgroup")
+	}
+	return nil
+}
+
+// permitPID ensures the supplied PID may be signalled on behalf of a volume
+// with the supplied owner. Only processes whose real UID is that of the
+// volume's owner may be signalled, so that volumes cannot be used to signal
+// arbitrary processes on the host. Neither init nor the Manager's own process
+// may be signalled.
+func (sm *manager) permitPID(pid int, o *api.Owner) error {
+	if pid <= 1 || pid == os.Getpid() {
+		return ErrForbidden(fmt.Sprintf("PID %v is not permitted", pid))
+	}
+	if o == nil {
+		return ErrForbidden("only volumes with an owner may signal a PID")
+	}
+	uid, err := sm.processUID(pid)
+	if err != nil {
+		return ErrForbidden(fmt.Sprintf("cannot determine owner of PID %v: %v", pid, err))
+	}
+	if uid != o.UID {
+		return ErrForbidden(fmt.Sprintf("PID %v is not owned by UID %v", pid, o.UID))
+	}
+	return nil
+}
+
+// processUID returns the real UID of the process with the supplied PID.
+func (sm *manager) processUID(pid int) (int, error) {
+	p := path.Join(sm.proc, strconv.Itoa(pid), "status")
+	f, err := sm.fs.Open(p)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot open process status")
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Uid:	real	effective	saved	filesystem
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "Uid:" {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[1])
+		return uid, errors.Wrap(err, "cannot parse UID")
+	}
+	if err := s.Err(); err != nil {
+		return 0, errors.Wrap(err, "cannot read process status")
+	}
+	return 0, errors.New("process status has no UID")
+}
+
+// notify notifies the consumers of the supplied volume that its secrets
+// changed, by signalling the volume's notification target and running the
+// notification hook if either are configured. Consumers are notified in the
+// background; the results are logged.
+func (sm *manager) notify(v *api.Volume) {
+	if v.Notify == nil && len(sm.hook) == 0 {
+		return
+	}
+	cv := *v
+	go func() {
+		if cv.Notify != nil {
+			if err := sm.signal(&cv); err != nil {
+				log.Error("cannot signal volume consumers", zap.String("id", cv.ID), zap.Error(err))
+			}
+		}
+		if len(sm.hook) > 0 {
+			if err := sm.runHook(&cv); err != nil {
+				log.Error("notification hook failed", zap.String("id", cv.ID), zap.Error(err))
+			}
+		}
+	}()
+}
+
+// signal sends the requested signal to the supplied volume's notification
+// target. Each process is permitted as per permitPID immediately before it is
+// signalled, in case it exited and its PID was reused. Processes in the target
+// cgroup that are not permitted are skipped.
+func (sm *manager) signal(v *api.Volume) error {
+	s, err := requestedSignal(v.Notify)
+	if err != nil {
+		return err
+	}
+	pids := []int{v.Notify.PID}
+	if v.Notify.Cgroup != "" {
+		if pids, err = sm.cgroupPIDs(v.Notify.Cgroup); err != nil {
+			return errors.Wrapf(err, "cannot list processes in cgroup %v", v.Notify.Cgroup)
+		}
+	}
+	for _, pid := range pids {
+		if err := sm.permitPID(pid, v.Owner); err != nil {
+			if v.Notify.Cgroup == "" {
+				return errors.Wrapf(err, "cannot signal PID %v", pid)
+			}
+			log.Warn("not signalling forbidden volume consumer", zap.String("id", v.ID), zap.Int("pid", pid), zap.Error(err))
+			continue
+		}
+		if err := sm.kill(pid, s); err != nil {
+			return errors.Wrapf(err, "cannot send %v to PID %v", s, pid)
+		}
+		log.Info("signalled volume consumer", zap.String("id", v.ID), zap.Int("pid", pid), zap.String("signal", s.String()))
+	}
+	return nil
+}
+
+// cgroupPIDs returns the PIDs of the processes in the supplied cgroup.
+func (sm *manager) cgroupPIDs(cgroup string) ([]int, error) {
+	// Cleaning the cgroup relative to / ensures it cannot escape the root.
+	p := path.Join(sm.cgroups, path.Clean("/"+cgroup), "cgroup.procs")
+	f, err := sm.fs.Open(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open cgroup processes")
+	}
+	defer f.Close()
+	pids := []int{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		pid, err := strconv.Atoi(strings.TrimSpace(s.Text()))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse PID")
+		}
+		pids = append(pids, pid)
+	}
+	return pids, errors.Wrap(s.Err(), "cannot read cgroup processes")
+}
+
+// runHook runs the notification hook for the supplied volume. The hook is
+// passed the JSON encoded volume on stdin, and the volume's ID and path via the
+// SECRET_VOLUME_ID and SECRET_VOLUME_PATH environment variables. The hook's
+// process group is killed if it does not complete within the hook timeout.
+func (sm *manager) runHook(v *api.Volume) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sm.hookTimeout)
+	defer cancel()
+
+	stdin := &bytes.Buffer{}
+	if err := v.WriteJSON(stdin); err != nil {
+		return errors.Wrap(err, "cannot encode volume for hook")
+	}
+	out := &secrets.LimitedBuffer{Limit: maxHookOutput}
+	c := exec.CommandContext(ctx, sm.hook[0], sm.hook[1:]...)
+	c.Stdin = stdin
+	c.Stdout = out
+	c.Stderr = out
+	c.Env = append(os.Environ(), "SECRET_VOLUME_ID="+v.ID, "SECRET_VOLUME_PATH="+sm.m.Path(v.ID))
+	// The hook runs in its own process group so that signals sent to the
+	// Manager's process group, for example by a terminal, are not sent to it,
+	// and so that any children it starts in the background, which may hold its
+	// output open, are killed with it.
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		return errors.Wrapf(err, "cannot start hook %v", sm.hook[0])
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err := c.Wait()
+	close(done)
+	o := out.Bytes()
+	if ctx.Err() != nil {
+		return errors.Wrapf(ctx.Err(), "hook %v did not complete: %s", sm.hook[0], o)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "hook %v failed: %s", sm.hook[0], o)
+	}
+	log.Info("ran notification hook",
+		zap.String("id", v.ID),
+		zap.String("hook", sm.hook[0]),
+		zap.Duration("duration", time.Since(start)),
+		zap.String("output", string(o)))
+	return nil
+}
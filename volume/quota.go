@@ -0,0 +1,109 @@
+package volume
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+
+	"github.com/negz/secret-volume/api"
+)
+
+// ErrTooLarge is returned when writing secrets would cause a volume to exceed
+// its maximum size.
+type ErrTooLarge string
+
+func (e ErrTooLarge) Error() string {
+	return string(e)
+}
+
+// An Unbounded Mounter mounts filesystems that do not enforce a maximum size,
+// for example ramfs. The Manager enforces the size of their volumes instead.
+type Unbounded interface {
+	// Unbounded marks a Mounter as unbounded.
+	Unbounded()
+}
+
+// A quota tracks the number of bytes that may still be written to a volume.
+// A nil quota is unlimited.
+type quota struct {
+	remaining int64
+}
+
+// writer returns an io.Writer that fails with ErrTooLarge once the quota is
+// exhausted.
+func (q *quota) writer(w io.Writer) io.Writer {
+	if q == nil {
+		return w
+	}
+	return &quotaWriter{w, q}
+}
+
+// free returns the supplied number of bytes to the quota, i.e. because a file
+// is being replaced.
+func (q *quota) free(b int64) {
+	if q == nil {
+		return
+	}
+	q.remaining += b
+}
+
+type quotaWriter struct {
+	w io.Writer
+	q *quota
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.q.remaining {
+		return 0, ErrTooLarge("volume size limit exceeded")
+	}
+	n, err := w.w.Write(p)
+	w.q.remaining -= int64(n)
+	return n, err
+}
+
+// usage returns the number of files beneath the supplied path, the number of
+// bytes they use, and when the most recently modified of them was modified.
+func usage(fs afero.Fs, p string) (*api.Usage, error) {
+	u := &api.Usage{}
+	err := afero.Walk(fs, p, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !fi.Mode().IsRegular() {
+			return nil
+		}
+		u.Files++
+		u.UsedBytes += fi.Size()
+		if fi.ModTime().After(u.Modified) {
+			u.Modified = fi.ModTime()
+		}
+		return nil
+	})
+	return u, errors.Wrapf(err, "cannot determine usage of %v", p)
+}
+
+// newQuota returns a quota for a new volume, or nil if the Mounter enforces its
+// own size limit.
+func (sm *manager) newQuota(v *api.Volume) *quota {
+	if _, ok := sm.m.(Unbounded); !ok {
+		return nil
+	}
+	return &quota{sm.allocated(v)}
+}
+
+// existingQuota returns a quota for an existing volume, or nil if the Mounter
+// enforces its own size limit.
+func (sm *manager) existingQuota(v *api.Volume) (*quota, error) {
+	q := sm.newQuota(v)
+	if q == nil {
+		return nil, nil
+	}
+	u, err := usage(sm.fs, sm.m.Path(v.ID))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot determine volume usage")
+	}
+	q.remaining -= u.UsedBytes
+	return q, nil
+}
@@ -3,8 +3,14 @@
 package volume
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/negz/secret-volume/api"
 	"github.com/pkg/errors"
@@ -15,34 +21,15 @@ import (
 
 type tmpFsMounter struct {
 	root   string
-	max    uint
-	mode   uint32
 	mflags uintptr
 	uflags int
+	noswap bool
+	fstype string
 }
 
 // A TmpFsMounterOption represents an argument to NewTmpFsMounter.
 type TmpFsMounterOption func(*tmpFsMounter) error
 
-// MountpointMode specifies the octal permissions with which all mounts will be
-// mounted. It corresponds to the mode= tmpfs option and defaults to 700.
-func MountpointMode(md uint32) TmpFsMounterOption {
-	return func(m *tmpFsMounter) error {
-		m.mode = md
-		return nil
-	}
-}
-
-// MaxSizeMB specifies the maximum size in megabytes each secret volume will be
-// allowed to grow to. It corresponds to the size= tmpfs option and defaults to
-// 100MB.
-func MaxSizeMB(mb uint) TmpFsMounterOption {
-	return func(m *tmpFsMounter) error {
-		m.max = mb
-		return nil
-	}
-}
-
 // MountFlags specifies the mount flags for each secret volume. It defaults to
 // MS_NOSUID, MS_NODEV, and MS_NOEXEC.
 func MountFlags(flags uintptr) TmpFsMounterOption {
@@ -61,11 +48,21 @@ func UnmountFlags(flags int) TmpFsMounterOption {
 	}
 }
 
+// NoSwap prevents the pages of each secret volume being swapped to disk. It
+// corresponds to the noswap tmpfs option, which requires Linux 6.4 or later.
+// See NoSwapSupported.
+func NoSwap() TmpFsMounterOption {
+	return func(m *tmpFsMounter) error {
+		m.noswap = true
+		return nil
+	}
+}
+
 // NewTmpFsMounter creates a Mounter that mounts a tmpfs (i.e. in-memory) volume
 // in which to store secrets. This Mounter is only supported on Linux and as
 // such is only built when GOOS=linux.
 func NewTmpFsMounter(root string, mo ...TmpFsMounterOption) (Mounter, error) {
-	m := &tmpFsMounter{root, 100, 700, unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, 0}
+	m := &tmpFsMounter{root, unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, 0, false, "tmpfs"}
 	for _, o := range mo {
 		if err := o(m); err != nil {
 			return nil, errors.Wrap(err, "cannot apply tmpfs mounter option")
@@ -82,17 +79,225 @@ func (m *tmpFsMounter) Root() string {
 	return m.root
 }
 
-func (m *tmpFsMounter) flags() string {
-	return fmt.Sprintf("size=%vM,mode=%v", m.max, int(m.mode))
+// flags returns the mount options for the supplied volume, whose size and
+// mountpoint mode are resolved by the Manager.
+func (m *tmpFsMounter) flags(v *api.Volume) string {
+	mode := uint32(0700)
+	if v.Modes != nil && v.Modes.Mountpoint != 0 {
+		mode = uint32(v.Modes.Mountpoint)
+	}
+	f := fmt.Sprintf("mode=%o", mode) + ownerFlags(v.Owner)
+	if m.fstype == "ramfs" {
+		// ramfs supports neither size limits nor swap.
+		return f
+	}
+	f = fmt.Sprintf("size=%vM,", v.SizeMB) + f
+	if m.noswap {
+		f += ",noswap"
+	}
+	return f
+}
+
+// ownerFlags returns the mount options that set the owner of a volume's root.
+func ownerFlags(o *api.Owner) string {
+	if o == nil {
+		return ""
+	}
+	return fmt.Sprintf(",uid=%v,gid=%v", o.UID, o.GID)
 }
 
 func (m *tmpFsMounter) Mount(v *api.Volume) error {
-	f := m.flags()
-	log.Debug("mount", zap.String("path", m.Path(v.ID)), zap.String("flags", f))
-	return errors.Wrap(unix.Mount("tmpfs", m.Path(v.ID), "tmpfs", m.mflags, f), "cannot mount tmpfs volume")
+	f := m.flags(v)
+	log.Debug("mount", zap.String("path", m.Path(v.ID)), zap.String("type", m.fstype), zap.String("flags", f))
+	return errors.Wrapf(unix.Mount(m.fstype, m.Path(v.ID), m.fstype, m.mflags, f), "cannot mount %v volume", m.fstype)
+}
+
+// remount remounts the volume with the supplied flags. No mount options are
+// supplied, leaving the volume's size, mode, and owner unchanged.
+func (m *tmpFsMounter) remount(id string, flags uintptr) error {
+	log.Debug("remount", zap.String("path", m.Path(id)), zap.Bool("readonly", flags&unix.MS_RDONLY != 0))
+	return errors.Wrapf(unix.Mount(m.fstype, m.Path(id), m.fstype, m.mflags|unix.MS_REMOUNT|flags, ""), "cannot remount %v volume", m.fstype)
+}
+
+func (m *tmpFsMounter) ReadOnly(id string) error {
+	return m.remount(id, unix.MS_RDONLY)
+}
+
+func (m *tmpFsMounter) Writable(id string) error {
+	return m.remount(id, 0)
+}
+
+func (m *tmpFsMounter) unmount(id string, flags int) error {
+	log.Debug("unmount", zap.String("path", m.Path(id)), zap.Bool("lazy", flags&unix.MNT_DETACH != 0))
+	err := unix.Unmount(m.Path(id), flags)
+	if err == unix.EBUSY {
+		return ErrBusy(fmt.Sprintf("%v volume is busy", m.fstype))
+	}
+	return errors.Wrapf(err, "cannot unmount %v volume", m.fstype)
 }
 
 func (m *tmpFsMounter) Unmount(id string) error {
-	log.Debug("unmount", zap.String("path", m.Path(id)))
-	return errors.Wrap(unix.Unmount(m.Path(id), m.uflags), "cannot unmount tmpfs volume")
+	return m.unmount(id, m.uflags)
+}
+
+func (m *tmpFsMounter) LazyUnmount(id string) error {
+	return m.unmount(id, m.uflags|unix.MNT_DETACH)
+}
+
+func (m *tmpFsMounter) Statfs(id string) (int64, int64, error) {
+	s := &unix.Statfs_t{}
+	if err := unix.Statfs(m.Path(id), s); err != nil {
+		return 0, 0, errors.Wrapf(err, "cannot statfs %v volume", m.fstype)
+	}
+	bs := int64(s.Bsize)
+	return int64(s.Blocks-s.Bfree) * bs, int64(s.Blocks) * bs, nil
+}
+
+// MountInfo is the file from which mount state is read.
+const MountInfo = "/proc/self/mountinfo"
+
+func (m *tmpFsMounter) Mounted(id string) (bool, error) {
+	f, err := os.Open(MountInfo)
+	if err != nil {
+		return false, errors.Wrapf(err, "cannot open %v", MountInfo)
+	}
+	defer f.Close()
+	ok, err := mounted(f, m.Path(id), m.fstype)
+	return ok, errors.Wrapf(err, "cannot read %v", MountInfo)
+}
+
+// MountedIDs reads mountinfo once, rather than once per volume.
+func (m *tmpFsMounter) MountedIDs() (map[string]bool, error) {
+	f, err := os.Open(MountInfo)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open %v", MountInfo)
+	}
+	defer f.Close()
+	ps, err := mountpoints(f, m.fstype)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %v", MountInfo)
+	}
+	ids := make(map[string]bool)
+	for p := range ps {
+		if path.Dir(p) == path.Clean(m.root) {
+			ids[path.Base(p)] = true
+		}
+	}
+	return ids, nil
+}
+
+// mounted returns true if a filesystem of the supplied type is mounted at the
+// supplied path, per the supplied mountinfo file. See proc(5).
+func mounted(r io.Reader, p, fstype string) (bool, error) {
+	ps, err := mountpoints(r, fstype)
+	return ps[p], err
+}
+
+// mountpoints returns the set of paths at which filesystems of the supplied
+// type are mounted, per the supplied mountinfo file. See proc(5).
+func mountpoints(r io.Reader, fstype string) (map[string]bool, error) {
+	ps := make(map[string]bool)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		// A variable number of optional fields precedes the separator.
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		if fields[sep+1] == fstype {
+			ps[unescapeMountInfo(fields[4])] = true
+		}
+	}
+	return ps, s.Err()
+}
+
+// unescapeMountInfo replaces the octal escape sequences used for whitespace and
+// backslashes in mountinfo, i.e. \040, with the characters they represent.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(c))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+type ramFsMounter struct {
+	*tmpFsMounter
+}
+
+// NewRamFsMounter creates a Mounter that mounts a ramfs volume in which to
+// store secrets. Unlike tmpfs, ramfs pages are never swapped to disk. ramfs
+// does not enforce a size limit, so the Manager enforces each volume's size
+// instead. It accepts the same options as NewTmpFsMounter, except NoSwap which
+// is implied. This Mounter is only supported on Linux and as such is only built
+// when GOOS=linux.
+func NewRamFsMounter(root string, mo ...TmpFsMounterOption) (Mounter, error) {
+	m := &tmpFsMounter{root, unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, 0, false, "ramfs"}
+	for _, o := range mo {
+		if err := o(m); err != nil {
+			return nil, errors.Wrap(err, "cannot apply ramfs mounter option")
+		}
+	}
+	return &ramFsMounter{m}, nil
+}
+
+func (m *ramFsMounter) Unbounded() {}
+
+// NoSwapSupported determines whether the running kernel supports the noswap
+// tmpfs option by attempting to mount (and then unmount) a tmpfs with said
+// option at a temporary directory. The directory is created in the system
+// temporary directory rather than beneath the root of any Mounter, where it
+// would be mistaken for a volume.
+func NoSwapSupported() (bool, error) {
+	d, err := ioutil.TempDir("", "secret-volume-noswap")
+	if err != nil {
+		return false, errors.Wrap(err, "cannot create temporary directory")
+	}
+	defer os.Remove(d)
+	if err := unix.Mount("tmpfs", d, "tmpfs", 0, "size=1M,noswap"); err != nil {
+		if err == unix.EINVAL {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "cannot mount tmpfs with noswap")
+	}
+	return true, errors.Wrap(unix.Unmount(d, 0), "cannot unmount tmpfs with noswap")
+}
+
+// Filesystem magic numbers per statfs(2).
+const (
+	tmpFsMagic = 0x01021994
+	ramFsMagic = 0x858458f6
+)
+
+// MemoryBacked determines whether the supplied path resides on a tmpfs or ramfs
+// filesystem, i.e. whether files written beneath it avoid persistent storage.
+func MemoryBacked(p string) (bool, error) {
+	s := &unix.Statfs_t{}
+	if err := unix.Statfs(p, s); err != nil {
+		return false, errors.Wrapf(err, "cannot statfs %v", p)
+	}
+	// The width and signedness of Type varies by architecture.
+	t := uint32(s.Type)
+	return t == tmpFsMagic || t == ramFsMagic, nil
 }
@@ -0,0 +1,52 @@
+// +build linux
+
+package volume
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+36 22 0:32 / /secrets/one rw,nosuid,nodev,noexec,relatime shared:20 - tmpfs tmpfs rw,size=102400k,mode=700
+37 22 0:33 / /secrets/with\040space rw,nosuid,nodev,noexec,relatime - tmpfs tmpfs rw,size=102400k,mode=700
+38 22 0:34 / /secrets/ram rw,relatime - ramfs ramfs rw,mode=700
+`
+
+var mountedTests = []struct {
+	path   string
+	fstype string
+	want   bool
+}{
+	{"/secrets/one", "tmpfs", true},
+	{"/secrets/with space", "tmpfs", true},
+	{"/secrets/ram", "ramfs", true},
+	{"/secrets/ram", "tmpfs", false},
+	{"/secrets/two", "tmpfs", false},
+	{"/secrets", "tmpfs", false},
+}
+
+func TestMounted(t *testing.T) {
+	for _, tt := range mountedTests {
+		got, err := mounted(strings.NewReader(testMountInfo), tt.path, tt.fstype)
+		if err != nil {
+			t.Errorf("mounted(%v, %v): %v", tt.path, tt.fstype, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("mounted(%v, %v): want %v, got %v", tt.path, tt.fstype, tt.want, got)
+		}
+	}
+}
+
+func TestMountpoints(t *testing.T) {
+	want := map[string]bool{"/secrets/one": true, "/secrets/with space": true}
+	got, err := mountpoints(strings.NewReader(testMountInfo), "tmpfs")
+	if err != nil {
+		t.Fatalf("mountpoints(%v): %v", "tmpfs", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mountpoints(%v): want %v, got %v", "tmpfs", want, got)
+	}
+}
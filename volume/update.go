@@ -0,0 +1,526 @@
+package volume
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/uber-go/zap"
+
+	"github.com/negz/secret-volume/api"
+	"github.com/negz/secret-volume/secrets"
+)
+
+// dataLink is the symbolic link at the root of a volume that points to the
+// hidden directory containing its secrets, on filesystems that support symbolic
+// links. Each file and directory at the root of the volume is a symbolic link
+// through dataLink, so that all of the volume's secrets are replaced at once by
+// renaming a new link over it. Names at the root of a volume that begin with
+// ".." are reserved for dataLink and the directories it may point to.
+const dataLink = "..data"
+
+// reserved returns true if the supplied name at the root of a volume is
+// reserved for dataLink and the directories it may point to.
+func reserved(name string) bool {
+	return strings.HasPrefix(name, "..")
+}
+
+func (sm *manager) Update(ctx context.Context, v *api.Volume) error {
+	log.Debug("updating volume", zap.String("id", v.ID))
+	if ok, err := sm.locks.lock(ctx, v.ID); err != nil {
+		return errors.Wrap(err, "cannot lock volume")
+	} else if !ok {
+		return ErrConflict("volume is being created, updated, or destroyed")
+	}
+	defer sm.locks.unlock(v.ID)
+
+	e, sp, err := sm.updatable(v.ID)
+	if err != nil {
+		return err
+	}
+	if v.Source != api.UnknownSecretSource && v.Source != e.Source {
+		return ErrConflict(fmt.Sprintf("cannot change volume source from %v to %v", e.Source, v.Source))
+	}
+	kp, err := sm.retained(v.ID, v.KeyPair)
+	if err != nil {
+		return err
+	}
+	u := *e
+	u.Tags, u.KeyPair = v.Tags, kp
+	put := false
+	rf, err := sm.refresh(ctx, sp, &u, func() error {
+		put = true
+		return errors.Wrap(sm.ms.Put(&u), "cannot write metadata")
+	})
+	if err != nil {
+		if put {
+			// The volume's secrets were not replaced, so neither is its
+			// metadata.
+			if err := sm.ms.Put(e); err != nil {
+				log.Error("cannot restore metadata", zap.String("id", v.ID), zap.Error(err))
+			}
+		}
+		return err
+	}
+	u.KeyPair = api.KeyPair{}
+	sm.idx.add(&u)
+	*v = u
+	log.Info("updated volume", zap.String("id", v.ID), zap.String("path", sm.m.Path(v.ID)), zap.Int("version", rf.Version))
+	return nil
+}
+
+func (sm *manager) Refresh(ctx context.Context, id string, kp api.KeyPair) (*api.Refresh, error) {
+	log.Debug("refreshing volume", zap.String("id", id))
+	if ok, err := sm.locks.lock(ctx, id); err != nil {
+		return nil, errors.Wrap(err, "cannot lock volume")
+	} else if !ok {
+		return nil, ErrConflict("volume is being created, updated, or destroyed")
+	}
+	defer sm.locks.unlock(id)
+
+	e, sp, err := sm.updatable(id)
+	if err != nil {
+		return nil, err
+	}
+	if kp, err = sm.retained(id, kp); err != nil {
+		return nil, err
+	}
+	u := *e
+	u.KeyPair = kp
+	rf, err := sm.refresh(ctx, sp, &u, nil)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("refreshed volume",
+		zap.String("id", id),
+		zap.Int("version", rf.Version),
+		zap.Int("added", len(rf.Added)),
+		zap.Int("removed", len(rf.Removed)),
+		zap.Int("changed", len(rf.Changed)))
+	return rf, nil
+}
+
+// updatable returns the supplied volume and the producer of its secrets if the
+// volume exists and is ready. The volume must be locked.
+func (sm *manager) updatable(id string) (*api.Volume, secrets.Producer, error) {
+	e, ok := sm.idx.get(id)
+	if !ok || sm.cleaning(id) {
+		return nil, nil, ErrNonExist("volume not found")
+	}
+	if !ready(e) {
+		return nil, nil, ErrConflict(fmt.Sprintf("volume is %v: %v", e.Status, e.Error))
+	}
+	sp, ok := sm.producerFor[e.Source]
+	if !ok {
+		return nil, nil, errors.New("no producer for secret type")
+	}
+	return e, sp, nil
+}
+
+// refresh produces fresh secrets for the supplied volume, which must be locked,
+// and replaces its existing secrets with them. The supplied commit function, if
+// any, is called once the fresh secrets are written but before they replace the
+// existing secrets. The volume's consumers are notified if its secrets changed.
+func (sm *manager) refresh(ctx context.Context, sp secrets.Producer, v *api.Volume, commit func() error) (*api.Refresh, error) {
+	v.Status, v.Mounted, v.Usage = api.VolumeReady, nil, nil
+	s, err := sp.For(ctx, v)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot produce secret")
+	}
+	defer s.Close()
+	if err := sm.retain(v); err != nil {
+		return nil, errors.Wrap(err, "cannot retain credentials")
+	}
+	var rf *api.Refresh
+	err = sm.writable(v.ID, func() error {
+		var err error
+		rf, err = sm.update(ctx, v, s, commit)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot update secrets")
+	}
+	sm.scheduleRenewal(v.ID, s)
+	if changed(rf) {
+		sm.notify(v)
+	}
+	return rf, nil
+}
+
+// changed returns true if the supplied refresh added, removed, or changed any
+// files.
+func changed(rf *api.Refresh) bool {
+	return len(rf.Added)+len(rf.Removed)+len(rf.Changed) > 0
+}
+
+// update writes the supplied secrets to a staging directory beneath the root
+// of the supplied volume, calls the supplied commit function if any, then
+// replaces the volume's existing secrets with the staged secrets. The existing
+// secrets are untouched unless all of the supplied secrets are written and
+// committed. It returns a description of the changes, which is also written to
+// the volume's version file.
+func (sm *manager) update(ctx context.Context, v *api.Volume, s api.Secrets, commit func() error) (rf *api.Refresh, err error) {
+	root := sm.m.Path(v.ID)
+	cur, err := sm.current(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := sm.removeStale(root, cur); err != nil {
+		return nil, errors.Wrap(err, "cannot remove stale staging directories")
+	}
+	before, err := sm.hashes(cur, sm.versionFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot hash existing secrets")
+	}
+	stage, err := sm.stage(v)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			sm.removeAll(stage)
+		}
+	}()
+
+	// Existing secrets and staged secrets must both fit in the volume.
+	q, err := sm.existingQuota(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot determine volume quota")
+	}
+	if err := sm.writeSecrets(ctx, v, stage, s, q); err != nil {
+		return nil, errors.Wrap(err, "cannot write secrets")
+	}
+	if err := sm.writeJSONSecrets(v, stage, s, q); err != nil {
+		return nil, errors.Wrap(err, "cannot write JSON secrets")
+	}
+	after, err := sm.hashes(stage)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot hash staged secrets")
+	}
+	rf = diff(before, after)
+	rf.ID, rf.Version, rf.Time = v.ID, sm.version(v)+1, time.Now()
+	if err := sm.writeVersion(v, stage, rf, q); err != nil {
+		return nil, errors.Wrap(err, "cannot write version file")
+	}
+	if err := sm.chownAll(stage, v.Owner); err != nil {
+		return nil, errors.Wrap(err, "cannot change ownership of staged secrets")
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			return nil, err
+		}
+	}
+	if err := sm.activate(v, stage); err != nil {
+		return nil, errors.Wrap(err, "cannot replace secrets")
+	}
+	return rf, nil
+}
+
+// current returns the directory containing the secrets of the volume at the
+// supplied root; the target of its data link, or the root itself if the
+// volume has no data link.
+func (sm *manager) current(root string) (string, error) {
+	l, ok := links(sm.fs)
+	if !ok {
+		return root, nil
+	}
+	t, err := l.Readlink(path.Join(root, dataLink))
+	if os.IsNotExist(err) {
+		// Volumes created before secrets were linked have no data link.
+		return root, nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "cannot read data link")
+	}
+	return path.Join(root, t), nil
+}
+
+// stage creates a new hidden directory beneath the root of the supplied volume
+// to which secrets may be written before they replace the volume's secrets.
+func (sm *manager) stage(v *api.Volume) (string, error) {
+	p := path.Join(sm.m.Path(v.ID), fmt.Sprintf("..%d", time.Now().UnixNano()))
+	return p, errors.Wrap(sm.fs.Mkdir(p, os.FileMode(sm.modes(v).Dir)), "cannot create staging directory")
+}
+
+// removeStale removes any reserved names at the supplied root, for example
+// staging directories left behind when the daemon stopped part way through an
+// update, except for the data link and the supplied current directory.
+func (sm *manager) removeStale(root, cur string) error {
+	fis, err := afero.ReadDir(sm.fs, root)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read %v", root)
+	}
+	for _, fi := range fis {
+		p := path.Join(root, fi.Name())
+		if !reserved(fi.Name()) || fi.Name() == dataLink || p == cur {
+			continue
+		}
+		log.Debug("removing stale file", zap.String("path", p))
+		if err := sm.removeAll(p); err != nil {
+			return errors.Wrapf(err, "cannot remove %v", p)
+		}
+	}
+	return nil
+}
+
+// activate replaces the secrets of the supplied volume with those in the
+// supplied staging directory. On filesystems that support symbolic links this
+// is done atomically by renaming a new link to the staging directory over the
+// volume's data link. Other filesystems, which are never visible to consumers,
+// fall back to moving each staged file into place.
+func (sm *manager) activate(v *api.Volume, stage string) error {
+	l, ok := links(sm.fs)
+	if !ok {
+		if err := sm.swap(v, stage); err != nil {
+			return err
+		}
+		return errors.Wrap(sm.chownAll(sm.m.Path(v.ID), v.Owner), "cannot change volume ownership")
+	}
+	root := sm.m.Path(v.ID)
+	tmp := path.Join(root, dataLink+".tmp")
+	if err := sm.fs.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot remove stale data link")
+	}
+	if err := l.Symlink(path.Base(stage), tmp); err != nil {
+		return errors.Wrap(err, "cannot create data link")
+	}
+	if err := sm.fs.Rename(tmp, path.Join(root, dataLink)); err != nil {
+		sm.fs.Remove(tmp)
+		return errors.Wrap(err, "cannot replace data link")
+	}
+	// The volume's secrets have now been replaced. Failing to tidy the root of
+	// the volume would not undo that, so such failures are only logged; they
+	// are retried by the volume's next update.
+	if err := sm.relink(l, v, stage); err != nil {
+		log.Error("cannot link secrets", zap.String("id", v.ID), zap.Error(err))
+	}
+	return nil
+}
+
+// relink ensures everything at the top of the supplied directory, which must be
+// the target of the supplied volume's data link, is linked to through the data
+// link from the root of the volume. Everything else at the root of the volume,
+// including its previous secrets, is removed.
+func (sm *manager) relink(l linker, v *api.Volume, dir string) error {
+	root := sm.m.Path(v.ID)
+	fis, err := afero.ReadDir(sm.fs, dir)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read %v", dir)
+	}
+	keep := map[string]bool{dataLink: true, path.Base(dir): true}
+	for _, fi := range fis {
+		keep[fi.Name()] = true
+		p, t := path.Join(root, fi.Name()), path.Join(dataLink, fi.Name())
+		if have, err := l.Readlink(p); err == nil && have == t {
+			continue
+		}
+		// Anything else by this name was written before secrets were linked.
+		if err := sm.removeAll(p); err != nil {
+			return errors.Wrapf(err, "cannot remove %v", p)
+		}
+		log.Debug("linking secret", zap.String("path", p), zap.String("target", t))
+		if err := l.Symlink(t, p); err != nil {
+			return errors.Wrapf(err, "cannot link %v", p)
+		}
+	}
+	fis, err = afero.ReadDir(sm.fs, root)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read %v", root)
+	}
+	for _, fi := range fis {
+		if keep[fi.Name()] {
+			continue
+		}
+		p := path.Join(root, fi.Name())
+		log.Debug("removing stale file", zap.String("path", p))
+		if err := sm.removeAll(p); err != nil {
+			return errors.Wrapf(err, "cannot remove %v", p)
+		}
+	}
+	return nil
+}
+
+// swap renames each file in the supplied staging directory over the file of
+// the same name in the supplied volume, then removes any files and directories
+// that were not staged, including the staging directory.
+func (sm *manager) swap(v *api.Volume, stage string) error {
+	root := sm.m.Path(v.ID)
+	keep := map[string]bool{root: true, stage: true}
+	err := sm.walk(stage, func(p string, fi os.FileInfo) error {
+		dst := path.Join(root, p[len(stage):])
+		keep[dst] = true
+		if fi.IsDir() {
+			return errors.Wrapf(sm.fs.MkdirAll(dst, os.FileMode(sm.modes(v).Dir)), "cannot create directory %v", dst)
+		}
+		log.Debug("replacing file", zap.String("path", dst))
+		err := sm.replace(dst, func() error { return sm.fs.Rename(p, dst) })
+		if err != nil {
+			if err := sm.removeAll(dst); err != nil {
+				return errors.Wrapf(err, "cannot remove %v", dst)
+			}
+			return errors.Wrapf(sm.fs.Rename(p, dst), "cannot rename %v", p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stale := []string{}
+	err = sm.walk(root, func(p string, _ os.FileInfo) error {
+		if !keep[p] && !strings.HasPrefix(p, stage+"/") {
+			stale = append(stale, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range append(stale, stage) {
+		log.Debug("removing stale file", zap.String("path", p))
+		if err := sm.removeAll(p); err != nil {
+			return errors.Wrapf(err, "cannot remove %v", p)
+		}
+	}
+	return nil
+}
+
+// walk calls fn for every file and directory beneath root, in lexical order.
+// The root itself is omitted.
+func (sm *manager) walk(root string, fn func(p string, fi os.FileInfo) error) error {
+	type entry struct {
+		p  string
+		fi os.FileInfo
+	}
+	es := []entry{}
+	err := sm.af.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root {
+			es = append(es, entry{filepath.ToSlash(p), fi})
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "cannot walk %v", root)
+	}
+	// Collect entries before calling fn, which may modify the tree.
+	for _, e := range es {
+		if err := fn(e.p, e.fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashes returns the hex encoded HMAC-SHA256 of each file beneath root, keyed
+// by its path relative to root. Files beneath the supplied paths, which may be
+// absolute or relative to root, are omitted.
+func (sm *manager) hashes(root string, omit ...string) (map[string]string, error) {
+	skip := func(p string) bool {
+		for _, o := range omit {
+			if o == "" {
+				continue
+			}
+			if !path.IsAbs(o) {
+				o = path.Join(root, o)
+			}
+			if p == o || strings.HasPrefix(p, o+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	hs := map[string]string{}
+	err := sm.walk(root, func(p string, fi os.FileInfo) error {
+		if fi.IsDir() || skip(p) {
+			return nil
+		}
+		f, err := sm.fs.Open(p)
+		if err != nil {
+			return errors.Wrapf(err, "cannot open %v", p)
+		}
+		defer f.Close()
+		h := hmac.New(sha256.New, sm.hashKey)
+		if _, err := io.Copy(h, f); err != nil {
+			return errors.Wrapf(err, "cannot read %v", p)
+		}
+		hs[strings.TrimPrefix(p, root+"/")] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	return hs, err
+}
+
+// diff describes how the supplied file hashes changed.
+func diff(before, after map[string]string) *api.Refresh {
+	rf := &api.Refresh{Added: []api.FileHash{}, Removed: []api.FileHash{}, Changed: []api.FileHash{}}
+	for _, p := range sortedKeys(after) {
+		h, ok := before[p]
+		switch {
+		case !ok:
+			rf.Added = append(rf.Added, api.FileHash{Path: p, HMAC: after[p]})
+		case h != after[p]:
+			rf.Changed = append(rf.Changed, api.FileHash{Path: p, HMAC: after[p]})
+		}
+	}
+	for _, p := range sortedKeys(before) {
+		if _, ok := after[p]; !ok {
+			rf.Removed = append(rf.Removed, api.FileHash{Path: p, HMAC: before[p]})
+		}
+	}
+	return rf
+}
+
+func sortedKeys(m map[string]string) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+// version returns the version recorded in the supplied volume's version file,
+// or zero if it has none.
+func (sm *manager) version(v *api.Volume) int {
+	if sm.versionFile == "" {
+		return 0
+	}
+	f, err := sm.fs.Open(path.Join(sm.m.Path(v.ID), sm.versionFile))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	rf, err := api.ReadRefreshJSON(f)
+	if err != nil {
+		log.Warn("cannot read version file", zap.String("id", v.ID), zap.Error(err))
+		return 0
+	}
+	return rf.Version
+}
+
+// writeVersion writes the supplied refresh to the version file beneath the
+// supplied root, if the Manager is configured to write version files.
+func (sm *manager) writeVersion(v *api.Volume, root string, rf *api.Refresh, q *quota) error {
+	if sm.versionFile == "" {
+		return nil
+	}
+	f, err := sm.createFile(v, root, sm.versionFile)
+	if err != nil {
+		return errors.Wrap(err, "cannot create version file")
+	}
+	defer f.Close()
+	return errors.Wrap(rf.WriteJSON(q.writer(f)), "cannot write version file")
+}